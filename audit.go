@@ -0,0 +1,231 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// A record of every url issued or denied, kept in the sql datastore or, for
+// the other stores, in memory
+package atm
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_ISSUED = "issued"
+	AUDIT_DENIED = "denied"
+	AUDIT_FAILED = "failed"
+	// The reason recorded for failures, the error itself is only logged as
+	// it may carry datastore details not for account owners
+	AUDIT_REASON_DATASTORE = "datastore error"
+
+	AUDIT_DEFAULT_LIMIT = 100
+	AUDIT_MAX_LIMIT     = 1000
+	// Entries kept by a MemoryAuditLog before the oldest are dropped
+	AUDIT_MEMORY_SIZE = 10000
+)
+
+type AuditEntry struct {
+	Id          int64      `json:"id"`
+	Time        time.Time  `json:"time"`
+	Outcome     string     `json:"outcome"`
+	Reason      string     `json:"reason,omitempty"`
+	RequestorId string     `json:"requestor_id"`
+	AccountId   string     `json:"account_id,omitempty"`
+	Account     string     `json:"account"`
+	Container   string     `json:"container"`
+	Object      string     `json:"object"`
+	Method      string     `json:"method"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RuleId      string     `json:"rule_id,omitempty"`
+	ClientIp    string     `json:"client_ip"`
+}
+
+// Which entries to list, newest first. Empty fields match everything
+type AuditFilter struct {
+	// Only entries requested by or for the account with this id
+	Viewer      string
+	RequestorId string
+	Account     string
+	Container   string
+	Object      string
+	Method      string
+	Outcome     string
+	Since       time.Time
+	Until       time.Time
+	// Only entries older than this id, for the next page
+	Before int64
+	Limit  int
+}
+
+func (f *AuditFilter) limit() int {
+	if f.Limit <= 0 {
+		return AUDIT_DEFAULT_LIMIT
+	}
+	if f.Limit > AUDIT_MAX_LIMIT {
+		return AUDIT_MAX_LIMIT
+	}
+	return f.Limit
+}
+
+func (f *AuditFilter) matches(e *AuditEntry) bool {
+	return ("" == f.Viewer || f.Viewer == e.RequestorId || f.Viewer == e.AccountId) &&
+		("" == f.RequestorId || f.RequestorId == e.RequestorId) &&
+		("" == f.Account || f.Account == e.Account) &&
+		("" == f.Container || f.Container == e.Container) &&
+		("" == f.Object || f.Object == e.Object) &&
+		("" == f.Method || strings.ToUpper(f.Method) == e.Method) &&
+		("" == f.Outcome || f.Outcome == e.Outcome) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Before <= 0 || e.Id < f.Before)
+}
+
+type AuditSink interface {
+	RecordAudit(e *AuditEntry) error
+}
+
+type AuditLog interface {
+	AuditSink
+	QueryAudit(f *AuditFilter) ([]*AuditEntry, error)
+}
+
+type teeAuditLog struct {
+	AuditLog
+	sinks []AuditSink
+}
+
+// An AuditLog also recording to each sink, after l has assigned the id
+func NewTeeAuditLog(l AuditLog, sinks ...AuditSink) AuditLog {
+	return &teeAuditLog{AuditLog: l, sinks: sinks}
+}
+
+func (t *teeAuditLog) RecordAudit(e *AuditEntry) error {
+	err := t.AuditLog.RecordAudit(e)
+	for _, s := range t.sinks {
+		if sinkErr := s.RecordAudit(e); nil == err {
+			err = sinkErr
+		}
+	}
+	return err
+}
+
+type MemoryAuditLog struct {
+	lock    sync.RWMutex
+	entries []*AuditEntry
+	next    int64
+}
+
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{next: 1}
+}
+
+func (m *MemoryAuditLog) RecordAudit(e *AuditEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e.Id = m.next
+	m.next++
+	m.entries = append(m.entries, e)
+	if len(m.entries) > AUDIT_MEMORY_SIZE {
+		m.entries = m.entries[len(m.entries)-AUDIT_MEMORY_SIZE:]
+	}
+	return nil
+}
+
+func (m *MemoryAuditLog) QueryAudit(f *AuditFilter) ([]*AuditEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []*AuditEntry
+	for i := len(m.entries) - 1; i >= 0 && len(found) < f.limit(); i-- {
+		if f.matches(m.entries[i]) {
+			found = append(found, m.entries[i])
+		}
+	}
+	return found, nil
+}
+
+func (d *Datastore) RecordAudit(e *AuditEntry) error {
+	expiresAt := int64(0)
+	if nil != e.ExpiresAt {
+		expiresAt = e.ExpiresAt.Unix()
+	}
+	_, err := d.pool.Exec(d.rebind("INSERT INTO audit_log (created_at, outcome, reason, requestor_id, account_id, "+
+		"account, container, object, method, expires_at, rule_id, client_ip) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		e.Time.Unix(), e.Outcome, e.Reason, e.RequestorId, e.AccountId, e.Account, e.Container, e.Object,
+		e.Method, expiresAt, e.RuleId, e.ClientIp)
+	return err
+}
+
+func (d *Datastore) QueryAudit(f *AuditFilter) ([]*AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	add := func(condition string, arg ...interface{}) {
+		where = append(where, condition)
+		args = append(args, arg...)
+	}
+	if "" != f.Viewer {
+		add("(requestor_id = ? OR account_id = ?)", f.Viewer, f.Viewer)
+	}
+	equal := map[string]string{
+		"requestor_id": f.RequestorId,
+		"account":      f.Account,
+		"container":    f.Container,
+		"object":       f.Object,
+		"method":       strings.ToUpper(f.Method),
+		"outcome":      f.Outcome,
+	}
+	for column, value := range equal {
+		if "" != value {
+			add(column+" = ?", value)
+		}
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= ?", f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		add("created_at < ?", f.Until.Unix())
+	}
+	if f.Before > 0 {
+		add("id < ?", f.Before)
+	}
+	query := "SELECT id, created_at, outcome, reason, requestor_id, account_id, account, container, object, " +
+		"method, expires_at, rule_id, client_ip FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, f.limit())
+
+	rows, err := d.pool.Query(d.rebind(query), args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*AuditEntry
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if nil != err {
+			return nil, err
+		}
+		found = append(found, e)
+	}
+	return found, rows.Err()
+}
+
+func scanAuditEntry(rows *sql.Rows) (*AuditEntry, error) {
+	e := &AuditEntry{}
+	var createdAt, expiresAt int64
+	err := rows.Scan(&e.Id, &createdAt, &e.Outcome, &e.Reason, &e.RequestorId, &e.AccountId, &e.Account,
+		&e.Container, &e.Object, &e.Method, &expiresAt, &e.RuleId, &e.ClientIp)
+	if nil != err {
+		return nil, err
+	}
+	e.Time = time.Unix(createdAt, 0).UTC()
+	if expiresAt > 0 {
+		expires := time.Unix(expiresAt, 0).UTC()
+		e.ExpiresAt = &expires
+	}
+	return e, nil
+}
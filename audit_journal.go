@@ -0,0 +1,372 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// A tamper evident copy of the audit log, as JSON lines each holding the
+// hash of the line before, with checkpoints signed by an ed25519 key
+package atm
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JOURNAL_ENTRY      = "entry"
+	JOURNAL_CHECKPOINT = "checkpoint"
+
+	JOURNAL_DEFAULT_MAX_SIZE            = 100 * 1024 * 1024
+	JOURNAL_DEFAULT_CHECKPOINT          = 100
+	JOURNAL_DEFAULT_CHECKPOINT_INTERVAL = time.Minute
+)
+
+type journalLine struct {
+	Seq       int64       `json:"seq"`
+	Prev      string      `json:"prev"`
+	Type      string      `json:"type"`
+	Time      time.Time   `json:"time"`
+	Entry     *AuditEntry `json:"entry,omitempty"`
+	Signature string      `json:"signature,omitempty"`
+}
+
+// What a checkpoint signs, committing to every line before it
+func (l *journalLine) checkpointMessage() []byte {
+	return []byte(fmt.Sprintf("atm-audit-checkpoint:%d:%s:%d", l.Seq, l.Prev, l.Time.Unix()))
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Appends audit entries to path, checkpointing every CheckpointEvery entries
+// and rotating path aside, to path.<time>, once it grows past MaxSize
+type AuditJournal struct {
+	MaxSize         int64
+	CheckpointEvery int
+	lock            sync.Mutex
+	path            string
+	key             ed25519.PrivateKey
+	file            *os.File
+	size            int64
+	seq             int64
+	prev            string
+	sinceCheckpoint int
+	stop            chan bool
+}
+
+// Open the journal at path, continuing the chain of any lines already in it
+func OpenAuditJournal(path string, key ed25519.PrivateKey) (*AuditJournal, error) {
+	j := &AuditJournal{
+		MaxSize:         JOURNAL_DEFAULT_MAX_SIZE,
+		CheckpointEvery: JOURNAL_DEFAULT_CHECKPOINT,
+		path:            path,
+		key:             key,
+	}
+	if err := j.resume(); nil != err {
+		return nil, err
+	}
+	if err := j.open(); nil != err {
+		return nil, err
+	}
+	// sign what an earlier run left unsigned, if it stopped uncleanly
+	if j.sinceCheckpoint > 0 {
+		if err := j.checkpoint(); nil != err {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// Also checkpoint every interval while there are unsigned entries, so they
+// are signed soon even when entries are few
+func (j *AuditJournal) CheckpointEach(interval time.Duration) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if nil != j.stop || interval <= 0 {
+		return
+	}
+	j.stop = make(chan bool)
+	go func(stop chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.checkpointPending(); nil != err {
+					log.Printf("audit journal: checkpoint: %s", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(j.stop)
+}
+
+func (j *AuditJournal) checkpointPending() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if nil == j.file || 0 == j.sinceCheckpoint {
+		return nil
+	}
+	return j.checkpoint()
+}
+
+// Pick up seq & prev from the last line of an existing journal, & how many
+// entries follow its last checkpoint
+func (j *AuditJournal) resume() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var last []byte
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+		l := &journalLine{}
+		if nil == json.Unmarshal(last, l) && JOURNAL_CHECKPOINT == l.Type {
+			j.sinceCheckpoint = 0
+		} else {
+			j.sinceCheckpoint++
+		}
+	}
+	if err := scanner.Err(); nil != err {
+		return err
+	}
+	if 0 == len(last) {
+		return nil
+	}
+	l := &journalLine{}
+	if err := json.Unmarshal(last, l); nil != err {
+		return errors.New(fmt.Sprintf("Unable to resume audit journal %s: %s", j.path, err.Error()))
+	}
+	j.seq, j.prev = l.Seq, lineHash(last)
+	return nil
+}
+
+func (j *AuditJournal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return err
+	}
+	info, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return err
+	}
+	j.file, j.size = f, info.Size()
+	return nil
+}
+
+func (j *AuditJournal) RecordAudit(e *AuditEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if nil == j.file {
+		return errors.New("Audit journal closed")
+	}
+	if err := j.append(&journalLine{Type: JOURNAL_ENTRY, Time: time.Now().UTC(), Entry: e}); nil != err {
+		return err
+	}
+	j.sinceCheckpoint++
+	if j.sinceCheckpoint >= j.CheckpointEvery {
+		if err := j.checkpoint(); nil != err {
+			return err
+		}
+	}
+	if j.size >= j.MaxSize {
+		return j.rotate()
+	}
+	return nil
+}
+
+// Write a final checkpoint & close the file
+func (j *AuditJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if nil == j.file {
+		return nil
+	}
+	if nil != j.stop {
+		close(j.stop)
+		j.stop = nil
+	}
+	err := j.checkpoint()
+	if closeErr := j.file.Close(); nil == err {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
+
+func (j *AuditJournal) append(l *journalLine) error {
+	l.Seq, l.Prev = j.seq+1, j.prev
+	if JOURNAL_CHECKPOINT == l.Type {
+		l.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(j.key, l.checkpointMessage()))
+	}
+	b, err := json.Marshal(l)
+	if nil != err {
+		return err
+	}
+	if _, err := j.file.Write(append(b, '\n')); nil != err {
+		return err
+	}
+	j.seq, j.prev = l.Seq, lineHash(b)
+	j.size += int64(len(b) + 1)
+	return nil
+}
+
+func (j *AuditJournal) checkpoint() error {
+	if err := j.append(&journalLine{Type: JOURNAL_CHECKPOINT, Time: time.Now().UTC()}); nil != err {
+		return err
+	}
+	j.sinceCheckpoint = 0
+	return j.file.Sync()
+}
+
+// End the current file with a checkpoint & start the next one with another,
+// so the chain carries on & a new file is never empty
+func (j *AuditJournal) rotate() error {
+	if err := j.checkpoint(); nil != err {
+		return err
+	}
+	if err := j.file.Close(); nil != err {
+		return err
+	}
+	j.file = nil
+	rotated := fmt.Sprintf("%s.%s", j.path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(j.path, rotated); nil != err {
+		return err
+	}
+	if err := j.open(); nil != err {
+		return err
+	}
+	return j.checkpoint()
+}
+
+type JournalReport struct {
+	// Anything but 1 means the start of the journal was not checked
+	FirstSeq    int64
+	Entries     int64
+	Checkpoints int64
+	LastSeq     int64
+	// Entries after the last checkpoint are chained but not yet signed
+	LastCheckpointSeq int64
+}
+
+// Check the chain through each journal file, given oldest first, & the
+// signature of every checkpoint. The first problem found is returned
+func VerifyAuditJournal(paths []string, public ed25519.PublicKey) (*JournalReport, error) {
+	r := &JournalReport{}
+	prev := ""
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if nil != err {
+			return r, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for n := 1; scanner.Scan(); n++ {
+			if err := r.verifyLine(scanner.Bytes(), &prev, public); nil != err {
+				f.Close()
+				return r, errors.New(fmt.Sprintf("%s:%d: %s", path, n, err.Error()))
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if nil != err {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+func (r *JournalReport) verifyLine(b []byte, prev *string, public ed25519.PublicKey) error {
+	l := &journalLine{}
+	if err := json.Unmarshal(b, l); nil != err {
+		return errors.New(fmt.Sprintf("Unreadable line: %s", err.Error()))
+	}
+	if 0 == r.LastSeq {
+		r.FirstSeq = l.Seq
+	}
+	if 0 != r.LastSeq && r.LastSeq+1 != l.Seq {
+		return errors.New(fmt.Sprintf("Expected seq %d, found %d", r.LastSeq+1, l.Seq))
+	}
+	if 0 != r.LastSeq && *prev != l.Prev {
+		return errors.New(fmt.Sprintf("Seq %d does not chain to the line before, modified or missing lines", l.Seq))
+	}
+	switch l.Type {
+	case JOURNAL_ENTRY:
+		if nil == l.Entry {
+			return errors.New(fmt.Sprintf("Seq %d has no entry", l.Seq))
+		}
+		r.Entries++
+	case JOURNAL_CHECKPOINT:
+		sig, err := base64.StdEncoding.DecodeString(l.Signature)
+		if nil != err || !ed25519.Verify(public, l.checkpointMessage(), sig) {
+			return errors.New(fmt.Sprintf("Checkpoint at seq %d has an invalid signature", l.Seq))
+		}
+		r.Checkpoints++
+		r.LastCheckpointSeq = l.Seq
+	default:
+		return errors.New(fmt.Sprintf("Seq %d has unknown type %s", l.Seq, l.Type))
+	}
+	r.LastSeq = l.Seq
+	*prev = lineHash(b)
+	return nil
+}
+
+// Read the base64 ed25519 seed in path, creating it if missing
+func LoadOrCreateJournalKey(path string) (ed25519.PrivateKey, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if nil != err {
+			return nil, err
+		}
+		text := base64.StdEncoding.EncodeToString(key.Seed())
+		return key, ioutil.WriteFile(path, []byte(text+"\n"), 0600)
+	}
+	return LoadJournalKey(path)
+}
+
+func LoadJournalKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if nil != err || ed25519.SeedSize != len(seed) {
+		return nil, errors.New(fmt.Sprintf("Invalid audit journal key in %s", path))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func ParseJournalPublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if nil != err || ed25519.PublicKeySize != len(b) {
+		return nil, errors.New("Invalid audit journal public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+func JournalPublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
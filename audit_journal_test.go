@@ -0,0 +1,121 @@
+package atm
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func journalFiles(t *testing.T, path string) []string {
+	rotated, err := filepath.Glob(path + ".*")
+	if nil != err {
+		t.Fatal(err)
+	}
+	sort.Strings(rotated)
+	return append(rotated, path)
+}
+
+func TestAuditJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key, err := LoadOrCreateJournalKey(filepath.Join(t.TempDir(), "journal.key"))
+	if nil != err {
+		t.Fatal("Unable to create journal key", err)
+	}
+	public := key.Public().(ed25519.PublicKey)
+
+	j, err := OpenAuditJournal(path, key)
+	if nil != err {
+		t.Fatal("Unable to open journal", err)
+	}
+	j.CheckpointEvery = 2
+	j.MaxSize = 1024
+	for i := 0; i < 10; i++ {
+		if err := j.RecordAudit(&AuditEntry{Id: int64(i + 1), Outcome: AUDIT_ISSUED, Account: "owner"}); nil != err {
+			t.Fatal("Unable to record", err)
+		}
+	}
+	j.Close()
+
+	// a restart carries on the chain
+	if j, err = OpenAuditJournal(path, key); nil != err {
+		t.Fatal("Unable to reopen journal", err)
+	}
+	j.RecordAudit(&AuditEntry{Id: 11, Outcome: AUDIT_DENIED, Account: "owner"})
+	j.Close()
+
+	files := journalFiles(t, path)
+	if len(files) < 2 {
+		t.Fatal("Expected the journal to have rotated", files)
+	}
+	r, err := VerifyAuditJournal(files, public)
+	if nil != err {
+		t.Fatal("Unexpected error verifying", err)
+	}
+	if 1 != r.FirstSeq || 11 != r.Entries || r.LastSeq != r.LastCheckpointSeq {
+		t.Error("Unexpected report", r)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := VerifyAuditJournal(files, ed25519.PublicKey(other)); nil == err {
+		t.Error("Expected checkpoints to fail with another key")
+	}
+	if _, err := VerifyAuditJournal(files[1:], public); nil != err {
+		t.Error("Expected a later run of files to verify on its own", err)
+	}
+	if _, err := VerifyAuditJournal(append([]string{files[1]}, files[0]), public); nil == err {
+		t.Error("Expected files out of order to fail")
+	}
+
+	b, _ := ioutil.ReadFile(files[0])
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	tampered := append([]string{}, lines...)
+	tampered[1] = strings.Replace(tampered[1], `"owner"`, `"other"`, 1)
+	ioutil.WriteFile(files[0], []byte(strings.Join(tampered, "\n")+"\n"), 0600)
+	if _, err := VerifyAuditJournal(files, public); nil == err {
+		t.Error("Expected a modified line to be detected")
+	}
+	removed := append(append([]string{}, lines[:1]...), lines[2:]...)
+	ioutil.WriteFile(files[0], []byte(strings.Join(removed, "\n")+"\n"), 0600)
+	if _, err := VerifyAuditJournal(files, public); nil == err {
+		t.Error("Expected a missing line to be detected")
+	}
+}
+
+func TestAuditJournalUnsignedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key, _ := LoadOrCreateJournalKey(filepath.Join(t.TempDir(), "journal.key"))
+	public := key.Public().(ed25519.PublicKey)
+
+	// a run that never got to Close
+	crashed, err := OpenAuditJournal(path, key)
+	if nil != err {
+		t.Fatal("Unable to open journal", err)
+	}
+	crashed.RecordAudit(&AuditEntry{Id: 1, Outcome: AUDIT_ISSUED, Account: "owner"})
+	crashed.RecordAudit(&AuditEntry{Id: 2, Outcome: AUDIT_ISSUED, Account: "owner"})
+	crashed.file.Close()
+
+	j, err := OpenAuditJournal(path, key)
+	if nil != err {
+		t.Fatal("Unable to reopen journal", err)
+	}
+	defer j.Close()
+	r, err := VerifyAuditJournal([]string{path}, public)
+	if nil != err || 2 != r.Entries || r.LastSeq != r.LastCheckpointSeq {
+		t.Error("Expected the entries left unsigned to be checkpointed on open", r, err)
+	}
+
+	j.CheckpointEach(10 * time.Millisecond)
+	j.RecordAudit(&AuditEntry{Id: 3, Outcome: AUDIT_DENIED, Account: "owner"})
+	for i := 0; i < 100 && (3 != r.Entries || r.LastSeq != r.LastCheckpointSeq); i++ {
+		time.Sleep(10 * time.Millisecond)
+		r, _ = VerifyAuditJournal([]string{path}, public)
+	}
+	if 3 != r.Entries || r.LastSeq != r.LastCheckpointSeq {
+		t.Error("Expected a timed checkpoint after the entry", r)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Sealing signing keys to the server's X25519 public key so they are not
+// readable by whatever terminates TLS in front of us
+package atm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	BOX_ALGORITHM = "x25519-aes256gcm"
+	// prefix of a value sealed to a BoxKey: box1:<base64 ephemeral key+nonce+ciphertext>
+	BOX_PREFIX = "box1:"
+	// prefix of a box public key fingerprint: sha256:<hex of the raw key>
+	BOX_FINGERPRINT_PREFIX = "sha256:"
+)
+
+type BoxPublicKey struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+// The server's key pair for receiving sealed signing keys
+type BoxKey struct {
+	private *ecdh.PrivateKey
+}
+
+func NewBoxKey() (*BoxKey, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if nil != err {
+		return nil, err
+	}
+	return &BoxKey{private: k}, nil
+}
+
+// Read the base64 private key in path, creating it if missing so every
+// restart, & every instance sharing the file, keeps the same public key
+func LoadOrCreateBoxKey(path string) (*BoxKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		k, err := NewBoxKey()
+		if nil != err {
+			return nil, err
+		}
+		text := base64.StdEncoding.EncodeToString(k.private.Bytes())
+		return k, ioutil.WriteFile(path, []byte(text+"\n"), 0600)
+	}
+	if nil != err {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("Invalid box key in %s: %s", path, err.Error()))
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("Invalid box key in %s: %s", path, err.Error()))
+	}
+	return &BoxKey{private: private}, nil
+}
+
+func (k *BoxKey) PublicKey() *BoxPublicKey {
+	return &BoxPublicKey{
+		Algorithm: BOX_ALGORITHM,
+		PublicKey: base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes()),
+	}
+}
+
+// The hash of the raw public key, what clients pin to be sure they seal
+// to the server rather than whatever answered for it
+func (p *BoxPublicKey) Fingerprint() string {
+	raw, err := base64.StdEncoding.DecodeString(p.PublicKey)
+	if nil != err {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return BOX_FINGERPRINT_PREFIX + hex.EncodeToString(sum[:])
+}
+
+// Whether p is the key pinned, given either as the base64 key itself or as
+// its fingerprint
+func (p *BoxPublicKey) Verify(pin string) error {
+	pin = strings.TrimSpace(pin)
+	expected := p.PublicKey
+	if lower := strings.ToLower(pin); strings.HasPrefix(lower, BOX_FINGERPRINT_PREFIX) {
+		expected = p.Fingerprint()
+		pin = lower
+	}
+	if BOX_ALGORITHM != p.Algorithm || "" == expected ||
+		1 != subtle.ConstantTimeCompare([]byte(expected), []byte(pin)) {
+		return errors.New(fmt.Sprintf("Server public key %s does not match the pinned key", p.Fingerprint()))
+	}
+	return nil
+}
+
+// Seal plain to the public key p, bound to context which must be given again
+// to open it
+func (p *BoxPublicKey) Seal(plain []byte, context string) (string, error) {
+	if BOX_ALGORITHM != p.Algorithm {
+		return "", errors.New(fmt.Sprintf("Unsupported box algorithm %s", p.Algorithm))
+	}
+	raw, err := base64.StdEncoding.DecodeString(p.PublicKey)
+	if nil != err {
+		return "", err
+	}
+	public, err := ecdh.X25519().NewPublicKey(raw)
+	if nil != err {
+		return "", err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if nil != err {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(public)
+	if nil != err {
+		return "", err
+	}
+	aead, err := boxAead(shared, ephemeral.PublicKey().Bytes(), raw)
+	if nil != err {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); nil != err {
+		return "", err
+	}
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = aead.Seal(out, nonce, plain, []byte(context))
+	return BOX_PREFIX + base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (k *BoxKey) Open(sealed, context string) ([]byte, error) {
+	if !strings.HasPrefix(sealed, BOX_PREFIX) {
+		return nil, errors.New("Not a sealed box")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, BOX_PREFIX))
+	if nil != err {
+		return nil, err
+	}
+	size := len(k.private.PublicKey().Bytes())
+	if len(raw) < size {
+		return nil, errors.New("Sealed box too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(raw[:size])
+	if nil != err {
+		return nil, err
+	}
+	shared, err := k.private.ECDH(ephemeral)
+	if nil != err {
+		return nil, err
+	}
+	aead, err := boxAead(shared, raw[:size], k.private.PublicKey().Bytes())
+	if nil != err {
+		return nil, err
+	}
+	raw = raw[size:]
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("Sealed box too short")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(context))
+	if nil != err {
+		return nil, errors.New("Unable to open sealed box")
+	}
+	return plain, nil
+}
+
+// AES-256-GCM keyed by a hash of the shared secret & both public keys
+func boxAead(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(BOX_ALGORITHM))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if nil != err {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
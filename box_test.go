@@ -0,0 +1,50 @@
+package atm
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBoxSealOpen(t *testing.T) {
+	k, err := NewBoxKey()
+	if nil != err {
+		t.Fatal("Unable to create box key", err)
+	}
+	sealed, err := k.PublicKey().Seal([]byte("swift-key"), "owner")
+	if nil != err {
+		t.Fatal("Unable to seal", err)
+	}
+	if plain, err := k.Open(sealed, "owner"); nil != err || "swift-key" != string(plain) {
+		t.Error("Expected to open the sealed key", string(plain), err)
+	}
+	if _, err := k.Open(sealed, "backup"); nil == err {
+		t.Error("Expected opening for another account to fail")
+	}
+	other, _ := NewBoxKey()
+	if _, err := other.Open(sealed, "owner"); nil == err {
+		t.Error("Expected opening with another key to fail")
+	}
+
+	pub := k.PublicKey()
+	for _, pin := range []string{pub.PublicKey, pub.Fingerprint(), strings.ToUpper(pub.Fingerprint())} {
+		if err := pub.Verify(pin); nil != err {
+			t.Error("Expected the key to match its pin", pin, err)
+		}
+	}
+	for _, pin := range []string{other.PublicKey().PublicKey, other.PublicKey().Fingerprint(), "sha256:", ""} {
+		if err := pub.Verify(pin); nil == err {
+			t.Error("Expected another pin to be refused", pin)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "box.key")
+	created, err := LoadOrCreateBoxKey(path)
+	if nil != err {
+		t.Fatal("Unable to create box key file", err)
+	}
+	loaded, err := LoadOrCreateBoxKey(path)
+	if nil != err || created.PublicKey().PublicKey != loaded.PublicKey().PublicKey {
+		t.Error("Expected the same key to be loaded again", err)
+	}
+}
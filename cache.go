@@ -145,6 +145,17 @@ func (c *Cache) Delete(key string) {
 	shard.lock.Unlock()
 }
 
+// Number of items across every shard
+func (c *Cache) Count() int {
+	count := 0
+	for _, shard := range *c {
+		shard.lock.RLock()
+		count += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return count
+}
+
 func (c *Cache) getShard(key string) (shard *shard) {
 	hasher := sha1.New()
 	hasher.Write([]byte(key))
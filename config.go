@@ -0,0 +1,226 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Server configuration from a YAML or JSON file, overridden by the
+// environment
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const DEFAULT_LISTEN = ":8080"
+
+// The layout of a config file, for example in yaml
+//
+//	listen: [":8080", "127.0.0.1:9090"]
+//	metrics_listen: 127.0.0.1:9100
+//	object_host: https://swift.example.org
+//	object_hosts:
+//	  archive: https://archive.example.org
+//	swift_hosts: [https://auth.example.org]
+//	default_duration: 5m
+//	max_duration: 24h
+//	hmac_expiration: 5m
+//	nonce_ttl: 10m
+//	database:
+//	  driver: postgres
+//	  host: db.example.org
+//	  name: atm
+//	  user: atm
+//	  password_file: /run/secrets/atm-db
+type ServerConfig struct {
+	Listen []string `yaml:"listen"`
+	// Where metrics are served instead of alongside the service, if anywhere
+	MetricsListen string `yaml:"metrics_listen"`
+	ObjectHost    string `yaml:"object_host"`
+	// Hosts for particular accounts, by account name
+	ObjectHosts map[string]string `yaml:"object_hosts"`
+	// Further hosts swift credentials may point at, besides the object hosts
+	SwiftHosts      []string      `yaml:"swift_hosts"`
+	DefaultDuration time.Duration `yaml:"default_duration"`
+	// The longest url lifetime handed out, 0 for no limit
+	MaxDuration    time.Duration  `yaml:"max_duration"`
+	HmacExpiration time.Duration  `yaml:"hmac_expiration"`
+	NonceTtl       time.Duration  `yaml:"nonce_ttl"`
+	DatastoreFile  string         `yaml:"datastore_file"`
+	Database       DatabaseConfig `yaml:"database"`
+}
+
+// Where the database is, either a url, a SQLite file or the parts of one
+type DatabaseConfig struct {
+	Driver     string `yaml:"driver"`
+	Url        string `yaml:"url"`
+	SqliteFile string `yaml:"sqlite_file"`
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	Name       string `yaml:"name"`
+	User       string `yaml:"user"`
+	// Re-read on SIGHUP, the password is never kept in the config itself
+	PasswordFile string `yaml:"password_file"`
+}
+
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Listen:          []string{DEFAULT_LISTEN},
+		ObjectHost:      HOST,
+		DefaultDuration: DURATION,
+		HmacExpiration:  HMAC_EXPIRATION,
+		NonceTtl:        NONCE_TTL,
+		Database: DatabaseConfig{
+			Driver: MYSQL_DRIVER,
+			Host:   "localhost",
+			Name:   "atm",
+		},
+	}
+}
+
+// Read path over the current settings, leaving those it does not mention.
+// JSON is read as the YAML it also is
+func (c *ServerConfig) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(b, c); nil != err {
+		return errors.New(fmt.Sprintf("Reading config %s: %s", path, err.Error()))
+	}
+	return nil
+}
+
+// Override settings from ATM_ environment variables, as found by getenv
+func (c *ServerConfig) ApplyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"ATM_METRICS_LISTEN":         &c.MetricsListen,
+		"ATM_OBJECT_HOST":            &c.ObjectHost,
+		"ATM_DATASTORE_FILE":         &c.DatastoreFile,
+		"ATM_DATABASE_DRIVER":        &c.Database.Driver,
+		"ATM_DATABASE_URL":           &c.Database.Url,
+		"ATM_DATABASE_FILE":          &c.Database.SqliteFile,
+		"ATM_DATABASE_HOST":          &c.Database.Host,
+		"ATM_DATABASE":               &c.Database.Name,
+		"ATM_DATABASE_USER":          &c.Database.User,
+		"ATM_DATABASE_PASSWORD_FILE": &c.Database.PasswordFile,
+	}
+	for name, value := range strs {
+		if v := getenv(name); "" != v {
+			*value = v
+		}
+	}
+	durations := map[string]*time.Duration{
+		"ATM_DEFAULT_DURATION": &c.DefaultDuration,
+		"ATM_MAX_DURATION":     &c.MaxDuration,
+		"ATM_HMAC_EXPIRATION":  &c.HmacExpiration,
+		"ATM_NONCE_TTL":        &c.NonceTtl,
+	}
+	for name, value := range durations {
+		if v := getenv(name); "" != v {
+			d, err := time.ParseDuration(v)
+			if nil != err {
+				return errors.New(fmt.Sprintf("Invalid %s: %s", name, v))
+			}
+			*value = d
+		}
+	}
+	if v := getenv("ATM_DATABASE_PORT"); "" != v {
+		port, err := strconv.Atoi(v)
+		if nil != err {
+			return errors.New(fmt.Sprintf("Invalid ATM_DATABASE_PORT: %s", v))
+		}
+		c.Database.Port = port
+	}
+	if v := getenv("ATM_LISTEN"); "" != v {
+		c.Listen = strings.Split(v, ",")
+	}
+	if v := getenv("ATM_SWIFT_HOSTS"); "" != v {
+		c.SwiftHosts = strings.Split(v, ",")
+	}
+	return nil
+}
+
+// Every problem with the settings, in one error
+func (c *ServerConfig) Validate() error {
+	var problems []string
+	if 0 == len(c.Listen) {
+		problems = append(problems, "no listen address")
+	}
+	for _, addr := range c.Listen {
+		if _, port, err := net.SplitHostPort(addr); nil != err || "" == port {
+			problems = append(problems, fmt.Sprintf("invalid listen address %q", addr))
+		}
+	}
+	if "" != c.MetricsListen {
+		if _, port, err := net.SplitHostPort(c.MetricsListen); nil != err || "" == port {
+			problems = append(problems, fmt.Sprintf("invalid metrics_listen address %q", c.MetricsListen))
+		}
+	}
+	if err := validHost(c.ObjectHost); nil != err {
+		problems = append(problems, fmt.Sprintf("object_host %s", err.Error()))
+	}
+	for account, host := range c.ObjectHosts {
+		if err := validHost(host); nil != err {
+			problems = append(problems, fmt.Sprintf("object_hosts %s %s", account, err.Error()))
+		}
+	}
+	for _, host := range c.SwiftHosts {
+		if err := validHost(host); nil != err {
+			problems = append(problems, fmt.Sprintf("swift_hosts %s", err.Error()))
+		}
+	}
+	if c.DefaultDuration < time.Second {
+		problems = append(problems, "default_duration must be at least 1s")
+	}
+	if c.MaxDuration < 0 {
+		problems = append(problems, "max_duration can not be negative")
+	} else if c.MaxDuration > 0 && c.DefaultDuration > c.MaxDuration {
+		problems = append(problems, "default_duration is longer than max_duration")
+	}
+	if c.HmacExpiration <= 0 {
+		problems = append(problems, "hmac_expiration must be positive")
+	}
+	if c.NonceTtl < 2*c.HmacExpiration {
+		problems = append(problems, "nonce_ttl must be at least twice hmac_expiration, or replays go unnoticed")
+	}
+	if "" != c.DatastoreFile && ("" != c.Database.Url || "" != c.Database.SqliteFile) {
+		problems = append(problems, "use either datastore_file or a database, not both")
+	}
+	if "" == c.DatastoreFile && "" == c.Database.Url && "" == c.Database.SqliteFile {
+		if MYSQL_DRIVER != c.Database.Driver && POSTGRES_DRIVER != c.Database.Driver {
+			problems = append(problems, fmt.Sprintf("unsupported database driver %q", c.Database.Driver))
+		}
+		if c.Database.Port < 0 || c.Database.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("invalid database port %d", c.Database.Port))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(fmt.Sprintf("Invalid config: %s", strings.Join(problems, "; ")))
+	}
+	return nil
+}
+
+// Every host registered swift credentials may have atm connect to
+func (c *ServerConfig) SwiftAllowedHosts() []string {
+	hosts := []string{c.ObjectHost}
+	for _, host := range c.ObjectHosts {
+		hosts = append(hosts, host)
+	}
+	return append(hosts, c.SwiftHosts...)
+}
+
+func validHost(host string) error {
+	u, err := url.Parse(host)
+	if nil != err || ("http" != u.Scheme && "https" != u.Scheme) || "" == u.Host {
+		return errors.New(fmt.Sprintf("%q is not an http or https url", host))
+	}
+	return nil
+}
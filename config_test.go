@@ -0,0 +1,82 @@
+package atm
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "atm.yaml")
+	contents := `
+listen: [":9000", "127.0.0.1:9001"]
+object_hosts:
+  archive: https://archive.example.org
+default_duration: 2m
+max_duration: 1h
+database:
+  driver: postgres
+  host: db.example.org
+`
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); nil != err {
+		t.Fatal("Unable to write config", err)
+	}
+	c := DefaultServerConfig()
+	if err := c.Load(file); nil != err {
+		t.Fatal("Unable to load config", err)
+	}
+	env := map[string]string{"ATM_MAX_DURATION": "30m", "ATM_DATABASE_PORT": "6432"}
+	if err := c.ApplyEnv(func(name string) string { return env[name] }); nil != err {
+		t.Fatal("Unable to apply environment", err)
+	}
+	if err := c.Validate(); nil != err {
+		t.Fatal("Expected a valid config", err)
+	}
+	if 2 != len(c.Listen) || 2*time.Minute != c.DefaultDuration || 30*time.Minute != c.MaxDuration ||
+		HOST != c.ObjectHost || "https://archive.example.org" != c.ObjectHosts["archive"] ||
+		POSTGRES_DRIVER != c.Database.Driver || 6432 != c.Database.Port || "atm" != c.Database.Name ||
+		NONCE_TTL != c.NonceTtl {
+		t.Error("Unexpected config", c)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("listne: [\":9000\"]\n"), 0600); nil != err {
+		t.Fatal("Unable to write config", err)
+	}
+	if err := DefaultServerConfig().Load(file); nil == err {
+		t.Error("Expected an unknown setting to be refused")
+	}
+	bad := map[string]string{"ATM_NONCE_TTL": "soon"}
+	if err := DefaultServerConfig().ApplyEnv(func(name string) string { return bad[name] }); nil == err {
+		t.Error("Expected an invalid duration to be refused")
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	for name, change := range map[string]func(c *ServerConfig){
+		"no listen":        func(c *ServerConfig) { c.Listen = nil },
+		"listen":           func(c *ServerConfig) { c.Listen = []string{"8080"} },
+		"metrics listen":   func(c *ServerConfig) { c.MetricsListen = "localhost" },
+		"swift host":       func(c *ServerConfig) { c.SwiftHosts = []string{"auth.example.org"} },
+		"object host":      func(c *ServerConfig) { c.ObjectHost = "swift.example.org" },
+		"account host":     func(c *ServerConfig) { c.ObjectHosts = map[string]string{"a": "ftp://x"} },
+		"default duration": func(c *ServerConfig) { c.DefaultDuration = 0 },
+		"max duration":     func(c *ServerConfig) { c.MaxDuration = time.Minute },
+		"hmac expiration":  func(c *ServerConfig) { c.HmacExpiration = 0 },
+		"nonce ttl":        func(c *ServerConfig) { c.NonceTtl = c.HmacExpiration },
+		"driver":           func(c *ServerConfig) { c.Database.Driver = "oracle" },
+		"both datastores": func(c *ServerConfig) {
+			c.DatastoreFile, c.Database.SqliteFile = "atm.yaml", "atm.db"
+		},
+	} {
+		c := DefaultServerConfig()
+		change(c)
+		if err := c.Validate(); nil == err || !strings.HasPrefix(err.Error(), "Invalid config") {
+			t.Error("Expected an invalid config", name, err)
+		}
+	}
+	if err := DefaultServerConfig().Validate(); nil != err {
+		t.Error("Expected the defaults to be valid", err)
+	}
+}
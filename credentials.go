@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Database passwords that can be read from a file & re-read to rotate them
+// without restarting
+package atm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// A database password, either fixed or kept in a file
+type PasswordSource struct {
+	file     string
+	lock     sync.RWMutex
+	password string
+}
+
+func StaticPassword(password string) *PasswordSource {
+	return &PasswordSource{password: password}
+}
+
+// The password in file, ignoring surrounding whitespace
+func NewPasswordFile(file string) (*PasswordSource, error) {
+	p := &PasswordSource{file: file}
+	return p, p.Reload()
+}
+
+func (p *PasswordSource) Password() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.password
+}
+
+// Read the file again, keeping the old password if that fails
+func (p *PasswordSource) Reload() error {
+	if "" == p.file {
+		return nil
+	}
+	b, err := ioutil.ReadFile(p.file)
+	if nil != err {
+		return err
+	}
+	password := strings.TrimSpace(string(b))
+	if "" == password {
+		return errors.New(fmt.Sprintf("No password in %s", p.file))
+	}
+	p.set(password)
+	return nil
+}
+
+func (p *PasswordSource) set(password string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.password = password
+}
+
+// Opens each new connection with the current password, so existing ones
+// keep working after a rotation while new ones use the new password
+type passwordConnector struct {
+	driver   driver.Driver
+	dsnFor   func(password string) string
+	password *PasswordSource
+}
+
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsnFor(c.password.Password()))
+}
+
+func (c *passwordConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// A Datastore connecting with the dsn made from the current password of p.
+// Call ReloadCredentials after the password changes
+func NewDatastoreWithPassword(driverName string, dsnFor func(password string) string,
+	p *PasswordSource) (*Datastore, error) {
+
+	db, err := sql.Open(driverName, "")
+	if nil != err {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	ds := &Datastore{driver: driverName}
+	ds.connector = &passwordConnector{driver: d, dsnFor: dsnFor, password: p}
+	ds.pool = sql.OpenDB(ds.connector)
+	if err := ds.Ping(); nil != err {
+		ds.pool.Close()
+		return nil, err
+	}
+	ds.SigningKeys = NewSigningKeys()
+	return ds, nil
+}
+
+// Re-read the password file, if connecting with one, going back to the
+// old password if the new one can not connect. Open connections are left
+// alone
+func (d *Datastore) ReloadCredentials() error {
+	if nil == d.connector {
+		return nil
+	}
+	p := d.connector.password
+	old := p.Password()
+	if err := p.Reload(); nil != err {
+		return err
+	}
+	conn, err := d.connector.Connect(context.Background())
+	if nil != err {
+		p.set(old)
+		return errors.New(fmt.Sprintf("Keeping the old password, the new one failed: %s", err.Error()))
+	}
+	return conn.Close()
+}
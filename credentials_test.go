@@ -0,0 +1,82 @@
+package atm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if _, err := NewPasswordFile(file); nil == err {
+		t.Error("Expected an error without the file")
+	}
+	if err := ioutil.WriteFile(file, []byte("  \n"), 0600); nil != err {
+		t.Fatal("Unable to write password", err)
+	}
+	if _, err := NewPasswordFile(file); nil == err {
+		t.Error("Expected an error for an empty file")
+	}
+	ioutil.WriteFile(file, []byte("first\n"), 0600)
+	p, err := NewPasswordFile(file)
+	if nil != err || "first" != p.Password() {
+		t.Fatal("Expected the password from the file", err)
+	}
+	ioutil.WriteFile(file, []byte("second"), 0600)
+	if err := p.Reload(); nil != err || "second" != p.Password() {
+		t.Error("Expected the new password after reloading", err)
+	}
+	if err := StaticPassword("fixed").Reload(); nil != err {
+		t.Error("Expected reloading a fixed password to do nothing", err)
+	}
+}
+
+func TestDatastoreReloadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	ioutil.WriteFile(file, []byte("first"), 0600)
+	p, err := NewPasswordFile(file)
+	if nil != err {
+		t.Fatal("Unable to read password", err)
+	}
+	var lock sync.Mutex
+	var used []string
+	// sqlite has no passwords, so a bad one is a file that can not be opened
+	dsnFor := func(password string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		used = append(used, password)
+		if "bad" == password {
+			return filepath.Join(dir, "missing", "atm.db")
+		}
+		return fmt.Sprintf("file:%s", filepath.Join(dir, "atm.db"))
+	}
+	ds, err := NewDatastoreWithPassword(SQLITE_DRIVER, dsnFor, p)
+	if nil != err {
+		t.Fatal("Unable to open datastore", err)
+	}
+	defer ds.Close()
+
+	ioutil.WriteFile(file, []byte("second"), 0600)
+	if err := ds.ReloadCredentials(); nil != err {
+		t.Fatal("Unexpected error reloading", err)
+	}
+	lock.Lock()
+	if "second" != used[len(used)-1] {
+		t.Error("Expected a connection with the new password", used)
+	}
+	lock.Unlock()
+
+	ioutil.WriteFile(file, []byte("bad"), 0600)
+	if err := ds.ReloadCredentials(); nil == err {
+		t.Error("Expected a password that can not connect to be refused")
+	}
+	if "second" != p.Password() {
+		t.Error("Expected the working password kept", p.Password())
+	}
+	if err := ds.Ping(); nil != err {
+		t.Error("Expected the datastore to keep working", err)
+	}
+}
@@ -0,0 +1,758 @@
+package atm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Run f against each datastore backend available. SQLite always, postgres
+// and mysql when ATM_TEST_POSTGRES_URL or ATM_TEST_MYSQL_URL name a
+// scratch database that may be wiped
+func forEachDatastore(t *testing.T, f func(*testing.T, *Datastore)) {
+	backends := map[string]string{
+		SQLITE_DRIVER:   "sqlite3://" + filepath.Join(t.TempDir(), "atm.db"),
+		POSTGRES_DRIVER: os.Getenv("ATM_TEST_POSTGRES_URL"),
+		MYSQL_DRIVER:    os.Getenv("ATM_TEST_MYSQL_URL"),
+	}
+	for name, raw := range backends {
+		if "" == raw {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			f(t, newTestDatastore(t, raw))
+		})
+	}
+}
+
+// Run f against every Store implementation, each holding the same
+// accounts & rules
+func forEachStore(t *testing.T, f func(*testing.T, Store)) {
+	forEachDatastore(t, func(t *testing.T, ds *Datastore) { f(t, ds) })
+	t.Run("memory", func(t *testing.T) { f(t, newTestMemoryDatastore(t)) })
+	t.Run("file", func(t *testing.T) { f(t, newTestFileDatastore(t)) })
+}
+
+func newTestMemoryDatastore(t *testing.T) *MemoryDatastore {
+	m := NewMemoryDatastore()
+	m.AddAccount("owner-key", "owner", "owner-secret")
+	m.AddAccount("backup-key", "backup", "backup-secret")
+	rules := []Rule{
+		{AccountId: "owner-key", RequestorId: "backup-key", Container: "^backups$",
+			Object: "^host-.*", Method: "PUT,POST", Duration: 60},
+		{AccountId: "owner-key", RequestorId: "backup-key", Container: "^public$",
+			Object: ".*", Method: "GET"},
+	}
+	for _, r := range rules {
+		if err := m.AddRule(r); nil != err {
+			t.Fatal("Unable to add rule", err)
+		}
+	}
+	return m
+}
+
+const testDatastoreYaml = `accounts:
+  - id: owner-key
+    name: owner
+    secret: owner-secret
+  - id: backup-key
+    name: backup
+    secret: backup-secret
+rules:
+  - account_id: owner-key
+    requestor_id: backup-key
+    container: ^backups$
+    object: ^host-.*
+    method: PUT,POST
+    duration: 60
+  - account_id: owner-key
+    requestor_id: backup-key
+    container: ^public$
+    object: .*
+    method: GET
+`
+
+func newTestFileDatastore(t *testing.T) *FileDatastore {
+	file := filepath.Join(t.TempDir(), "atm.yaml")
+	if err := ioutil.WriteFile(file, []byte(testDatastoreYaml), 0600); nil != err {
+		t.Fatal(err)
+	}
+	f, err := NewFileDatastore(file, 0)
+	if nil != err {
+		t.Fatal("Unable to load datastore file", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func newTestDatastore(t *testing.T, raw string) *Datastore {
+	driver, dsn, err := ParseDatabaseUrl(raw)
+	if nil != err {
+		t.Fatal("Invalid test database url", err)
+	}
+	ds, err := NewDatastore(driver, dsn)
+	if nil != err {
+		t.Fatal("Unable to open datastore", err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	resetTestDatastore(t, ds)
+	if _, err := ds.InitSchema(); nil != err {
+		t.Fatal("Unable to initialize schema", err)
+	}
+	seedTestDatastore(t, ds)
+	return ds
+}
+
+// Drop everything from a shared test database server
+func resetTestDatastore(t *testing.T, ds *Datastore) {
+	var statements []string
+	switch ds.driver {
+	case POSTGRES_DRIVER:
+		statements = []string{"DROP SCHEMA public CASCADE", "CREATE SCHEMA public"}
+	case MYSQL_DRIVER:
+		rows, err := ds.pool.Query("SHOW TABLES")
+		if nil != err {
+			t.Fatal(err)
+		}
+		statements = append(statements, "SET FOREIGN_KEY_CHECKS = 0")
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); nil != err {
+				t.Fatal(err)
+			}
+			statements = append(statements, "DROP TABLE `"+table+"`")
+		}
+		rows.Close()
+		statements = append(statements, "SET FOREIGN_KEY_CHECKS = 1")
+	default:
+		return
+	}
+	// A single connection, as the foreign key setting is per session
+	conn, err := ds.pool.Conn(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, s := range statements {
+		if _, err := conn.ExecContext(context.Background(), s); nil != err {
+			t.Fatal("Unable to reset test database", err)
+		}
+	}
+}
+
+func seedTestDatastore(t *testing.T, ds *Datastore) {
+	statements := []string{
+		"INSERT INTO accounts (id, name, secret) VALUES ('owner-key', 'owner', 'owner-secret')",
+		"INSERT INTO accounts (id, name, secret) VALUES ('backup-key', 'backup', 'backup-secret')",
+		"INSERT INTO rules (account_id, requestor_id, container, object, method, duration) " +
+			"VALUES ('owner-key', 'backup-key', '^backups$', '^host-.*', 'PUT,POST', 60)",
+		"INSERT INTO rules (account_id, requestor_id, container, object, method, duration) " +
+			"VALUES ('owner-key', 'backup-key', '^public$', '.*', 'GET', 0)",
+	}
+	for _, s := range statements {
+		if _, err := ds.pool.Exec(s); nil != err {
+			t.Fatal("Unable to seed datastore", err)
+		}
+	}
+}
+
+func TestDatastoreMigrations(t *testing.T) {
+	forEachDatastore(t, testDatastoreMigrations)
+}
+
+func testDatastoreMigrations(t *testing.T, ds *Datastore) {
+	if _, err := ds.InitSchema(); nil == err {
+		t.Error("Expected init of an initialized database to fail")
+	}
+	applied, err := ds.Migrate()
+	if nil != err || 0 != len(applied) {
+		t.Error("Expected no pending migrations", applied, err)
+	}
+	status, err := ds.MigrationStatus()
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if !m.Applied {
+			t.Error("Migration not applied", m.Version, m.Name)
+		}
+	}
+}
+
+func TestDatastoreAccount(t *testing.T) {
+	forEachStore(t, testDatastoreAccount)
+}
+
+func testDatastoreAccount(t *testing.T, ds Store) {
+	a, err := ds.Account("owner")
+	if nil != err || "owner-key" != a.Id {
+		t.Error("Did not find owner account", a, err)
+	}
+	a, err = ds.Account("nobody")
+	if nil != err || "" != a.Id {
+		t.Error("Should not have found an account", a, err)
+	}
+}
+
+func TestDatastoreApiKeySecret(t *testing.T) {
+	forEachStore(t, testDatastoreApiKeySecret)
+}
+
+func testDatastoreApiKeySecret(t *testing.T, ds Store) {
+	s, err := ds.ApiKeySecret("backup-key")
+	if nil != err || "backup-secret" != s {
+		t.Error("Did not get the backup secret", s, err)
+	}
+	if _, err = ds.ApiKeySecret("nobody"); nil == err {
+		t.Error("Expected an error for an unknown api key")
+	} else if _, ok := err.(UnknownApiKeyError); !ok {
+		t.Error("Expected an unknown api key told apart from lookup trouble", err)
+	}
+}
+
+func TestDatastoreKeyForRequest(t *testing.T) {
+	forEachStore(t, testDatastoreKeyForRequest)
+}
+
+func testDatastoreKeyForRequest(t *testing.T, ds Store) {
+	u := &UrlRequest{Account: "owner", Container: "backups", Object: "host-1/today.tgz", Method: "PUT"}
+	if _, _, err := ds.KeyForRequest(u, "backup-key"); nil == err {
+		t.Error("Expected an error without a signing key set")
+	}
+
+	ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	cases := []struct {
+		container string
+		object    string
+		method    string
+		requestor string
+		key       string
+		duration  int64
+	}{
+		{"backups", "host-1/today.tgz", "PUT", "backup-key", "swift-key", 60},
+		{"backups", "host-1/today.tgz", "POST", "backup-key", "swift-key", 60},
+		{"backups", "host-1/today.tgz", "GET", "backup-key", "", 0},
+		{"backups", "other/today.tgz", "PUT", "backup-key", "", 0},
+		{"public", "anything", "GET", "backup-key", "swift-key", 0},
+		{"public", "anything", "HEAD", "backup-key", "swift-key", 0},
+		{"public", "anything", "GET", "owner-key", "", 0},
+	}
+	for _, c := range cases {
+		u := &UrlRequest{Account: "owner", Container: c.container, Object: c.object, Method: c.method}
+		key, duration, err := ds.KeyForRequest(u, c.requestor)
+		if nil != err {
+			t.Error("Unexpected error", c, err)
+			continue
+		}
+		if c.key != key || c.duration != duration {
+			t.Error("Unexpected result for", c, key, duration)
+		}
+	}
+
+	ds.RemoveSigningKeyForAccount("owner-key")
+	if _, _, err := ds.KeyForRequest(u, "backup-key"); nil == err {
+		t.Error("Expected an error after removing the signing key")
+	}
+}
+
+func TestParseDatabaseUrl(t *testing.T) {
+	cases := []struct {
+		url    string
+		driver string
+		dsn    string
+	}{
+		{"postgres://atm:pw@db/atm?sslmode=disable", POSTGRES_DRIVER, "postgres://atm:pw@db/atm?sslmode=disable"},
+		{"mysql://atm:pw@db/atm", MYSQL_DRIVER, "atm:pw@tcp(db:3306)/atm"},
+		{"mysql://atm@db:3307/atm?parseTime=true", MYSQL_DRIVER, "atm:@tcp(db:3307)/atm?parseTime=true"},
+		{"sqlite3:///var/lib/atm.db", SQLITE_DRIVER, "file:/var/lib/atm.db?_foreign_keys=on"},
+		{"sqlite3:///var/lib/atm%3F%23.db", SQLITE_DRIVER, "file:/var/lib/atm%3F%23.db?_foreign_keys=on"},
+	}
+	for _, c := range cases {
+		driver, dsn, err := ParseDatabaseUrl(c.url)
+		if nil != err || c.driver != driver || c.dsn != dsn {
+			t.Error("Unexpected parse of", c.url, driver, dsn, err)
+		}
+	}
+	if _, _, err := ParseDatabaseUrl("oracle://db/atm"); nil == err {
+		t.Error("Expected an error for an unsupported scheme")
+	}
+}
+
+func TestSqliteDsn(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "atm?v=1#a.db")
+	ds, err := NewDatastore(SQLITE_DRIVER, SqliteDsn(file, nil))
+	if nil != err {
+		t.Fatal("Unable to open datastore", err)
+	}
+	ds.Close()
+	if _, err := os.Stat(file); nil != err {
+		t.Error("Expected the database at the path given", err)
+	}
+}
+
+func TestDatastoreRebind(t *testing.T) {
+	d := &Datastore{driver: POSTGRES_DRIVER}
+	if q := d.rebind("a = ? AND b = ?"); "a = $1 AND b = $2" != q {
+		t.Error("Unexpected postgres rebind", q)
+	}
+	d.driver = MYSQL_DRIVER
+	if q := d.rebind("a = ? AND b = ?"); "a = ? AND b = ?" != q {
+		t.Error("Unexpected mysql rebind", q)
+	}
+}
+
+func TestFileDatastoreReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "atm.json")
+	write := func(name string) {
+		contents := `{"accounts": [{"id": "owner-key", "name": "` + name + `", "secret": "s"}]}`
+		if err := ioutil.WriteFile(file, []byte(contents), 0600); nil != err {
+			t.Fatal(err)
+		}
+	}
+	write("owner")
+	f, err := NewFileDatastore(file, 10*time.Millisecond)
+	if nil != err {
+		t.Fatal("Unable to load datastore file", err)
+	}
+	defer f.Close()
+	f.AddSigningKeyForAccount("swift-key", "owner-key")
+
+	<-time.After(20 * time.Millisecond)
+	write("renamed")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(file, future, future)
+	<-time.After(100 * time.Millisecond)
+
+	if a, _ := f.Account("renamed"); "owner-key" != a.Id {
+		t.Error("Did not find account after reload", a)
+	}
+	if a, _ := f.Account("owner"); "" != a.Id {
+		t.Error("Old account still present after reload", a)
+	}
+	if "swift-key" != f.signingKeyFor("owner-key") {
+		t.Error("Signing key lost on reload")
+	}
+}
+
+func TestDatastoreEncryptSecrets(t *testing.T) {
+	forEachDatastore(t, testDatastoreEncryptSecrets)
+}
+
+func testDatastoreEncryptSecrets(t *testing.T, ds *Datastore) {
+	first, _ := NewKek("first")
+	changed, err := ds.EncryptSecrets(NewKeyRing(first))
+	if nil != err || 2 != changed {
+		t.Fatal("Expected both secrets to be encrypted", changed, err)
+	}
+	if _, err := ds.ApiKeySecret("backup-key"); nil == err {
+		t.Error("Expected an error reading an encrypted secret without a kek")
+	}
+	ds.SetKeyRing(NewKeyRing(first))
+	if s, err := ds.ApiKeySecret("backup-key"); nil != err || "backup-secret" != s {
+		t.Error("Unable to read encrypted secret", s, err)
+	}
+
+	second, _ := NewKek("second")
+	rotated := NewKeyRing(second, first)
+	if changed, err = ds.EncryptSecrets(rotated); nil != err || 2 != changed {
+		t.Fatal("Expected both secrets to be re-encrypted", changed, err)
+	}
+	if changed, err = ds.EncryptSecrets(rotated); nil != err || 0 != changed {
+		t.Error("Expected nothing left to encrypt", changed, err)
+	}
+	ds.SetKeyRing(NewKeyRing(second))
+	if s, err := ds.ApiKeySecret("owner-key"); nil != err || "owner-secret" != s {
+		t.Error("Unable to read re-encrypted secret", s, err)
+	}
+}
+
+func TestDatastorePersistSigningKeys(t *testing.T) {
+	forEachDatastore(t, testDatastorePersistSigningKeys)
+}
+
+func testDatastorePersistSigningKeys(t *testing.T, ds *Datastore) {
+	master, _ := NewKek("master")
+	ds.SetMasterKey(NewKeyRing(master))
+	if err := ds.AddSigningKeyForAccount("swift-key", "owner-key"); nil != err {
+		t.Fatal("Unable to save signing key", err)
+	}
+	if err := ds.AddSigningKeyForAccount("other-key", "backup-key"); nil != err {
+		t.Fatal("Unable to save signing key", err)
+	}
+	if err := ds.RemoveSigningKeyForAccount("backup-key"); nil != err {
+		t.Fatal("Unable to remove signing key", err)
+	}
+
+	// as if restarted, with an empty cache
+	ds.SigningKeys = NewSigningKeys()
+	if k := ds.signingKeyFor("owner-key"); "swift-key" != k {
+		t.Error("Signing key not read through from the database", k)
+	}
+	ds.SigningKeys = NewSigningKeys()
+	if loaded, err := ds.LoadSigningKeys(); nil != err || 1 != loaded {
+		t.Error("Expected to load one signing key", loaded, err)
+	}
+	if k := ds.SigningKeys.signingKeyFor("owner-key"); "swift-key" != k {
+		t.Error("Signing key not loaded", k)
+	}
+	if k := ds.signingKeyFor("backup-key"); "" != k {
+		t.Error("Removed signing key came back", k)
+	}
+
+	var stored string
+	ds.pool.QueryRow(ds.rebind("SELECT signing_key FROM signing_keys WHERE account_id = ?"), "owner-key").Scan(&stored)
+	if !IsSealed(stored) {
+		t.Error("Signing key not stored encrypted", stored)
+	}
+
+	other, _ := NewKek("other")
+	ds.SetMasterKey(NewKeyRing(other))
+	ds.SigningKeys = NewSigningKeys()
+	if k := ds.signingKeyFor("owner-key"); "" != k {
+		t.Error("Signing key opened with the wrong master key", k)
+	}
+}
+
+// A key activating after delay
+func testSigningKey(key string, delay time.Duration) *SigningKey {
+	k := NewSigningKey(key)
+	k.ActiveAt = k.ActiveAt.Add(delay)
+	return k
+}
+
+func TestStoreRotateSigningKey(t *testing.T) {
+	forEachStore(t, testStoreRotateSigningKey)
+}
+
+func testStoreRotateSigningKey(t *testing.T, ds Store) {
+	if d, ok := ds.(*Datastore); ok {
+		master, _ := NewKek("master")
+		d.SetMasterKey(NewKeyRing(master))
+	}
+	u := &UrlRequest{Account: "owner", Container: "backups", Object: "host-1/a.tgz", Method: "PUT"}
+	ds.AddSigningKeyForAccount("old-key", "owner-key")
+	ds.StageSigningKeyForAccount("owner-key", testSigningKey("new-key", time.Hour))
+	if k, _, _ := ds.KeyForRequest(u, "backup-key"); "old-key" != k {
+		t.Error("Expected the old key until the new one activates", k)
+	}
+	ds.StageSigningKeyForAccount("owner-key", testSigningKey("newer-key", time.Hour))
+	keys := ds.SigningKeysForAccount("owner-key")
+	if nil == keys || "newer-key" != keys.Primary.Key || "old-key" != keys.Secondary.Key {
+		t.Error("Expected a pending key to be replaced, keeping the active one", keys)
+	}
+
+	ds.StageSigningKeyForAccount("owner-key", testSigningKey("newest-key", -time.Second))
+	if k, _, _ := ds.KeyForRequest(u, "backup-key"); "newest-key" != k {
+		t.Error("Expected the newest key once active", k)
+	}
+	ds.AddSigningKeyForAccount("newest-key", "owner-key")
+	if keys := ds.SigningKeysForAccount("owner-key"); "old-key" != keys.Secondary.Key {
+		t.Error("Expected adding the primary again to change nothing", keys.Secondary)
+	}
+
+	if d, ok := ds.(*Datastore); ok {
+		d.SigningKeys = NewSigningKeys()
+		keys := d.SigningKeysForAccount("owner-key")
+		if nil == keys || "newest-key" != keys.Primary.Key || "old-key" != keys.Secondary.Key {
+			t.Error("Expected both keys to be persisted", keys)
+		}
+
+		// another replica rotated since this one last synced its cache
+		d.SigningKeys.setAccountKeys("owner-key", &AccountKeys{Primary: testSigningKey("old-key", 0)})
+		d.StageSigningKeyForAccount("owner-key", testSigningKey("replica-key", 0))
+		d.SigningKeys = NewSigningKeys()
+		keys = d.SigningKeysForAccount("owner-key")
+		if nil == keys || "replica-key" != keys.Primary.Key || nil == keys.Secondary || "newest-key" != keys.Secondary.Key {
+			t.Error("Expected staging from the persisted keys, not a stale cache", keys)
+		}
+	}
+}
+
+func TestStoreSigningKeyMetadata(t *testing.T) {
+	forEachStore(t, testStoreSigningKeyMetadata)
+}
+
+func testStoreSigningKeyMetadata(t *testing.T, ds Store) {
+	if d, ok := ds.(*Datastore); ok {
+		master, _ := NewKek("master")
+		d.SetMasterKey(NewKeyRing(master))
+	}
+	k := NewSigningKey("swift-key")
+	k.SetBy = "owner-key"
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	k.ExpiresAt = &expires
+	ds.StageSigningKeyForAccount("owner-key", k)
+
+	if d, ok := ds.(*Datastore); ok {
+		d.SigningKeys = NewSigningKeys()
+	}
+	status := NewKeyStatus("owner", ds.SigningKeysForAccount("owner-key"))
+	if KeyFingerprint("owner", "swift-key") != status.Signing || "" == status.Signing {
+		t.Error("Expected the fingerprint of the signing key", status.Signing)
+	}
+	if nil == status.Primary || "owner-key" != status.Primary.SetBy ||
+		nil == status.Primary.ExpiresAt || !expires.Equal(*status.Primary.ExpiresAt) {
+		t.Error("Expected key metadata to be kept", status.Primary)
+	}
+
+	expired := NewSigningKey("expired-key")
+	expired.ExpiresAt = &expired.SetAt
+	ds.StageSigningKeyForAccount("backup-key", expired)
+	if d, ok := ds.(*Datastore); ok {
+		d.SigningKeys = NewSigningKeys()
+	}
+	if keys := ds.SigningKeysForAccount("backup-key"); nil != keys {
+		t.Error("Expected an expired key to be dropped", keys.Primary)
+	}
+}
+
+func TestDatastoreSyncSigningKeys(t *testing.T) {
+	forEachDatastore(t, testDatastoreSyncSigningKeys)
+}
+
+func testDatastoreSyncSigningKeys(t *testing.T, ds *Datastore) {
+	master, _ := NewKek("master")
+	ds.SetMasterKey(NewKeyRing(master))
+	// another instance on the same database
+	other := &Datastore{SigningKeys: NewSigningKeys(), pool: ds.pool, driver: ds.driver, masterKey: ds.masterKey}
+
+	ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	if k := other.signingKeyFor("owner-key"); "swift-key" != k {
+		t.Error("Expected the other instance to read the key through", k)
+	}
+	last, err := other.SyncSigningKeys(0, time.Now())
+	if nil != err || 0 == last {
+		t.Fatal("Unexpected error syncing", last, err)
+	}
+
+	ds.AddSigningKeyForAccount("new-key", "owner-key")
+	if k := other.signingKeyFor("owner-key"); "swift-key" != k {
+		t.Error("Expected the other instance to still have the cached key", k)
+	}
+	if last, err = other.SyncSigningKeys(last, time.Now()); nil != err {
+		t.Fatal("Unexpected error syncing", err)
+	}
+	if k := other.signingKeyFor("owner-key"); "new-key" != k {
+		t.Error("Expected the new key after syncing", k)
+	}
+
+	ds.RemoveSigningKeyForAccount("owner-key")
+	if _, err = other.SyncSigningKeys(last, time.Now()); nil != err {
+		t.Fatal("Unexpected error syncing", err)
+	}
+	if k := other.SigningKeys.signingKeyFor("owner-key"); "" != k {
+		t.Error("Expected the removed key to be dropped after syncing", k)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, ds *Datastore) { testAuditLog(t, ds) })
+	t.Run("memory", func(t *testing.T) { testAuditLog(t, NewMemoryAuditLog()) })
+}
+
+func testAuditLog(t *testing.T, l AuditLog) {
+	now := time.Now().UTC().Truncate(time.Second)
+	entries := []*AuditEntry{
+		{Time: now.Add(-time.Hour), Outcome: AUDIT_ISSUED, RequestorId: "backup-key", AccountId: "owner-key",
+			Account: "owner", Container: "backups", Object: "a", Method: "PUT", ExpiresAt: &now, RuleId: "1"},
+		{Time: now, Outcome: AUDIT_DENIED, RequestorId: "backup-key", AccountId: "owner-key",
+			Account: "owner", Container: "backups", Object: "b", Method: "DELETE"},
+		{Time: now, Outcome: AUDIT_DENIED, RequestorId: "other-key", Account: "other", Container: "c",
+			Object: "d", Method: "GET"},
+	}
+	for _, e := range entries {
+		if err := l.RecordAudit(e); nil != err {
+			t.Fatal("Unable to record audit entry", err)
+		}
+	}
+
+	found, err := l.QueryAudit(&AuditFilter{Viewer: "owner-key"})
+	if nil != err || 2 != len(found) || "b" != found[0].Object {
+		t.Error("Expected the owner's 2 entries newest first", found, err)
+	}
+	found, _ = l.QueryAudit(&AuditFilter{Viewer: "backup-key", Method: "put"})
+	if 1 != len(found) || nil == found[0].ExpiresAt || !now.Equal(*found[0].ExpiresAt) || "1" != found[0].RuleId {
+		t.Error("Expected the PUT entry", found)
+	}
+	found, _ = l.QueryAudit(&AuditFilter{Since: now.Add(-time.Minute)})
+	if 2 != len(found) {
+		t.Error("Expected 2 entries since a minute ago", found)
+	}
+	page, _ := l.QueryAudit(&AuditFilter{Limit: 2})
+	rest, _ := l.QueryAudit(&AuditFilter{Limit: 2, Before: page[1].Id})
+	if 2 != len(page) || 1 != len(rest) || "a" != rest[0].Object {
+		t.Error("Expected a second page with the oldest entry", page, rest)
+	}
+}
+
+func TestGrantStore(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, ds *Datastore) { testGrantStore(t, ds) })
+	t.Run("memory", func(t *testing.T) { testGrantStore(t, NewMemoryGrantStore()) })
+}
+
+func testGrantStore(t *testing.T, gs GrantStore) {
+	now := time.Now().UTC().Truncate(time.Second)
+	token, id, err := NewGrantToken()
+	if nil != err || GrantId(token) != id {
+		t.Fatal("Unexpected grant token", token, id, err)
+	}
+	grants := []*Grant{
+		{Id: id, RequestorId: "backup-key", AccountId: "owner-key", Account: "owner", Container: "backups",
+			Object: "host-1/a.tgz", Method: "PUT", CreatedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)},
+		{Id: GrantId("other"), RequestorId: "other-key", Account: "other", Container: "c", Object: "d",
+			Method: "GET", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	if err := gs.CreateGrants(grants); nil != err {
+		t.Fatal("Unable to create grants", err)
+	}
+	if g, err := gs.Grant("missing"); nil != g || nil != err {
+		t.Error("Expected no grant", g, err)
+	}
+	gs.AddGrantBytes(id, 10, 0)
+	gs.AddGrantBytes(id, 5, 2)
+	gs.RevokeGrant(id)
+	g, err := gs.Grant(id)
+	if nil != err || nil == g || 15 != g.BytesIn || 2 != g.BytesOut || g.Usable(now) ||
+		!now.Add(time.Hour).Equal(g.ExpiresAt) {
+		t.Error("Expected a revoked grant with its bytes counted", g, err)
+	}
+	if !grants[1].Usable(now) || grants[1].Usable(now.Add(time.Hour)) {
+		t.Error("Expected the other grant usable until it expires")
+	}
+	found, err := gs.GrantsFor("owner-key", GRANTS_DEFAULT_LIMIT)
+	if nil != err || 1 != len(found) || id != found[0].Id {
+		t.Error("Expected the owner to find the grant for their account", found, err)
+	}
+
+	old := now.Add(-GRANT_RETENTION - time.Hour)
+	gs.CreateGrants([]*Grant{{Id: GrantId("old"), RequestorId: "backup-key", AccountId: "owner-key", Account: "owner",
+		Container: "backups", Object: "old.tgz", Method: "GET", CreatedAt: old, ExpiresAt: old.Add(time.Minute)}})
+	gs.CreateGrants([]*Grant{{Id: GrantId("newer"), RequestorId: "backup-key", AccountId: "owner-key", Account: "owner",
+		Container: "backups", Object: "newer.tgz", Method: "GET", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}})
+	if g, _ := gs.Grant(GrantId("old")); nil != g {
+		t.Error("Expected a grant long expired to be dropped", g)
+	}
+	found, err = gs.GrantsFor("backup-key", 1)
+	if nil != err || 1 != len(found) || GrantId("newer") != found[0].Id {
+		t.Error("Expected only the newest grant within the limit", found, err)
+	}
+	if 1 != GrantsLimit(1) || GRANTS_DEFAULT_LIMIT != GrantsLimit(0) || GRANTS_MAX_LIMIT != GrantsLimit(1<<20) {
+		t.Error("Unexpected grants limits")
+	}
+}
+
+func TestWebhookStore(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, ds *Datastore) {
+		testWebhookStore(t, ds)
+		kek, _ := NewKek("k1")
+		ds.SetKeyRing(NewKeyRing(kek))
+		testWebhookStore(t, ds)
+	})
+	t.Run("memory", func(t *testing.T) { testWebhookStore(t, NewMemoryWebhookStore()) })
+}
+
+func testWebhookStore(t *testing.T, ws WebhookStore) {
+	h := &Webhook{AccountId: "owner-key", Url: "https://hooks.example.org/atm", Events: []string{WEBHOOK_KEY_SET},
+		Container: "^backups$"}
+	if err := h.Prepare(); nil != err || "" == h.Id || "" == h.Secret {
+		t.Fatal("Unexpected prepared webhook", h, err)
+	}
+	if err := (&Webhook{Url: "ftp://example.org"}).Prepare(); nil == err {
+		t.Error("Expected a non http url to be refused")
+	}
+	if err := ws.AddWebhook(h); nil != err {
+		t.Fatal("Unable to add webhook", err)
+	}
+	found, err := ws.WebhooksFor("owner-key")
+	if nil != err || 1 != len(found) || h.Secret != found[0].Secret || 1 != len(found[0].Events) ||
+		"^backups$" != found[0].Container {
+		t.Fatal("Expected the webhook back", found, err)
+	}
+
+	e := NewWebhookEvent(WEBHOOK_URL_ISSUED)
+	e.AccountId = "owner-key"
+	ws.RecordDeadLetter(&DeadLetter{WebhookId: h.Id, AccountId: "owner-key", Url: h.Url, Event: e, Attempts: 3,
+		LastError: "down", Time: time.Now()})
+	letters, err := ws.DeadLetters("owner-key")
+	if nil != err || 1 > len(letters) || e.Id != letters[0].Event.Id || 3 != letters[0].Attempts {
+		t.Error("Expected the dead letter back", letters, err)
+	}
+
+	ws.RemoveWebhook("other-key", h.Id)
+	ws.RemoveWebhook("owner-key", h.Id)
+	if found, _ := ws.WebhooksFor("owner-key"); 0 != len(found) {
+		t.Error("Expected the webhook removed", found)
+	}
+}
+
+func TestDatastoreRateLimits(t *testing.T) {
+	forEachDatastore(t, testDatastoreRateLimits)
+}
+
+func testDatastoreRateLimits(t *testing.T, ds *Datastore) {
+	if r, err := ds.RateLimitFor("backup-key"); nil != r || nil != err {
+		t.Error("Expected no override", r, err)
+	}
+	ds.SetRateLimit(RateLimit{RequestorId: "backup-key", PerMinute: 10, Burst: 2})
+	ds.SetRateLimit(RateLimit{RequestorId: "backup-key", PerMinute: 20, Burst: 5})
+	if r, err := ds.RateLimitFor("backup-key"); nil == r || 20 != r.PerMinute || 5 != r.Burst || nil != err {
+		t.Error("Expected the latest override", r, err)
+	}
+	if limits, _ := ds.RateLimits(); 1 != len(limits) {
+		t.Error("Expected one override listed", limits)
+	}
+	ds.RemoveRateLimit("backup-key")
+	if r, _ := ds.RateLimitFor("backup-key"); nil != r {
+		t.Error("Expected the override removed", r)
+	}
+}
+
+func TestDatastoreAllowedNetworks(t *testing.T) {
+	forEachDatastore(t, testDatastoreAllowedNetworks)
+}
+
+func testDatastoreAllowedNetworks(t *testing.T, ds *Datastore) {
+	if networks, err := ds.AllowedNetworks("backup-key"); 0 != len(networks) || nil != err {
+		t.Error("Expected no networks by default", networks, err)
+	}
+	if err := ds.SetAllowedNetworks("backup-key", []string{"10.1.0.0/16", "192.0.2.7"}); nil != err {
+		t.Fatal("Unable to set networks", err)
+	}
+	if networks, _ := ds.AllowedNetworks("backup-key"); 2 != len(networks) || "192.0.2.7/32" != networks[1].String() {
+		t.Error("Expected the networks back", networks)
+	}
+	if err := ds.SetAllowedNetworks("backup-key", []string{"10.1.0.0/16", "192.0.2.7"}); nil != err {
+		t.Error("Expected setting the same networks again to succeed", err)
+	}
+	if err := ds.SetAllowedNetworks("missing-key", nil); nil == err {
+		t.Error("Expected an unknown api key to fail")
+	}
+	if err := ds.SetAllowedNetworks("backup-key", []string{"nope"}); nil == err {
+		t.Error("Expected an invalid network to fail")
+	}
+}
+
+func TestDatastoreSealConfig(t *testing.T) {
+	forEachDatastore(t, testDatastoreSealConfig)
+}
+
+func testDatastoreSealConfig(t *testing.T, ds *Datastore) {
+	if c, err := ds.SealConfig(); nil != err || nil != c {
+		t.Error("Expected no seal config", c, err)
+	}
+	config, _, _ := NewSealedMasterKey("sealed", 3, 2)
+	if err := ds.SaveSealConfig(config, false); nil != err {
+		t.Fatal("Unable to save seal config", err)
+	}
+	if err := ds.SaveSealConfig(config, false); nil == err {
+		t.Error("Expected an existing seal config to be kept")
+	}
+	c, err := ds.SealConfig()
+	if nil != err || nil == c || !reflect.DeepEqual(config, c) {
+		t.Error("Seal config did not round trip", c, err)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// A Store loaded from a YAML or JSON file, reloaded when the file changes
+package atm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The layout of a datastore file, for example in yaml
+//
+//	accounts:
+//	  - id: 5f0c...
+//	    name: backups
+//	    secret: s3cr3t
+//	    allowed_networks: [10.1.0.0/16]
+//	rules:
+//	  - account_id: 5f0c...
+//	    requestor_id: 9a1b...
+//	    container: ^nightly$
+//	    object: .*
+//	    method: PUT,POST
+//	    duration: 300
+//	rate_limits:
+//	  - requestor_id: 9a1b...
+//	    per_minute: 6000
+//	    burst: 100
+type datastoreFile struct {
+	Accounts   []fileAccount `json:"accounts" yaml:"accounts"`
+	Rules      []Rule        `json:"rules" yaml:"rules"`
+	RateLimits []RateLimit   `json:"rate_limits" yaml:"rate_limits"`
+}
+
+type fileAccount struct {
+	Id              string   `json:"id" yaml:"id"`
+	Name            string   `json:"name" yaml:"name"`
+	Secret          string   `json:"secret" yaml:"secret"`
+	AllowedNetworks []string `json:"allowed_networks" yaml:"allowed_networks"`
+}
+
+type FileDatastore struct {
+	*MemoryDatastore
+	path    string
+	lock    sync.Mutex
+	modTime time.Time
+	stop    chan bool
+}
+
+// Load path, checking every interval for changes to reload. An interval of
+// 0 disables reloading
+func NewFileDatastore(path string, interval time.Duration) (*FileDatastore, error) {
+	f := &FileDatastore{
+		MemoryDatastore: NewMemoryDatastore(),
+		path:            path,
+	}
+	if err := f.Reload(); nil != err {
+		return nil, err
+	}
+	if interval > 0 {
+		f.stop = make(chan bool)
+		go f.watch(interval, f.stop)
+	}
+	return f, nil
+}
+
+func (f *FileDatastore) watch(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.reloadIfChanged(); nil != err {
+				log.Printf("Reloading %s: %s", f.path, err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (f *FileDatastore) reloadIfChanged() error {
+	info, err := os.Stat(f.path)
+	if nil != err {
+		return err
+	}
+	f.lock.Lock()
+	changed := !info.ModTime().Equal(f.modTime)
+	f.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	return f.Reload()
+}
+
+// Read the file again, replacing all accounts, rules & rate limits if it is valid.
+// Signing keys are kept as they are never stored in the file
+func (f *FileDatastore) Reload() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	info, err := os.Stat(f.path)
+	if nil != err {
+		return err
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if nil != err {
+		return err
+	}
+	contents := &datastoreFile{}
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, contents)
+	case ".json":
+		err = json.Unmarshal(b, contents)
+	default:
+		err = errors.New(fmt.Sprintf("Unknown datastore file type %s, expected .yaml or .json", f.path))
+	}
+	if nil != err {
+		return err
+	}
+
+	accounts := make(map[string]*memoryAccount, len(contents.Accounts))
+	for _, a := range contents.Accounts {
+		if "" == a.Id || "" == a.Name {
+			return errors.New("Every account needs an id and name")
+		}
+		networks, err := ParseNetworks(a.AllowedNetworks)
+		if nil != err {
+			return err
+		}
+		accounts[a.Name] = &memoryAccount{Account: Account{Id: a.Id, Name: a.Name}, secret: a.Secret,
+			networks: networks}
+	}
+	rules := make([]*Rule, 0, len(contents.Rules))
+	for i := range contents.Rules {
+		r := contents.Rules[i]
+		if err := r.compile(); nil != err {
+			return err
+		}
+		rules = append(rules, &r)
+	}
+	rateLimits := make(map[string]*RateLimit, len(contents.RateLimits))
+	for i := range contents.RateLimits {
+		r := contents.RateLimits[i]
+		if "" == r.RequestorId {
+			return errors.New("Every rate limit needs a requestor_id")
+		}
+		rateLimits[r.RequestorId] = &r
+	}
+	f.MemoryDatastore.replace(accounts, rules, rateLimits)
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func (f *FileDatastore) Close() error {
+	if nil != f.stop {
+		close(f.stop)
+		f.stop = nil
+	}
+	return nil
+}
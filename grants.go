@@ -0,0 +1,248 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Grants behind the opaque urls of proxy mode. Only a hash of each token is
+// kept, so the stored grants can not be used to make requests
+package atm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	GRANT_TOKEN_SIZE = 32
+	// How long grants are kept after they expire, so their traffic can still
+	// be listed
+	GRANT_RETENTION      = 24 * time.Hour
+	GRANTS_DEFAULT_LIMIT = 100
+	GRANTS_MAX_LIMIT     = 1000
+)
+
+// The number of grants to list for a requested limit, 0 for the default
+func GrantsLimit(limit int) int {
+	if limit <= 0 {
+		return GRANTS_DEFAULT_LIMIT
+	}
+	if limit > GRANTS_MAX_LIMIT {
+		return GRANTS_MAX_LIMIT
+	}
+	return limit
+}
+
+type Grant struct {
+	// Hash of the token, how the grant is named when listing or revoking
+	Id          string     `json:"id"`
+	RequestorId string     `json:"requestor_id"`
+	AccountId   string     `json:"account_id"`
+	Account     string     `json:"account"`
+	Container   string     `json:"container"`
+	Object      string     `json:"object"`
+	Method      string     `json:"method"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	BytesIn     int64      `json:"bytes_in"`
+	BytesOut    int64      `json:"bytes_out"`
+}
+
+// Can the grant be used at now
+func (g *Grant) Usable(now time.Time) bool {
+	return nil == g.RevokedAt && now.Before(g.ExpiresAt)
+}
+
+// A new random token & its id
+func NewGrantToken() (string, string, error) {
+	b := make([]byte, GRANT_TOKEN_SIZE)
+	if _, err := rand.Read(b); nil != err {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, GrantId(token), nil
+}
+
+func GrantId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type GrantStore interface {
+	// Every one of grants, or none of them. Grants expired longer than
+	// GRANT_RETENTION ago are dropped along the way
+	CreateGrants(grants []*Grant) error
+	// nil if there is no such grant
+	Grant(id string) (*Grant, error)
+	RevokeGrant(id string) error
+	AddGrantBytes(id string, in, out int64) error
+	// Up to limit grants requested by, or for the account of, viewer, newest
+	// first
+	GrantsFor(viewer string, limit int) ([]*Grant, error)
+}
+
+type MemoryGrantStore struct {
+	lock   sync.RWMutex
+	grants map[string]*Grant
+}
+
+func NewMemoryGrantStore() *MemoryGrantStore {
+	return &MemoryGrantStore{grants: make(map[string]*Grant)}
+}
+
+func (m *MemoryGrantStore) CreateGrants(grants []*Grant) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cutoff := time.Now().Add(-GRANT_RETENTION)
+	for id, g := range m.grants {
+		if g.ExpiresAt.Before(cutoff) {
+			delete(m.grants, id)
+		}
+	}
+	for _, g := range grants {
+		copy := *g
+		m.grants[g.Id] = &copy
+	}
+	return nil
+}
+
+func (m *MemoryGrantStore) Grant(id string) (*Grant, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	g, found := m.grants[id]
+	if !found {
+		return nil, nil
+	}
+	copy := *g
+	return &copy, nil
+}
+
+func (m *MemoryGrantStore) RevokeGrant(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if g, found := m.grants[id]; found && nil == g.RevokedAt {
+		now := time.Now().UTC()
+		g.RevokedAt = &now
+	}
+	return nil
+}
+
+func (m *MemoryGrantStore) AddGrantBytes(id string, in, out int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if g, found := m.grants[id]; found {
+		g.BytesIn += in
+		g.BytesOut += out
+	}
+	return nil
+}
+
+func (m *MemoryGrantStore) GrantsFor(viewer string, limit int) ([]*Grant, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []*Grant
+	for _, g := range m.grants {
+		if viewer == g.RequestorId || viewer == g.AccountId {
+			copy := *g
+			found = append(found, &copy)
+		}
+	}
+	// newest first, like the sql store
+	for i := 1; i < len(found); i++ {
+		for j := i; j > 0 && found[j].CreatedAt.After(found[j-1].CreatedAt); j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+		}
+	}
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+const grantColumns = "id, requestor_id, account_id, account, container, object, method, created_at, " +
+	"expires_at, revoked_at, bytes_in, bytes_out"
+
+func (d *Datastore) CreateGrants(grants []*Grant) error {
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("DELETE FROM grants WHERE expires_at < ?"), time.Now().Add(-GRANT_RETENTION).Unix())
+	if nil != err {
+		tx.Rollback()
+		return err
+	}
+	for _, g := range grants {
+		_, err := tx.Exec(d.rebind("INSERT INTO grants ("+grantColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0)"),
+			g.Id, g.RequestorId, g.AccountId, g.Account, g.Container, g.Object, g.Method, g.CreatedAt.Unix(),
+			g.ExpiresAt.Unix())
+		if nil != err {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *Datastore) Grant(id string) (*Grant, error) {
+	rows, err := d.pool.Query(d.rebind("SELECT "+grantColumns+" FROM grants WHERE id = ?"), id)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanGrant(rows)
+}
+
+func (d *Datastore) RevokeGrant(id string) error {
+	_, err := d.pool.Exec(d.rebind("UPDATE grants SET revoked_at = ? WHERE id = ? AND revoked_at = 0"),
+		time.Now().Unix(), id)
+	return err
+}
+
+func (d *Datastore) AddGrantBytes(id string, in, out int64) error {
+	_, err := d.pool.Exec(d.rebind("UPDATE grants SET bytes_in = bytes_in + ?, bytes_out = bytes_out + ? WHERE id = ?"),
+		in, out, id)
+	return err
+}
+
+func (d *Datastore) GrantsFor(viewer string, limit int) ([]*Grant, error) {
+	rows, err := d.pool.Query(d.rebind("SELECT "+grantColumns+" FROM grants "+
+		"WHERE requestor_id = ? OR account_id = ? ORDER BY created_at DESC LIMIT ?"), viewer, viewer, limit)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*Grant
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if nil != err {
+			return nil, err
+		}
+		found = append(found, g)
+	}
+	return found, rows.Err()
+}
+
+func scanGrant(rows *sql.Rows) (*Grant, error) {
+	g := &Grant{}
+	var createdAt, expiresAt, revokedAt int64
+	err := rows.Scan(&g.Id, &g.RequestorId, &g.AccountId, &g.Account, &g.Container, &g.Object, &g.Method,
+		&createdAt, &expiresAt, &revokedAt, &g.BytesIn, &g.BytesOut)
+	if nil != err {
+		return nil, err
+	}
+	g.CreatedAt = time.Unix(createdAt, 0).UTC()
+	g.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	if revokedAt > 0 {
+		revoked := time.Unix(revokedAt, 0).UTC()
+		g.RevokedAt = &revoked
+	}
+	return g, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Unauthenticated liveness & readiness checks for orchestrators
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	HEALTH_OK        = "ok"
+	HEALTH_FAILED    = "failed"
+	HEALTH_NOT_READY = "not_ready"
+)
+
+// Only the outcome, why a check failed is logged rather than told to
+// whoever asks
+type HealthCheck struct {
+	Status string `json:"status"`
+}
+
+type Health struct {
+	Status string                  `json:"status"`
+	Checks map[string]*HealthCheck `json:"checks,omitempty"`
+}
+
+// The process is up & serving
+func (s *Server) healthz(c *echo.Context) error {
+	return c.JSON(http.StatusOK, &Health{Status: HEALTH_OK})
+}
+
+// Ready when the datastore answers, nonces can be checked, the service is
+// unsealed & every required account has a signing key
+func (s *Server) readyz(c *echo.Context) error {
+	h := s.readiness(requestLog(c), time.Now())
+	if HEALTH_OK != h.Status {
+		return c.JSON(http.StatusServiceUnavailable, h)
+	}
+	return c.JSON(http.StatusOK, h)
+}
+
+func (s *Server) readiness(l *slog.Logger, now time.Time) *Health {
+	h := &Health{Status: HEALTH_OK, Checks: make(map[string]*HealthCheck)}
+	check := func(name string, err error) {
+		if nil != err {
+			l.Warn("readiness", "check", name, "error", err)
+			h.Checks[name] = &HealthCheck{Status: HEALTH_FAILED}
+			h.Status = HEALTH_NOT_READY
+			return
+		}
+		h.Checks[name] = &HealthCheck{Status: HEALTH_OK}
+	}
+	check("datastore", s.Ds.Ping())
+	check("nonces", s.checkNonces())
+	if nil != s.Seal {
+		if s.sealed() {
+			check("seal", errors.New("Service is sealed"))
+		} else {
+			check("seal", nil)
+		}
+	}
+	for _, name := range s.Required_accounts {
+		check("signing_key:"+name, s.hasSigningKey(name, now))
+	}
+	return h
+}
+
+type nonceRemover interface {
+	Remove(string)
+}
+
+// A made up nonce must be new, & used once it is added. It is only added
+// when it can be removed again, so probes leave nothing behind
+func (s *Server) checkNonces() error {
+	if nil == s.Nonces {
+		return errors.New("No nonce store")
+	}
+	n := "readyz-" + randomHex(16)
+	if !s.Nonces.Valid(n) {
+		return errors.New("A new nonce was already used")
+	}
+	remover, ok := s.Nonces.(nonceRemover)
+	if !ok {
+		return nil
+	}
+	s.Nonces.Add(n)
+	defer remover.Remove(n)
+	if s.Nonces.Valid(n) {
+		return errors.New("An added nonce was not remembered")
+	}
+	return nil
+}
+
+func (s *Server) hasSigningKey(name string, now time.Time) error {
+	a, err := s.Ds.Account(name)
+	if nil != err {
+		return err
+	}
+	if "" == a.Id {
+		return errors.New(fmt.Sprintf("No account %s", name))
+	}
+	if nil == s.Ds.SigningKeysForAccount(a.Id).Current(now) {
+		return errors.New(fmt.Sprintf("No signing key for %s", name))
+	}
+	return nil
+}
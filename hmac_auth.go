@@ -24,6 +24,20 @@ const CONTENT_MD5 = "Content-MD5"
 const XNONCE = "X-Nonce"
 const API_KEY = "api-key"
 
+// How far from now a request timestamp may be
+const HMAC_EXPIRATION = 5 * time.Minute
+
+// Why authentication failed, as counted in metrics
+const (
+	AUTH_FAILED_MALFORMED   = "malformed"
+	AUTH_FAILED_TIMESTAMP   = "timestamp"
+	AUTH_FAILED_NONCE       = "nonce_reuse"
+	AUTH_FAILED_MD5         = "md5_mismatch"
+	AUTH_FAILED_UNKNOWN_KEY = "unknown_key"
+	AUTH_FAILED_SIGNATURE   = "signature_mismatch"
+	AUTH_FAILED_NETWORK     = "network"
+)
+
 type KeyFinder func(string) (string, error)
 
 type NonceChecker interface {
@@ -36,12 +50,16 @@ type HmacOpts struct {
 	Expiration   time.Duration
 	SecretKeyFor KeyFinder
 	NonceChecker NonceChecker
+	// When set, api keys are refused outside their networks
+	NetworksFor NetworkFinder
+	// Called with the reason for each failed authentication
+	OnFailure func(reason string)
 }
 
 func NewHmacOpts(f KeyFinder, nc NonceChecker) *HmacOpts {
 	o := &HmacOpts{
 		AuthPrefix:   "ATM_Auth",
-		Expiration:   5 * time.Minute,
+		Expiration:   HMAC_EXPIRATION,
 		SecretKeyFor: f,
 		NonceChecker: nc,
 	}
@@ -52,10 +70,15 @@ func HMACAuth(o *HmacOpts) echo.HandlerFunc {
 	return func(c *echo.Context) error {
 		auth, err := newAuth(c.Request(), o)
 		if nil != err {
-			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			return o.reject(c, err, http.StatusUnauthorized)
 		}
 		if err := auth.Authentic(c.Request()); nil != err {
-			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			return o.reject(c, err, http.StatusUnauthorized)
+		}
+		if nil != o.NetworksFor {
+			if err := allowedFrom(o.NetworksFor, auth.ApiKey, clientIP(c)); nil != err {
+				return o.reject(c, err, http.StatusForbidden)
+			}
 		}
 		c.Set(API_KEY, auth.ApiKey)
 		return nil
@@ -76,13 +99,29 @@ type Authorizor struct {
 }
 
 type hmacError struct {
-	msg string
+	msg    string
+	reason string
 }
 
 func (e hmacError) Error() string {
 	return e.msg
 }
 
+// Answer code for a request failing authentication. Other errors come from
+// looking up secrets or networks, which are the server's trouble, not the
+// client's, so are neither counted nor answered with the detail
+func (o *HmacOpts) reject(c *echo.Context, err error, code int) error {
+	e, ok := err.(hmacError)
+	if !ok {
+		requestLog(c).Error("authenticating", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Trouble checking authorization")
+	}
+	if nil != o.OnFailure {
+		o.OnFailure(e.reason)
+	}
+	return echo.NewHTTPError(code, err.Error())
+}
+
 func AuthorizorForRequest(o *HmacOpts, method string, uri string) *Authorizor {
 	return &Authorizor{
 		Opts:   o,
@@ -94,7 +133,7 @@ func AuthorizorForRequest(o *HmacOpts, method string, uri string) *Authorizor {
 func newAuth(r *http.Request, o *HmacOpts) (*Authorizor, error) {
 	h := r.Header
 	if len(h.Get(echo.Authorization)) <= 0 {
-		return nil, hmacError{"Missing required Authorization header"}
+		return nil, hmacError{"Missing required Authorization header", AUTH_FAILED_MALFORMED}
 	}
 	a := &Authorizor{
 		Opts:   o,
@@ -116,7 +155,7 @@ func (a *Authorizor) invalidNonce() error {
 	if a.Opts.NonceChecker.Valid(a.ApiKey + a.Nonce) {
 		return nil
 	}
-	return hmacError{"Reused Nonce"}
+	return hmacError{"Reused Nonce", AUTH_FAILED_NONCE}
 }
 
 func (a *Authorizor) Authentic(r *http.Request) error {
@@ -132,23 +171,23 @@ func (a *Authorizor) Authentic(r *http.Request) error {
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 	contentHash := md5Of(body)
 	if strings.ToLower(a.Md5) != strings.ToLower(contentHash) {
-		return hmacError{fmt.Sprintf("Content MD5s do not match:%s", contentHash)}
+		return hmacError{fmt.Sprintf("Content MD5s do not match:%s", contentHash), AUTH_FAILED_MD5}
 	}
 	secret, err := a.Opts.SecretKeyFor(a.ApiKey)
+	if _, unknown := err.(UnknownApiKeyError); unknown || (nil == err && "" == secret) {
+		return hmacError{fmt.Sprintf("No secret key for %s", a.ApiKey), AUTH_FAILED_UNKNOWN_KEY}
+	}
 	if nil != err {
 		return err
 	}
-	if "" == secret {
-		return hmacError{fmt.Sprintf("No secret key for %s", a.ApiKey)}
-	}
 	generatedSig := a.SignatureWith(secret)
 	if "" == generatedSig {
-		return hmacError{"Unable to generate hmac signature"}
+		return hmacError{"Unable to generate hmac signature", AUTH_FAILED_SIGNATURE}
 	}
 	if hmac.Equal([]byte(generatedSig), []byte(a.Signature)) {
 		return nil
 	}
-	return hmacError{"HMAC Signature mismatch"}
+	return hmacError{"HMAC Signature mismatch", AUTH_FAILED_SIGNATURE}
 }
 
 func md5Of(b []byte) string {
@@ -168,7 +207,7 @@ func (a *Authorizor) invalidTime() error {
 		age *= -1
 	}
 	if age > a.Opts.Expiration {
-		return hmacError{"Timestamp out of range"}
+		return hmacError{"Timestamp out of range", AUTH_FAILED_TIMESTAMP}
 	}
 	return nil
 }
@@ -207,24 +246,24 @@ func (a *Authorizor) SigningString() string {
 func (a *Authorizor) extractRequiredHeaders(h *http.Header) error {
 	a.Md5 = h.Get(CONTENT_MD5)
 	if "" == a.Md5 {
-		return hmacError{fmt.Sprintf("Missing required %s header", CONTENT_MD5)}
+		return hmacError{fmt.Sprintf("Missing required %s header", CONTENT_MD5), AUTH_FAILED_MALFORMED}
 	}
 	a.Type = h.Get(CONTENT_TYPE)
 	a.Nonce = h.Get(XNONCE)
 	if "" == a.Nonce {
-		return hmacError{fmt.Sprintf("Missing required %s header", XNONCE)}
+		return hmacError{fmt.Sprintf("Missing required %s header", XNONCE), AUTH_FAILED_MALFORMED}
 	}
 	return a.parseTimestamp(h.Get(XTIME))
 }
 
 func (a *Authorizor) parseTimestamp(t string) error {
 	if "" == t {
-		return hmacError{fmt.Sprintf("Missing required %s header", XTIME)}
+		return hmacError{fmt.Sprintf("Missing required %s header", XTIME), AUTH_FAILED_MALFORMED}
 	}
 	a.Xtime = t
 	ts, err := time.Parse(time.RFC3339, t)
 	if nil != err {
-		return hmacError{fmt.Sprintf("Invalid timestamp: %s", err.Error())}
+		return hmacError{fmt.Sprintf("Invalid timestamp: %s", err.Error()), AUTH_FAILED_TIMESTAMP}
 	}
 	a.Timestamp = ts
 	return nil
@@ -233,19 +272,19 @@ func (a *Authorizor) parseTimestamp(t string) error {
 func (a *Authorizor) authorizorFromAuthHeader(h string) error {
 	l := len(a.Opts.AuthPrefix)
 	if len(h)-l-1 <= 0 || h[:l] != a.Opts.AuthPrefix {
-		return hmacError{fmt.Sprintf("Authorization header invalid format: Missing %s prefix", a.Opts.AuthPrefix)}
+		return hmacError{fmt.Sprintf("Authorization header invalid format: Missing %s prefix", a.Opts.AuthPrefix), AUTH_FAILED_MALFORMED}
 	}
 	parts := strings.SplitN(strings.Trim(h[l+1:], " "), AUTH_SEP, 2)
 	if len(parts) != 2 {
-		return hmacError{"Authorization header invalid format: Missing ApiKey:Signature"}
+		return hmacError{"Authorization header invalid format: Missing ApiKey:Signature", AUTH_FAILED_MALFORMED}
 	}
 	a.ApiKey = parts[0]
 	if "" == a.ApiKey {
-		return hmacError{"Authorization header invalid format: Missing ApiKey"}
+		return hmacError{"Authorization header invalid format: Missing ApiKey", AUTH_FAILED_MALFORMED}
 	}
 	a.Signature = parts[1]
 	if "" == a.Signature {
-		return hmacError{"Authorization header invalid format: Missing Signature"}
+		return hmacError{"Authorization header invalid format: Missing Signature", AUTH_FAILED_MALFORMED}
 	}
 	return nil
 }
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Key-encryption keys protecting secrets stored in the datastore
+package atm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	KEK_SIZE = 32
+	// prefix of a value sealed by a Kek: enc1:<kek id>:<base64 nonce+ciphertext>
+	SEALED_PREFIX = "enc1:"
+)
+
+// A 256 bit AES key with an id recorded alongside everything it seals, so
+// the right key can be found after rotation
+type Kek struct {
+	Id  string
+	key []byte
+}
+
+// Create a new random Kek
+func NewKek(id string) (*Kek, error) {
+	if "" == id || strings.Contains(id, ":") {
+		return nil, errors.New("Kek id must be non-empty and not contain :")
+	}
+	k := &Kek{Id: id, key: make([]byte, KEK_SIZE)}
+	if _, err := rand.Read(k.key); nil != err {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Parse a Kek from its text form <id>:<base64 key>
+func ParseKek(s string) (*Kek, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(parts) != 2 || "" == parts[0] {
+		return nil, errors.New("Invalid kek, expected <id>:<base64 key>")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[1])
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("Invalid kek %s: %s", parts[0], err.Error()))
+	}
+	if KEK_SIZE != len(key) {
+		return nil, errors.New(fmt.Sprintf("Invalid kek %s: must be %d bytes", parts[0], KEK_SIZE))
+	}
+	return &Kek{Id: parts[0], key: key}, nil
+}
+
+// Read a Kek in text form from a file
+func LoadKek(path string) (*Kek, error) {
+	b, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	return ParseKek(string(b))
+}
+
+func (k *Kek) String() string {
+	return k.Id + ":" + base64.StdEncoding.EncodeToString(k.key)
+}
+
+func (k *Kek) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if nil != err {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The current Kek used to seal along with any older ones still needed to
+// open values sealed before a rotation
+type KeyRing struct {
+	current *Kek
+	keks    map[string]*Kek
+}
+
+func NewKeyRing(current *Kek, old ...*Kek) *KeyRing {
+	r := &KeyRing{current: current, keks: make(map[string]*Kek, 1+len(old))}
+	for _, k := range old {
+		r.keks[k.Id] = k
+	}
+	r.keks[current.Id] = current
+	return r
+}
+
+func (r *KeyRing) CurrentId() string {
+	return r.current.Id
+}
+
+// Is s a value sealed by some Kek, rather than plaintext
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, SEALED_PREFIX)
+}
+
+// The id of the Kek that sealed s
+func sealedKekId(s string) string {
+	parts := strings.SplitN(strings.TrimPrefix(s, SEALED_PREFIX), ":", 2)
+	return parts[0]
+}
+
+// Encrypt plaintext with the current Kek. context is authenticated but not
+// stored, the same context must be given to Open, binding the sealed value
+// to where it is kept (such as the account id of a secret)
+func (r *KeyRing) Seal(plaintext []byte, context string) (string, error) {
+	aead, err := r.current.aead()
+	if nil != err {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); nil != err {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(context))
+	return SEALED_PREFIX + r.current.Id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value from Seal with whichever Kek sealed it
+func (r *KeyRing) Open(s, context string) ([]byte, error) {
+	if !IsSealed(s) {
+		return nil, errors.New("Value is not sealed")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, SEALED_PREFIX), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid sealed value")
+	}
+	k, found := r.keks[parts[0]]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Unknown kek %s", parts[0]))
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if nil != err {
+		return nil, err
+	}
+	aead, err := k.aead()
+	if nil != err {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Invalid sealed value")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(context))
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("Unable to open value sealed by kek %s", k.Id))
+	}
+	return plaintext, nil
+}
+
+// Envelope encrypt plaintext under a fresh random data key, which is in turn
+// sealed by the current Kek. Returns the sealed data key & the ciphertext
+func (r *KeyRing) SealEnvelope(plaintext []byte, context string) (string, string, error) {
+	dek, err := NewKek("dek")
+	if nil != err {
+		return "", "", err
+	}
+	ciphertext, err := NewKeyRing(dek).Seal(plaintext, context)
+	if nil != err {
+		return "", "", err
+	}
+	wrapped, err := r.Seal(dek.key, context)
+	if nil != err {
+		return "", "", err
+	}
+	return wrapped, ciphertext, nil
+}
+
+// Decrypt a value from SealEnvelope
+func (r *KeyRing) OpenEnvelope(wrapped, ciphertext, context string) ([]byte, error) {
+	key, err := r.Open(wrapped, context)
+	if nil != err {
+		return nil, err
+	}
+	if KEK_SIZE != len(key) {
+		return nil, errors.New("Invalid data key")
+	}
+	return NewKeyRing(&Kek{Id: "dek", key: key}).Open(ciphertext, context)
+}
@@ -0,0 +1,41 @@
+package atm
+
+import (
+	"testing"
+)
+
+func TestKeyRingSealOpen(t *testing.T) {
+	old, _ := NewKek("old")
+	current, _ := NewKek("current")
+	r := NewKeyRing(current, old)
+
+	sealed, err := r.Seal([]byte("secret"), "acct")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || "current" != sealedKekId(sealed) {
+		t.Error("Unexpected sealed value", sealed)
+	}
+	if plain, err := r.Open(sealed, "acct"); nil != err || "secret" != string(plain) {
+		t.Error("Unable to open sealed value", plain, err)
+	}
+	if _, err := r.Open(sealed, "other"); nil == err {
+		t.Error("Expected open with another context to fail")
+	}
+
+	sealedByOld, _ := NewKeyRing(old).Seal([]byte("older"), "acct")
+	if plain, err := r.Open(sealedByOld, "acct"); nil != err || "older" != string(plain) {
+		t.Error("Unable to open value sealed by old kek", plain, err)
+	}
+	if _, err := NewKeyRing(current).Open(sealedByOld, "acct"); nil == err {
+		t.Error("Expected open without the old kek to fail")
+	}
+
+	parsed, err := ParseKek(current.String())
+	if nil != err || parsed.Id != current.Id || string(parsed.key) != string(current.key) {
+		t.Error("Kek did not survive a round trip through text", err)
+	}
+	if _, err := ParseKek("id:dG9vc2hvcnQ="); nil == err {
+		t.Error("Expected a short kek to be rejected")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Leveled JSON logging, with every request given an id to correlate its
+// log lines. Secrets, signatures & signing keys are never logged
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	REQUEST_ID = "X-Request-Id"
+	// Context keys the request log line is filled in from
+	LOGGER       = "logger"
+	LOG_ACCOUNT  = "log-account"
+	LOG_DECISION = "log-decision"
+
+	maxRequestIdSize = 128
+	REDACTED         = "[redacted]"
+)
+
+// Attributes whose values are never written, whatever logs them
+var redactedAttrs = map[string]bool{
+	"authorization": true,
+	"key":           true,
+	"secret":        true,
+	"api_secret":    true,
+	"signature":     true,
+	"signing_key":   true,
+	"sealed_key":    true,
+	"share":         true,
+	"token":         true,
+	"password":      true,
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedAttrs[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, REDACTED)
+	}
+	return a
+}
+
+// A JSON logger writing to w at level, one of debug, info, warn or error
+func NewLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); nil != err {
+		return nil, errors.New(fmt.Sprintf("Invalid log level %s", level))
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l, ReplaceAttr: redact})), nil
+}
+
+// Only what was asked for, never the key it is signed with
+func (u UrlRequest) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("account", u.Account),
+		slog.String("container", u.Container),
+		slog.String("object", u.Object),
+		slog.String("method", u.Method),
+	)
+}
+
+func (k SigningKey) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Time("active_at", k.ActiveAt),
+		slog.String("set_by", k.SetBy),
+	)
+}
+
+// The id given by the client, if it is reasonable, or a new one
+func requestId(given string) string {
+	if "" == given || len(given) > maxRequestIdSize {
+		return randomHex(16)
+	}
+	for _, r := range given {
+		if r < '!' || r > '~' {
+			return randomHex(16)
+		}
+	}
+	return given
+}
+
+// The logger of the request, carrying its id
+func requestLog(c *echo.Context) *slog.Logger {
+	if l, ok := c.Get(LOGGER).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Middleware giving each request an id, returned in X-Request-Id, & logging
+// one line for it once handled. The route is logged rather than the path so
+// opaque url tokens stay out of the log
+func RequestLogger(l *slog.Logger) echo.MiddlewareFunc {
+	return func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			id := requestId(c.Request().Header.Get(REQUEST_ID))
+			c.Response().Header().Set(REQUEST_ID, id)
+			reqLog := l.With("request_id", id)
+			c.Set(LOGGER, reqLog)
+
+			start := time.Now()
+			if err := h(c); nil != err {
+				c.Error(err)
+			}
+			status := c.Response().Status()
+			attrs := []any{
+				"method", c.Request().Method,
+				"route", c.Path(),
+				"status", status,
+				"bytes", c.Response().Size(),
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"client_ip", clientIP(c),
+			}
+			for _, field := range []struct{ name, key string }{
+				{"api_key", API_KEY},
+				{"account", LOG_ACCOUNT},
+				{"decision", LOG_DECISION},
+			} {
+				if v, ok := c.Get(field.key).(string); ok && "" != v {
+					attrs = append(attrs, field.name, v)
+				}
+			}
+			level := slog.LevelInfo
+			switch {
+			case status >= 500:
+				level = slog.LevelError
+			case status >= 400:
+				level = slog.LevelWarn
+			}
+			reqLog.Log(c.Request().Context(), level, "request", attrs...)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package atm
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// The logged lines, waiting a little for one containing want
+func (b *logBuffer) lines(want string) []map[string]interface{} {
+	var found []map[string]interface{}
+	for i := 0; i < 50; i++ {
+		b.lock.Lock()
+		text := b.buf.String()
+		b.lock.Unlock()
+		if strings.Contains(text, want) {
+			for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+				entry := make(map[string]interface{})
+				if nil == json.Unmarshal([]byte(line), &entry) {
+					found = append(found, entry)
+				}
+			}
+			return found
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestRequestId(t *testing.T) {
+	if "abc-123" != requestId("abc-123") {
+		t.Error("Expected a reasonable id to be kept")
+	}
+	for _, bad := range []string{"", "has space", "new\nline", strings.Repeat("a", maxRequestIdSize+1)} {
+		if id := requestId(bad); bad == id || 32 != len(id) {
+			t.Error("Expected a new id for", bad, id)
+		}
+	}
+}
+
+func TestLoggerRedacts(t *testing.T) {
+	out := &logBuffer{}
+	l, err := NewLogger(out, "debug")
+	if nil != err {
+		t.Fatal("Unable to create logger", err)
+	}
+	u := UrlRequest{Account: "owner", Container: "backups", Object: "a.tgz", Method: "PUT", Key: "swift-key"}
+	l.Info("test", "url_request", u, "secret", "backup-secret", "key", NewSigningKey("other-key"))
+	text := out.buf.String()
+	for _, leaked := range []string{"swift-key", "backup-secret", "other-key"} {
+		if strings.Contains(text, leaked) {
+			t.Error("Expected nothing secret logged", leaked, text)
+		}
+	}
+	if !strings.Contains(text, `"container":"backups"`) {
+		t.Error("Expected the request logged", text)
+	}
+	if _, err := NewLogger(out, "loud"); nil == err {
+		t.Error("Expected an invalid level to be refused")
+	}
+}
+
+func TestServerRequestLog(t *testing.T) {
+	s, c := newTestServer(t)
+	out := &logBuffer{}
+	s.Logger = slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{ReplaceAttr: redact}))
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	c.AtmHost = ts.URL
+
+	req, _ := http.NewRequest("GET", ts.URL+"/healthz", nil)
+	req.Header.Set(REQUEST_ID, "given-id")
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Fatal("Unable to get /healthz", err)
+	}
+	resp.Body.Close()
+	if "given-id" != resp.Header.Get(REQUEST_ID) {
+		t.Error("Expected the request id returned", resp.Header.Get(REQUEST_ID))
+	}
+	if lines := out.lines("given-id"); 1 != len(lines) || "/healthz" != lines[0]["route"] {
+		t.Error("Expected the request logged with its id", lines)
+	}
+
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	url, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	if nil != err {
+		t.Fatal("Unexpected error requesting url", err)
+	}
+	var logged map[string]interface{}
+	for _, line := range out.lines("/v1/urls") {
+		if "/v1/urls" == line["route"] {
+			logged = line
+		}
+	}
+	if nil == logged || "backup-key" != logged["api_key"] || "owner" != logged["account"] ||
+		AUDIT_ISSUED != logged["decision"] || "INFO" != logged["level"] || nil == logged["latency_ms"] {
+		t.Error("Expected the url request logged", logged)
+	}
+	out.lock.Lock()
+	text := out.buf.String()
+	out.lock.Unlock()
+	sig := url[strings.Index(url, "temp_url_sig=")+len("temp_url_sig="):]
+	for _, leaked := range []string{"swift-key", "backup-secret", sig[:strings.Index(sig, "&")]} {
+		if strings.Contains(text, leaked) {
+			t.Error("Expected nothing secret logged", leaked)
+		}
+	}
+}
@@ -7,10 +7,19 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/codegangsta/cli"
@@ -18,6 +27,9 @@ import (
 	"github.com/howeyc/gopass"
 )
 
+// How long requests in progress get to finish once told to stop
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "atm"
@@ -35,7 +47,7 @@ func main() {
 	}
 
 	app.Commands = clientCommands()
-	app.Commands = append(app.Commands, serverCommand())
+	app.Commands = append(app.Commands, auditCommand(), grantsCommand(), webhookCommand(), serverCommand(), serverPubkeyCommand(), dbCommand())
 	app.RunAndExitOnError()
 }
 
@@ -46,25 +58,10 @@ func clientCommands() []cli.Command {
 			Usage:       "Request a temp url to Account/Container/Object",
 			ArgsUsage:   "<Account> <Container> <Object> ",
 			Description: "Send a request to the ATM service for a tempurl",
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:   "api-key, k",
-					Usage:  "account/user atm api-key",
-					EnvVar: "ATM_API_KEY",
-				},
-				cli.StringFlag{
-					Name:   "api-secret, s",
-					Usage:  "account/user atm api-secret",
-					EnvVar: "ATM_API_SECRET",
-				},
-				cli.StringFlag{
-					Name:   "atm-host, a",
-					Usage:  "atm server endpoint",
-					EnvVar: "ATM_HOST",
-				},
+			Flags: append(clientFlags(),
 				cli.StringFlag{
 					Name:  "method, m",
-					Usage: "HTTP method requested for temp url",
+					Usage: "HTTP method(s) requested for temp url, comma separated for several (example GET,HEAD)",
 					Value: "GET",
 				},
 				cli.StringFlag{
@@ -72,7 +69,7 @@ func clientCommands() []cli.Command {
 					Usage: "Duration for which the url will be active (example 30s, 2m, 4h)",
 					Value: "",
 				},
-			},
+			),
 			Action: func(c *cli.Context) {
 				method := c.String("method")
 				if "" == method {
@@ -107,38 +104,581 @@ func clientCommands() []cli.Command {
 					cli.ShowSubcommandHelp(c)
 					os.Exit(1)
 				}
-				atm := &atm.AtmClient{
-					ApiKey:    c.String("api-key"),
-					ApiSecret: c.String("api-secret"),
-					AtmHost:   c.String("atm-host"),
+				atm := newClient(c)
+				methods := strings.Split(method, ",")
+				if 1 == len(methods) {
+					url, err := atm.RequestTempUrl(method, account, container, object, duration)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					fmt.Println(url)
+					return
 				}
-				url, err := atm.RequestTempUrl(method, account, container, object, duration)
+				urls, err := atm.RequestTempUrls(methods, account, container, object, duration)
 				if nil != err {
 					log.Fatal(err)
 					return
 				}
-				fmt.Println(url)
+				for _, m := range methods {
+					m = strings.ToUpper(strings.TrimSpace(m))
+					if url, ok := urls[m]; ok {
+						fmt.Printf("%s %s\n", m, url)
+					}
+				}
 			},
 		},
 
 		cli.Command{
 			Name:  "key",
 			Usage: "Add/Remove signing key",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "set",
+					Usage:     "Set the signing key of an account",
+					ArgsUsage: "<account> [-]",
+					Description: "Prompts for the account's Temp-URL-Key, or reads it from stdin when given - " +
+						"or from --key-file, and signs with it right away. Use rotate to replace a key in use",
+					Flags: append(keyFlags(),
+						cli.StringFlag{
+							Name:  "key-file",
+							Usage: "file holding the signing key",
+						},
+						cli.DurationFlag{
+							Name:  "ttl",
+							Usage: "How long until the key is dropped, 0 to keep it",
+						},
+					),
+					Action: func(c *cli.Context) {
+						account := c.Args().Get(0)
+						if "" == account {
+							log.Fatal("Missing account")
+							return
+						}
+						key, err := readSigningKey(c, c.Args().Get(1))
+						if nil != err {
+							log.Fatal(err)
+							return
+						}
+						if err := newKeyClient(c).SetKey(account, key, c.Duration("ttl")); nil != err {
+							log.Fatal(err)
+							return
+						}
+						fmt.Printf("Key set for %s, fingerprint %s\n", account, atm.KeyFingerprint(account, key))
+					},
+				},
+				cli.Command{
+					Name:      "remove",
+					Usage:     "Remove the signing keys of an account",
+					ArgsUsage: "<account>",
+					Flags:     clientFlags(),
+					Action: func(c *cli.Context) {
+						account := c.Args().Get(0)
+						if "" == account {
+							log.Fatal("Missing account")
+							return
+						}
+						if err := newClient(c).RemoveKey(account); nil != err {
+							log.Fatal(err)
+							return
+						}
+						fmt.Printf("Keys removed for %s\n", account)
+					},
+				},
+				cli.Command{
+					Name:      "rotate",
+					Usage:     "Replace the signing key of an account",
+					ArgsUsage: "<account> [-]",
+					Description: "Stages a new signing key, prompting for it, or reading it from stdin when given - " +
+						"or from --key-file. The current key keeps signing until the new one activates, so set the " +
+						"new key as Temp-URL-Key-2 in swift first, and only drop the old one once urls signed with it expire",
+					Flags: append(keyFlags(),
+						cli.StringFlag{
+							Name:  "key-file",
+							Usage: "file holding the new signing key",
+						},
+						cli.DurationFlag{
+							Name:  "activate-in",
+							Usage: "How long until the new key is used for signing, 0 for the server default",
+						},
+						cli.DurationFlag{
+							Name:  "ttl",
+							Usage: "How long after activating the key is dropped, 0 to keep it",
+						},
+					),
+					Action: func(c *cli.Context) {
+						account := c.Args().Get(0)
+						if "" == account {
+							log.Fatal("Missing account")
+							return
+						}
+						key, err := readSigningKey(c, c.Args().Get(1))
+						if nil != err {
+							log.Fatal(err)
+							return
+						}
+						var activateAt time.Time
+						if d := c.Duration("activate-in"); d > 0 {
+							activateAt = time.Now().Add(d)
+						}
+						if err := newKeyClient(c).StageKey(account, key, activateAt, c.Duration("ttl")); nil != err {
+							log.Fatal(err)
+							return
+						}
+						fmt.Printf("New key staged for %s\n", account)
+					},
+				},
+				cli.Command{
+					Name:      "status",
+					Usage:     "Show the signing keys held for an account",
+					ArgsUsage: "<account> [-]",
+					Description: "Lists fingerprints & metadata of the account's keys. With --check a key is read " +
+						"like for rotate and compared against the one signing",
+					Flags: append(clientFlags(),
+						cli.BoolFlag{
+							Name:  "check",
+							Usage: "compare a key against the one signing",
+						},
+						cli.StringFlag{
+							Name:  "key-file",
+							Usage: "file holding the key to check",
+						},
+					),
+					Action: func(c *cli.Context) {
+						account := c.Args().Get(0)
+						if "" == account {
+							log.Fatal("Missing account")
+							return
+						}
+						status, err := newClient(c).KeyStatus(account)
+						if nil != err {
+							log.Fatal(err)
+							return
+						}
+						printSigningKey("primary", status.Primary)
+						printSigningKey("secondary", status.Secondary)
+						if "" == status.Signing {
+							fmt.Println("No key signing")
+						}
+						if !c.Bool("check") {
+							return
+						}
+						key, err := readSigningKey(c, c.Args().Get(1))
+						if nil != err {
+							log.Fatal(err)
+							return
+						}
+						if atm.KeyFingerprint(account, key) != status.Signing {
+							log.Fatal("Key does not match the one signing")
+							return
+						}
+						fmt.Println("Key matches the one signing")
+					},
+				},
+			},
+		},
+
+		cli.Command{
+			Name:        "unseal",
+			Usage:       "Submit an unseal share to a sealed server",
+			ArgsUsage:   "[-]",
+			Description: "Prompts for one unseal share, or reads it from stdin when given -",
+			Flags:       clientFlags(),
 			Action: func(c *cli.Context) {
-				log.Fatal("Not implemented yet")
+				var share string
+				if "-" == c.Args().Get(0) {
+					b, err := ioutil.ReadAll(os.Stdin)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					share = string(b)
+				} else {
+					fmt.Printf("Unseal share: ")
+					b, err := gopass.GetPasswd()
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					share = string(b)
+				}
+				status, err := newClient(c).Unseal(strings.TrimSpace(share))
+				if nil != err {
+					log.Fatal(err)
+					return
+				}
+				if status.Sealed {
+					fmt.Printf("Sealed, %d of %d shares submitted\n", status.Progress, status.Threshold)
+				} else {
+					fmt.Println("Unsealed")
+				}
+			},
+		},
+	}
+}
+
+func printSigningKey(slot string, k *atm.SigningKey) {
+	if nil == k {
+		return
+	}
+	expires := "never"
+	if nil != k.ExpiresAt {
+		expires = k.ExpiresAt.Local().Format(time.RFC3339)
+	}
+	fmt.Printf("%-9s %s set %s by %s, active %s, expires %s\n", slot, k.Fingerprint,
+		k.SetAt.Local().Format(time.RFC3339), k.SetBy, k.ActiveAt.Local().Format(time.RFC3339), expires)
+}
+
+// A signing key from --key-file, stdin when arg is - or else a prompt. Never
+// from the command line where it would land in shell history
+func readSigningKey(c *cli.Context, arg string) (string, error) {
+	var b []byte
+	var err error
+	if file := c.String("key-file"); "" != file {
+		b, err = ioutil.ReadFile(file)
+	} else if "-" == arg {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		fmt.Printf("Signing key: ")
+		b, err = gopass.GetPasswd()
+	}
+	if nil != err {
+		return "", err
+	}
+	key := strings.TrimSpace(string(b))
+	if "" == key {
+		return "", errors.New("Empty signing key")
+	}
+	return key, nil
+}
+
+func auditCommand() cli.Command {
+	return cli.Command{
+		Name:        "audit",
+		Usage:       "List urls issued or denied",
+		Description: "Lists audit entries requested by, or for the account of, the api key, newest first",
+		Flags: append(clientFlags(),
+			cli.StringFlag{Name: "requestor", Usage: "only entries requested by this api key"},
+			cli.StringFlag{Name: "account", Usage: "only entries for this account name"},
+			cli.StringFlag{Name: "container", Usage: "only entries for this container"},
+			cli.StringFlag{Name: "object", Usage: "only entries for this object"},
+			cli.StringFlag{Name: "method", Usage: "only entries for this method"},
+			cli.StringFlag{Name: "outcome", Usage: "only issued, denied or failed entries"},
+			cli.DurationFlag{Name: "since", Usage: "only entries from this long ago"},
+			cli.IntFlag{Name: "limit", Usage: "entries per page", Value: atm.AUDIT_DEFAULT_LIMIT},
+			cli.IntFlag{Name: "before", Usage: "only entries older than this id, to continue a listing"},
+			cli.BoolFlag{Name: "all", Usage: "fetch every page rather than just the first"},
+		),
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:      "verify",
+				Usage:     "Check an audit journal has not been modified",
+				ArgsUsage: "<journal file>...",
+				Description: "Checks the hash chain through the journal files, given oldest first, along with " +
+					"the signature of every checkpoint",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "public-key",
+						Usage: "base64 ed25519 public key checkpoints are signed with, as logged by the server",
+					},
+					cli.StringFlag{
+						Name:  "key-file",
+						Usage: "the server's audit journal key file, instead of --public-key",
+					},
+				},
+				Action: func(c *cli.Context) {
+					if 0 == len(c.Args()) {
+						log.Fatal("Missing journal files")
+						return
+					}
+					var public ed25519.PublicKey
+					var err error
+					if file := c.String("key-file"); "" != file {
+						var key ed25519.PrivateKey
+						if key, err = atm.LoadJournalKey(file); nil == err {
+							public = key.Public().(ed25519.PublicKey)
+						}
+					} else {
+						public, err = atm.ParseJournalPublicKey(c.String("public-key"))
+					}
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					r, err := atm.VerifyAuditJournal(c.Args(), public)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					fmt.Printf("Verified %d entries & %d checkpoints, seq %d to %d\n", r.Entries, r.Checkpoints,
+						r.FirstSeq, r.LastSeq)
+					if 1 != r.FirstSeq {
+						fmt.Printf("Journal starts at seq %d, earlier files were not checked\n", r.FirstSeq)
+					}
+					if r.LastSeq != r.LastCheckpointSeq {
+						fmt.Printf("Entries after seq %d are not yet covered by a signed checkpoint\n", r.LastCheckpointSeq)
+					}
+				},
+			},
+		},
+		Action: func(c *cli.Context) {
+			f := &atm.AuditFilter{
+				RequestorId: c.String("requestor"),
+				Account:     c.String("account"),
+				Container:   c.String("container"),
+				Object:      c.String("object"),
+				Method:      c.String("method"),
+				Outcome:     c.String("outcome"),
+				Before:      int64(c.Int("before")),
+				Limit:       c.Int("limit"),
+			}
+			if d := c.Duration("since"); d > 0 {
+				f.Since = time.Now().Add(-d)
+			}
+			client := newClient(c)
+			for {
+				entries, next, err := client.Audit(f)
+				if nil != err {
+					log.Fatal(err)
+					return
+				}
+				for _, e := range entries {
+					expires := "-"
+					if nil != e.ExpiresAt {
+						expires = e.ExpiresAt.Local().Format(time.RFC3339)
+					}
+					fmt.Printf("%d\t%s\t%s\t%s\t%s\t/%s/%s/%s\t%s\t%s\t%s\t%s\n", e.Id,
+						e.Time.Local().Format(time.RFC3339), e.Outcome, e.RequestorId, e.Method,
+						e.Account, e.Container, e.Object, expires, e.RuleId, e.ClientIp, e.Reason)
+				}
+				if 0 == next {
+					return
+				}
+				if !c.Bool("all") {
+					fmt.Fprintf(os.Stderr, "More entries, continue with --before %d\n", next)
+					return
+				}
+				f.Before = next
+			}
+		},
+	}
+}
+
+func grantsCommand() cli.Command {
+	return cli.Command{
+		Name:        "grants",
+		Usage:       "List proxied urls & their traffic",
+		Description: "Lists grants behind the urls of a server in proxy mode, requested by or for accounts of the api key",
+		Flags:       clientFlags(),
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:      "revoke",
+				Usage:     "Stop the url of a grant working",
+				ArgsUsage: "<grant id>...",
+				Flags:     clientFlags(),
+				Action: func(c *cli.Context) {
+					if 0 == len(c.Args()) {
+						log.Fatal("Missing grant id")
+						return
+					}
+					client := newClient(c)
+					for _, id := range c.Args() {
+						if err := client.RevokeGrant(id); nil != err {
+							log.Fatal(err)
+							return
+						}
+					}
+				},
+			},
+		},
+		Action: func(c *cli.Context) {
+			grants, err := newClient(c).Grants()
+			if nil != err {
+				log.Fatal(err)
 				return
+			}
+			now := time.Now()
+			for _, g := range grants {
+				state := "active"
+				if nil != g.RevokedAt {
+					state = "revoked"
+				} else if !g.Usable(now) {
+					state = "expired"
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\t/%s/%s/%s\t%s\t%d\t%d\n", g.Id, state, g.RequestorId, g.Method,
+					g.Account, g.Container, g.Object, g.ExpiresAt.Local().Format(time.RFC3339), g.BytesIn, g.BytesOut)
+			}
+		},
+	}
+}
+
+func webhookCommand() cli.Command {
+	return cli.Command{
+		Name:  "webhook",
+		Usage: "Manage the webhooks of an account",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:      "list",
+				Usage:     "List the webhooks of an account",
+				ArgsUsage: "<account>",
+				Flags:     clientFlags(),
+				Action: func(c *cli.Context) {
+					hooks, err := newClient(c).Webhooks(requiredAccount(c))
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					for _, h := range hooks {
+						fmt.Printf("%s\t%s\t%s\t%s\n", h.Id, h.Url, strings.Join(h.Events, ","), h.Container)
+					}
+				},
+			},
+			cli.Command{
+				Name:      "add",
+				Usage:     "Add a webhook to an account",
+				ArgsUsage: "<account> <url>",
+				Description: "Events are POSTed to the url as JSON, signed in the " + atm.WEBHOOK_SIGNATURE_HEADER +
+					" header with the secret printed, which is not shown again",
+				Flags: append(clientFlags(),
+					cli.StringSliceFlag{
+						Name: "event",
+						Usage: fmt.Sprintf("only send this event, one of %s, %s, %s or %s, may be repeated",
+							atm.WEBHOOK_URL_ISSUED, atm.WEBHOOK_URL_DENIED, atm.WEBHOOK_KEY_SET, atm.WEBHOOK_KEY_REMOVED),
+					},
+					cli.StringFlag{
+						Name:  "container",
+						Usage: "only send url events for containers matching this regexp",
+					},
+					cli.StringFlag{
+						Name:  "secret",
+						Usage: "secret to sign deliveries with, generated if not given",
+					},
+				),
+				Action: func(c *cli.Context) {
+					account := requiredAccount(c)
+					h := &atm.Webhook{
+						Url:       c.Args().Get(1),
+						Events:    c.StringSlice("event"),
+						Container: c.String("container"),
+						Secret:    c.String("secret"),
+					}
+					added, err := newClient(c).AddWebhook(account, h)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					fmt.Printf("Webhook %s added for %s, secret %s\n", added.Id, account, added.Secret)
+				},
+			},
+			cli.Command{
+				Name:      "remove",
+				Usage:     "Remove a webhook from an account",
+				ArgsUsage: "<account> <id>",
+				Flags:     clientFlags(),
+				Action: func(c *cli.Context) {
+					account := requiredAccount(c)
+					if err := newClient(c).RemoveWebhook(account, c.Args().Get(1)); nil != err {
+						log.Fatal(err)
+						return
+					}
+				},
+			},
+			cli.Command{
+				Name:      "dead-letters",
+				Usage:     "List deliveries given up on",
+				ArgsUsage: "<account>",
+				Flags:     clientFlags(),
+				Action: func(c *cli.Context) {
+					letters, err := newClient(c).DeadLetters(requiredAccount(c))
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					for _, l := range letters {
+						fmt.Printf("%s\t%s\t%s\t%s\t%d\t%s\n", l.Time.Local().Format(time.RFC3339), l.WebhookId,
+							l.Event.Type, l.Event.Id, l.Attempts, l.LastError)
+					}
+				},
 			},
 		},
 	}
 }
 
-func serverFlags() []cli.Flag {
+// The first argument, exiting when missing
+func requiredAccount(c *cli.Context) string {
+	account := c.Args().Get(0)
+	if "" == account {
+		log.Fatal("Missing account")
+	}
+	return account
+}
+
+func clientFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "api-key, k",
+			Usage:  "account/user atm api-key",
+			EnvVar: "ATM_API_KEY",
+		},
+		cli.StringFlag{
+			Name:   "api-secret, s",
+			Usage:  "account/user atm api-secret",
+			EnvVar: "ATM_API_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "atm-host, a",
+			Usage:  "atm server endpoint",
+			EnvVar: "ATM_HOST",
+		},
+	}
+}
+
+// The client flags of commands sending signing keys
+func keyFlags() []cli.Flag {
+	return append(clientFlags(),
+		cli.StringFlag{
+			Name:   "server-pubkey",
+			Usage:  "public key, or sha256: fingerprint, the server must report before a key is sealed to it, see atm server-pubkey",
+			EnvVar: "ATM_SERVER_PUBKEY",
+		},
+	)
+}
+
+func newClient(c *cli.Context) *atm.AtmClient {
+	return &atm.AtmClient{
+		ApiKey:       c.String("api-key"),
+		ApiSecret:    c.String("api-secret"),
+		AtmHost:      c.String("atm-host"),
+		ServerPubkey: c.String("server-pubkey"),
+	}
+}
+
+// A client for sending signing keys, warning when the server key is not pinned
+func newKeyClient(c *cli.Context) *atm.AtmClient {
+	client := newClient(c)
+	if "" == client.ServerPubkey {
+		log.Printf("Warning: sealing to whatever key the server reports, pin it with --server-pubkey")
+	}
+	return client
+}
+
+func databaseFlags() []cli.Flag {
 	current_user, err := user.Current()
 	default_username := ""
 	if nil == err {
 		default_username = current_user.Username
 	}
 	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "database-driver",
+			Usage: "database server type, mysql or postgres",
+			Value: atm.MYSQL_DRIVER,
+		},
+		cli.StringFlag{
+			Name:   "database-url",
+			Usage:  "full database url, used instead of the other database options (example postgres://atm@db/atm)",
+			EnvVar: "ATM_DATABASE_URL",
+		},
 		cli.StringFlag{
 			Name:  "database",
 			Usage: "name of database",
@@ -156,51 +696,1017 @@ func serverFlags() []cli.Flag {
 		},
 		cli.IntFlag{
 			Name:  "database-port",
-			Usage: "port number of database server",
-			Value: 3306,
+			Usage: "port number of database server (default 3306 for mysql, 5432 for postgres)",
+		},
+		cli.StringFlag{
+			Name:  "database-file",
+			Usage: "path to a SQLite database file, used instead of a database server",
+		},
+		cli.StringFlag{
+			Name:   "database-password-file",
+			Usage:  "file holding the database password, re-read by the server on SIGHUP. Otherwise ATM_DATABASE_PASSWORD is used, or the password is prompted for",
+			EnvVar: "ATM_DATABASE_PASSWORD_FILE",
+		},
+	}
+}
+
+func kekFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "kek-file",
+			Usage:  "file holding the key-encryption key for api secrets, as <id>:<base64 key>",
+			EnvVar: "ATM_KEK_FILE",
+		},
+		cli.StringFlag{
+			Name:   "kek",
+			Usage:  "key-encryption key for api secrets, prefer --kek-file or the environment",
+			EnvVar: "ATM_KEK",
+		},
+		cli.StringSliceFlag{
+			Name:  "old-kek-file",
+			Usage: "file holding a previous key-encryption key, still used to decrypt (repeatable)",
+		},
+	}
+}
+
+// The configured keks, nil if there are none
+func loadKeyRing(c *cli.Context) (*atm.KeyRing, error) {
+	var current *atm.Kek
+	var err error
+	if file := c.String("kek-file"); "" != file {
+		current, err = atm.LoadKek(file)
+	} else if k := c.String("kek"); "" != k {
+		current, err = atm.ParseKek(k)
+	}
+	if nil != err || nil == current {
+		return nil, err
+	}
+	var old []*atm.Kek
+	for _, file := range c.StringSlice("old-kek-file") {
+		k, err := atm.LoadKek(file)
+		if nil != err {
+			return nil, err
+		}
+		old = append(old, k)
+	}
+	return atm.NewKeyRing(current, old...), nil
+}
+
+func serverFlags() []cli.Flag {
+	flags := append(databaseFlags(), kekFlags()...)
+	return append(flags,
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML or JSON file of server settings, overridden by the environment & flags",
+			EnvVar: "ATM_CONFIG",
+		},
+		cli.StringSliceFlag{
+			Name:  "listen",
+			Usage: "address to serve on, may be repeated (default :8080)",
+		},
+		cli.StringFlag{
+			Name:   "master-key-file",
+			Usage:  "file holding the key, as <id>:<base64 key>, encrypting signing keys kept in the database",
+			EnvVar: "ATM_MASTER_KEY_FILE",
+		},
+		cli.DurationFlag{
+			Name:  "key-sync-interval",
+			Usage: "How often to check the database for signing key changes made by other instances, 0 to never",
+			Value: 10 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:  "sealed",
+			Usage: "start sealed, persisting signing keys under a master key recreated from unseal shares",
+		},
+		cli.StringSliceFlag{
+			Name:  "unseal-key",
+			Usage: "api key of an operator allowed to submit unseal shares, may be repeated",
 		},
 		cli.DurationFlag{
 			Name:  "duration",
 			Usage: "Default lifetime for generated tempurl",
 			Value: atm.DURATION,
 		},
+		cli.DurationFlag{
+			Name:  "max-duration",
+			Usage: "Longest lifetime for generated tempurl, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "hmac-expiration",
+			Usage: "How far request timestamps may be from now",
+			Value: atm.HMAC_EXPIRATION,
+		},
+		cli.DurationFlag{
+			Name:  "nonce-ttl",
+			Usage: "How long request nonces are remembered, at least twice --hmac-expiration",
+			Value: atm.NONCE_TTL,
+		},
 		cli.StringFlag{
 			Name:  "object-host, host",
 			Usage: "Swift service host prefix",
 			Value: atm.HOST,
 		},
+		cli.StringFlag{
+			Name:  "datastore-file",
+			Usage: "YAML or JSON file of accounts & rules, used instead of a database",
+		},
+		cli.DurationFlag{
+			Name:  "datastore-file-reload",
+			Usage: "How often to check the datastore file for changes, 0 to never reload",
+			Value: 30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:   "box-key-file",
+			Usage:  "file holding the private key clients seal signing keys to, created if missing. Without one a new key is made at each start, so give every instance the same file",
+			EnvVar: "ATM_BOX_KEY_FILE",
+		},
+		cli.BoolFlag{
+			Name:  "require-sealed-keys",
+			Usage: "refuse signing keys not sealed to the server public key",
+		},
+		cli.DurationFlag{
+			Name:  "key-activation-delay",
+			Usage: "How long a key replacing an active one waits before signing, unless the owner gives a time",
+		},
+		cli.StringFlag{
+			Name:  "audit-journal",
+			Usage: "also append audit entries to this hash chained JSON lines file",
+		},
+		cli.StringFlag{
+			Name:  "audit-journal-key",
+			Usage: "file holding the ed25519 key signing audit journal checkpoints, created if missing",
+		},
+		cli.IntFlag{
+			Name:  "audit-journal-checkpoint",
+			Usage: "entries between signed checkpoints",
+			Value: atm.JOURNAL_DEFAULT_CHECKPOINT,
+		},
+		cli.DurationFlag{
+			Name:  "audit-journal-checkpoint-interval",
+			Usage: "longest time entries are left without a signed checkpoint, 0 to only checkpoint by count",
+			Value: atm.JOURNAL_DEFAULT_CHECKPOINT_INTERVAL,
+		},
+		cli.IntFlag{
+			Name:  "audit-journal-max-size",
+			Usage: "bytes after which the audit journal is rotated",
+			Value: atm.JOURNAL_DEFAULT_MAX_SIZE,
+		},
+		cli.StringSliceFlag{
+			Name:  "swift-host",
+			Usage: "base url, like https://auth.example.org, registered swift credentials may use besides the object hosts, may be repeated",
+		},
+		cli.DurationFlag{
+			Name:  "swift-key-refresh",
+			Usage: "How often to refetch keys of accounts with registered swift credentials, 0 to only fetch when missing",
+			Value: 15 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:   "proxy-url",
+			Usage:  "public base url of this server, to issue revocable urls proxied through it instead of tempurls",
+			EnvVar: "ATM_PROXY_URL",
+		},
+		cli.StringSliceFlag{
+			Name:  "trusted-proxy",
+			Usage: "address or CIDR of a proxy whose X-Forwarded-For gives the client address, may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "require-key",
+			Usage: "account that must have a signing key for /readyz to report ready, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "metrics",
+			Usage: "serve prometheus metrics at /metrics, without authentication, alongside the service",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "serve prometheus metrics at /metrics on this address only (example 127.0.0.1:9100), implies --metrics",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "least severe log lines written, debug, info, warn or error",
+			EnvVar: "ATM_LOG_LEVEL",
+		},
+		cli.IntFlag{
+			Name:  "rate-limit",
+			Usage: "requests per minute allowed each api key, 0 for no limit. Overridden per requestor in the datastore",
+			Value: 600,
+		},
+		cli.IntFlag{
+			Name:  "rate-burst",
+			Usage: "requests an api key may make at once",
+			Value: 60,
+		},
+		cli.IntFlag{
+			Name:  "auth-failure-limit",
+			Usage: "failed authentications per minute allowed each client address, 0 for no limit",
+			Value: 30,
+		},
+		cli.IntFlag{
+			Name:  "auth-failure-burst",
+			Usage: "failed authentications a client address may make at once",
+			Value: 10,
+		},
+		cli.IntFlag{
+			Name:  "webhook-workers",
+			Usage: "webhook deliveries made at once, 0 to disable webhooks",
+			Value: 4,
+		},
+		cli.IntFlag{
+			Name:  "webhook-attempts",
+			Usage: "tries at delivering each webhook event before it is kept as a dead letter",
+			Value: atm.WEBHOOK_DEFAULT_ATTEMPTS,
+		},
+		cli.DurationFlag{
+			Name:  "webhook-retry-delay",
+			Usage: "wait before retrying a webhook delivery, doubling after each try",
+			Value: atm.WEBHOOK_DEFAULT_DELAY,
+		},
+		cli.StringSliceFlag{
+			Name:  "webhook-allow-network",
+			Usage: "private, loopback or link-local network (CIDR) webhooks may be sent to, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "webhook-allow-http",
+			Usage: "accept plain http webhook urls, not only https",
+		},
+	)
+}
+
+func openDatastore(c *cli.Context) (*atm.Datastore, error) {
+	return openDatabase(databaseConfig(c))
+}
+
+// The database given by the database flags, or their defaults
+func databaseConfig(c *cli.Context) atm.DatabaseConfig {
+	return atm.DatabaseConfig{
+		Driver:     c.String("database-driver"),
+		Url:        c.String("database-url"),
+		SqliteFile: c.String("database-file"),
+		Host:       c.String("database-host"),
+		Port:       c.Int("database-port"),
+		Name:       c.String("database"),
+		User:       c.String("database-user"),
+
+		PasswordFile: c.String("database-password-file"),
 	}
 }
 
+func openDatabase(config atm.DatabaseConfig) (*atm.Datastore, error) {
+	if "" != config.Url {
+		return openDatabaseUrl(config)
+	}
+	if "" != config.SqliteFile {
+		return atm.NewDatastore(atm.SQLITE_DRIVER, atm.SqliteDsn(config.SqliteFile, nil))
+	}
+
+	driver := config.Driver
+	db_user := config.User
+	db_host := config.Host
+	db_port := config.Port
+	db := config.Name
+
+	var dsnFor func(password string) string
+	switch driver {
+	case atm.MYSQL_DRIVER:
+		if 0 == db_port {
+			db_port = 3306
+		}
+		dsnFor = func(password string) string {
+			return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", db_user, password, db_host, db_port, db)
+		}
+	case atm.POSTGRES_DRIVER:
+		if 0 == db_port {
+			db_port = 5432
+		}
+		dsnFor = func(password string) string {
+			dsn := &url.URL{
+				Scheme: "postgres",
+				User:   url.UserPassword(db_user, password),
+				Host:   fmt.Sprintf("%s:%d", db_host, db_port),
+				Path:   "/" + db,
+			}
+			return dsn.String()
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported database driver: %s", driver))
+	}
+	password, err := databasePassword(config, fmt.Sprintf("%s@%s/%s", db_user, db_host, db))
+	if nil != err {
+		return nil, err
+	}
+	return atm.NewDatastoreWithPassword(driver, dsnFor, password)
+}
+
+// A database url is used as is, unless it has no password & there is a
+// password file to take one from
+func openDatabaseUrl(config atm.DatabaseConfig) (*atm.Datastore, error) {
+	u, err := url.Parse(config.Url)
+	if nil != err {
+		return nil, err
+	}
+	_, hasPassword := u.User.Password()
+	if nil == u.User || hasPassword || "" == config.PasswordFile {
+		driver, dsn, err := atm.ParseDatabaseUrl(config.Url)
+		if nil != err {
+			return nil, err
+		}
+		return atm.NewDatastore(driver, dsn)
+	}
+	password, err := atm.NewPasswordFile(config.PasswordFile)
+	if nil != err {
+		return nil, err
+	}
+	driver, _, err := atm.ParseDatabaseUrl(config.Url)
+	if nil != err {
+		return nil, err
+	}
+	user := u.User.Username()
+	return atm.NewDatastoreWithPassword(driver, func(p string) string {
+		withPassword := *u
+		withPassword.User = url.UserPassword(user, p)
+		_, dsn, _ := atm.ParseDatabaseUrl(withPassword.String())
+		return dsn
+	}, password)
+}
+
+// From the password file, else ATM_DATABASE_PASSWORD, else prompting
+func databasePassword(config atm.DatabaseConfig, prompt string) (*atm.PasswordSource, error) {
+	if "" != config.PasswordFile {
+		return atm.NewPasswordFile(config.PasswordFile)
+	}
+	if password := os.Getenv("ATM_DATABASE_PASSWORD"); "" != password {
+		return atm.StaticPassword(password), nil
+	}
+	fmt.Printf("%s password: ", prompt)
+	db_pass, err := gopass.GetPasswd()
+	if nil != err {
+		return nil, errors.New("No database password, give --database-password-file or ATM_DATABASE_PASSWORD")
+	}
+	defer func() { db_pass = []byte("") }()
+	return atm.StaticPassword(string(db_pass)), nil
+}
+
+// Defaults, then the --config file, then the environment, then flags given
+// on the command line
+func serverConfig(c *cli.Context) (*atm.ServerConfig, error) {
+	config := atm.DefaultServerConfig()
+	config.Database.User = databaseConfig(c).User
+	if file := c.String("config"); "" != file {
+		if err := config.Load(file); nil != err {
+			return nil, err
+		}
+	}
+	if err := config.ApplyEnv(os.Getenv); nil != err {
+		return nil, err
+	}
+	set := func(names ...string) bool {
+		for _, name := range names {
+			if c.IsSet(name) {
+				return true
+			}
+		}
+		return false
+	}
+	if set("listen") {
+		config.Listen = c.StringSlice("listen")
+	}
+	if set("metrics-listen") {
+		config.MetricsListen = c.String("metrics-listen")
+	}
+	if set("object-host", "host") {
+		config.ObjectHost = c.String("object-host")
+	}
+	durations := map[string]*time.Duration{
+		"duration":        &config.DefaultDuration,
+		"max-duration":    &config.MaxDuration,
+		"hmac-expiration": &config.HmacExpiration,
+		"nonce-ttl":       &config.NonceTtl,
+	}
+	for name, value := range durations {
+		if set(name) {
+			*value = c.Duration(name)
+		}
+	}
+	if set("swift-host") {
+		config.SwiftHosts = c.StringSlice("swift-host")
+	}
+	if set("datastore-file") {
+		config.DatastoreFile = c.String("datastore-file")
+	}
+	flags := databaseConfig(c)
+	strs := map[string][]*string{
+		"database-driver": {&config.Database.Driver, &flags.Driver},
+		"database-url":    {&config.Database.Url, &flags.Url},
+		"database-file":   {&config.Database.SqliteFile, &flags.SqliteFile},
+		"database-host":   {&config.Database.Host, &flags.Host},
+		"database":        {&config.Database.Name, &flags.Name},
+		"database-user":   {&config.Database.User, &flags.User},
+
+		"database-password-file": {&config.Database.PasswordFile, &flags.PasswordFile},
+	}
+	for name, value := range strs {
+		if set(name) {
+			*value[0] = *value[1]
+		}
+	}
+	if set("database-port") {
+		config.Database.Port = flags.Port
+	}
+	return config, config.Validate()
+}
+
+// Re-read the database password file when sent SIGHUP
+func reloadCredentialsOnHangup(ds *atm.Datastore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := ds.ReloadCredentials(); nil != err {
+				log.Printf("Reloading database credentials: %s", err.Error())
+				continue
+			}
+			log.Printf("Reloaded database credentials")
+		}
+	}()
+}
+
+// Stop serving on SIGTERM or SIGINT, letting requests in progress finish,
+// before Run returns & the server's deferred closes run
+func shutdownOnSignal(service *atm.Server) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		log.Printf("Shutting down on %s", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := service.Shutdown(ctx); nil != err {
+			log.Printf("Shutting down: %s", err.Error())
+		}
+	}()
+}
+
+// Persist signing keys if there is a master key, loading those saved
+func loadSigningKeys(c *cli.Context, ds *atm.Datastore) error {
+	file := c.String("master-key-file")
+	if "" == file {
+		return nil
+	}
+	if c.Bool("sealed") {
+		return errors.New("Use either --sealed or --master-key-file, not both")
+	}
+	k, err := atm.LoadKek(file)
+	if nil != err {
+		return err
+	}
+	ds.SetMasterKey(atm.NewKeyRing(k))
+	loaded, err := ds.LoadSigningKeys()
+	if nil != err {
+		return err
+	}
+	log.Printf("Loaded %d signing keys", loaded)
+	return watchSigningKeys(ds, c.Duration("key-sync-interval"))
+}
+
+func watchSigningKeys(ds *atm.Datastore, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	return ds.WatchSigningKeys(interval)
+}
+
+// Sealed until enough shares are submitted to recreate the master key
+func sealState(ds *atm.Datastore, syncInterval time.Duration) (*atm.SealState, error) {
+	config, err := ds.SealConfig()
+	if nil != err {
+		return nil, err
+	}
+	if nil == config {
+		return nil, errors.New("Seal not initialized, see atm db init-seal")
+	}
+	return atm.NewSealState(config, func(r *atm.KeyRing) error {
+		ds.SetMasterKey(r)
+		loaded, err := ds.LoadSigningKeys()
+		if nil != err {
+			ds.SetMasterKey(nil)
+			return err
+		}
+		log.Printf("Unsealed, loaded %d signing keys", loaded)
+		return watchSigningKeys(ds, syncInterval)
+	}), nil
+}
+
+// The key clients seal signing keys to. Instances behind a load balancer
+// need the same one, so a key made up at start is only allowed while plain
+// keys are still accepted
+func boxKey(c *cli.Context) (*atm.BoxKey, error) {
+	if file := c.String("box-key-file"); "" != file {
+		return atm.LoadOrCreateBoxKey(file)
+	}
+	if c.Bool("require-sealed-keys") {
+		return nil, errors.New("--require-sealed-keys needs a --box-key-file shared by every instance")
+	}
+	log.Printf("Warning: no --box-key-file, keys sealed for another instance or before a restart can not be opened")
+	return atm.NewBoxKey()
+}
+
+func auditJournal(c *cli.Context) (*atm.AuditJournal, error) {
+	path := c.String("audit-journal")
+	if "" == path {
+		return nil, nil
+	}
+	keyFile := c.String("audit-journal-key")
+	if "" == keyFile {
+		return nil, errors.New("--audit-journal needs --audit-journal-key")
+	}
+	key, err := atm.LoadOrCreateJournalKey(keyFile)
+	if nil != err {
+		return nil, err
+	}
+	log.Printf("Audit journal checkpoints verify with public key %s", atm.JournalPublicKey(key))
+	j, err := atm.OpenAuditJournal(path, key)
+	if nil != err {
+		return nil, err
+	}
+	j.CheckpointEvery = c.Int("audit-journal-checkpoint")
+	j.MaxSize = int64(c.Int("audit-journal-max-size"))
+	j.CheckpointEach(c.Duration("audit-journal-checkpoint-interval"))
+	return j, nil
+}
+
 func serverCommand() cli.Command {
 	return cli.Command{
 		Name:  "server",
 		Usage: "Run webservice",
 		Flags: serverFlags(),
 		Action: func(c *cli.Context) {
-			db_user := c.String("database-user")
-			db_host := c.String("database-host")
-			db := c.String("database")
+			// exiting only once runServer returned, so its deferred closes ran
+			if err := runServer(c); nil != err {
+				log.Print(err)
+				os.Exit(1)
+			}
+		},
+	}
+}
 
-			fmt.Printf("%s@%s/%s password: ", db_user, db_host, db)
-			db_pass, _ := gopass.GetPasswd()
+// Serve until shut down, closing the datastore, audit journal & the rest
+// on the way out
+func runServer(c *cli.Context) error {
+	logger, err := atm.NewLogger(os.Stderr, c.String("log-level"))
+	if nil != err {
+		return err
+	}
+	slog.SetDefault(logger)
+	config, err := serverConfig(c)
+	if nil != err {
+		return err
+	}
+	var ds atm.Store
+	var seal *atm.SealState
+	var audit atm.AuditLog
+	var grants atm.GrantStore
+	var hooks atm.WebhookStore
+	var swiftCreds atm.SwiftCredentialStore
+	if file := config.DatastoreFile; "" != file {
+		ds, err = atm.NewFileDatastore(file, c.Duration("datastore-file-reload"))
+		audit = atm.NewMemoryAuditLog()
+		grants = atm.NewMemoryGrantStore()
+		hooks = atm.NewMemoryWebhookStore()
+	} else {
+		var db *atm.Datastore
+		var ring *atm.KeyRing
+		if ring, err = loadKeyRing(c); nil == err {
+			db, err = openDatabase(config.Database)
+		}
+		if nil == err && nil != ring {
+			db.SetKeyRing(ring)
+		}
+		if nil == err {
+			err = loadSigningKeys(c, db)
+		}
+		if nil == err && ("" != c.String("master-key-file") || c.Bool("sealed")) {
+			swiftCreds = db
+		}
+		if nil == err && c.Bool("sealed") {
+			if 0 == len(c.StringSlice("unseal-key")) {
+				err = errors.New("--sealed needs at least one --unseal-key operator")
+			} else {
+				seal, err = sealState(db, c.Duration("key-sync-interval"))
+			}
+		}
+		if nil == err {
+			reloadCredentialsOnHangup(db)
+		}
+		ds, audit, grants, hooks = db, db, db, db
+	}
+	if nil != err {
+		return err
+	}
+	defer ds.Close()
+	box, err := boxKey(c)
+	if nil != err {
+		return err
+	}
+	logger.Info("box key", "fingerprint", box.PublicKey().Fingerprint())
+	if journal, err := auditJournal(c); nil != err {
+		return err
+	} else if nil != journal {
+		defer journal.Close()
+		audit = atm.NewTeeAuditLog(audit, journal)
+	}
+	swift := atm.NewSwiftKeyFetcher(ds, c.Duration("swift-key-refresh"))
+	swift.Saved = swiftCreds
+	swift.AllowedHosts = config.SwiftAllowedHosts()
+	defer swift.Close()
+	var webhooks *atm.WebhookSender
+	if workers := c.Int("webhook-workers"); workers > 0 {
+		webhooks = atm.NewWebhookSender(hooks, workers)
+		webhooks.MaxAttempts = c.Int("webhook-attempts")
+		webhooks.RetryDelay = c.Duration("webhook-retry-delay")
+		webhooks.AllowHttp = c.Bool("webhook-allow-http")
+		if webhooks.AllowedNetworks, err = atm.ParseNetworks(c.StringSlice("webhook-allow-network")); nil != err {
+			return err
+		}
+		defer webhooks.Close()
+	}
+
+	service := &atm.Server{
+		Ds:                   ds,
+		Object_host:          config.ObjectHost,
+		Object_hosts:         config.ObjectHosts,
+		Default_duration:     int64(config.DefaultDuration.Seconds()),
+		Max_duration:         int64(config.MaxDuration.Seconds()),
+		Hmac_expiration:      config.HmacExpiration,
+		Listen:               config.Listen,
+		Nonces:               atm.NewNonceStoreFor(config.NonceTtl),
+		Seal:                 seal,
+		Swift:                swift,
+		Key_activation_delay: int64(c.Duration("key-activation-delay").Seconds()),
+		Box:                  box,
+		Require_sealed_keys:  c.Bool("require-sealed-keys"),
+		Audit:                audit,
+		Proxy_url:            c.String("proxy-url"),
+		Grants:               grants,
+		Webhooks:             webhooks,
+		Required_accounts:    c.StringSlice("require-key"),
+		Logger:               logger,
+		Unseal_keys:          c.StringSlice("unseal-key"),
+	}
+	if service.Trusted_proxies, err = atm.ParseNetworks(c.StringSlice("trusted-proxy")); nil != err {
+		return err
+	}
+	if c.Int("rate-limit") > 0 || c.Int("auth-failure-limit") > 0 {
+		overrides, _ := ds.(atm.RateLimitStore)
+		service.Limiter = atm.NewRateLimiter(
+			atm.RateLimit{PerMinute: c.Int("rate-limit"), Burst: c.Int("rate-burst")},
+			atm.RateLimit{PerMinute: c.Int("auth-failure-limit"), Burst: c.Int("auth-failure-burst")},
+			overrides)
+	}
+	if c.Bool("metrics") || "" != config.MetricsListen {
+		service.Metrics = atm.NewMetrics(service.Nonces, ds)
+		service.Metrics_listen = config.MetricsListen
+		service.Ds = service.Metrics.TimedStore(ds)
+	}
+	shutdownOnSignal(service)
+	return service.Run()
+}
 
-			ds, err := atm.NewDatastore("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-				db_user, string(db_pass), db_host, c.Int("database-port"), db))
+func serverPubkeyCommand() cli.Command {
+	return cli.Command{
+		Name:  "server-pubkey",
+		Usage: "Print the public key & fingerprint of a server box key file",
+		Description: "Reads the --box-key-file of a server, printing what key set & rotate should be " +
+			"given with --server-pubkey. Run it where the file is, not through the server",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "box-key-file",
+				Usage:  "file holding the server's private box key",
+				EnvVar: "ATM_BOX_KEY_FILE",
+			},
+		},
+		Action: func(c *cli.Context) {
+			file := c.String("box-key-file")
+			if "" == file {
+				log.Fatal("Missing --box-key-file")
+				return
+			}
+			if _, err := os.Stat(file); nil != err {
+				log.Fatal(err)
+				return
+			}
+			box, err := atm.LoadOrCreateBoxKey(file)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			pub := box.PublicKey()
+			fmt.Printf("Public key  %s\nFingerprint %s\n", pub.PublicKey, pub.Fingerprint())
+		},
+	}
+}
+
+func dbCommand() cli.Command {
+	return cli.Command{
+		Name:  "db",
+		Usage: "Manage the database schema",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:        "init",
+				Usage:       "Create the schema in a new database",
+				Description: "Apply all migrations to an empty database",
+				Flags:       databaseFlags(),
+				Action: func(c *cli.Context) {
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					applied, err := ds.InitSchema()
+					printMigrations(applied)
+					if nil != err {
+						log.Fatal(err)
+					}
+				},
+			},
+			cli.Command{
+				Name:        "migrate",
+				Usage:       "Upgrade the schema to the latest version",
+				Description: "Apply any migrations not yet applied to the database",
+				Flags:       databaseFlags(),
+				Action: func(c *cli.Context) {
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					applied, err := ds.Migrate()
+					printMigrations(applied)
+					if nil != err {
+						log.Fatal(err)
+					}
+					if 0 == len(applied) {
+						fmt.Println("Schema already up to date")
+					}
+				},
+			},
+			cli.Command{
+				Name:        "status",
+				Usage:       "Show applied & pending migrations",
+				Description: "List every known migration and when it was applied",
+				Flags:       databaseFlags(),
+				Action: func(c *cli.Context) {
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					status, err := ds.MigrationStatus()
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					for _, m := range status {
+						applied := "pending"
+						if m.Applied {
+							applied = m.AppliedAt.Format(time.RFC3339)
+						}
+						fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, applied)
+					}
+				},
+			},
+			encryptSecretsCommand(),
+			newKekCommand(),
+			initSealCommand(),
+			rateLimitCommand(),
+			allowNetworksCommand(),
+		},
+	}
+}
+
+func allowNetworksCommand() cli.Command {
+	return cli.Command{
+		Name:        "allow-networks",
+		Usage:       "Limit where an api key may be used from",
+		ArgsUsage:   "<api key> [cidr...]",
+		Description: "Requests signed with the api key are refused from outside the networks. Without any the key may be used from anywhere",
+		Flags:       databaseFlags(),
+		Action: func(c *cli.Context) {
+			apiKey := c.Args().Get(0)
+			if "" == apiKey {
+				log.Fatal("Missing api key")
+				return
+			}
+			ds, err := openDatastore(c)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			defer ds.Close()
+			if err := ds.SetAllowedNetworks(apiKey, c.Args()[1:]); nil != err {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func rateLimitCommand() cli.Command {
+	return cli.Command{
+		Name:  "rate-limit",
+		Usage: "Manage per requestor rate limit overrides",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:  "list",
+				Usage: "List every override",
+				Flags: databaseFlags(),
+				Action: func(c *cli.Context) {
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					limits, err := ds.RateLimits()
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					for _, r := range limits {
+						fmt.Printf("%s\t%d/min\tburst %d\n", r.RequestorId, r.PerMinute, r.Burst)
+					}
+				},
+			},
+			cli.Command{
+				Name:      "set",
+				Usage:     "Override the rate limit of a requestor",
+				ArgsUsage: "<api key>",
+				Flags: append(databaseFlags(),
+					cli.IntFlag{
+						Name:  "per-minute",
+						Usage: "requests per minute, 0 for no limit",
+					},
+					cli.IntFlag{
+						Name:  "burst",
+						Usage: "requests at once",
+					},
+				),
+				Action: func(c *cli.Context) {
+					r := atm.RateLimit{
+						RequestorId: c.Args().Get(0),
+						PerMinute:   c.Int("per-minute"),
+						Burst:       c.Int("burst"),
+					}
+					if "" == r.RequestorId {
+						log.Fatal("Missing api key")
+						return
+					}
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					if err := ds.SetRateLimit(r); nil != err {
+						log.Fatal(err)
+					}
+				},
+			},
+			cli.Command{
+				Name:      "remove",
+				Usage:     "Go back to the default rate limit for a requestor",
+				ArgsUsage: "<api key>",
+				Flags:     databaseFlags(),
+				Action: func(c *cli.Context) {
+					ds, err := openDatastore(c)
+					if nil != err {
+						log.Fatal(err)
+						return
+					}
+					defer ds.Close()
+					if err := ds.RemoveRateLimit(c.Args().Get(0)); nil != err {
+						log.Fatal(err)
+					}
+				},
+			},
+		},
+	}
+}
+
+func encryptSecretsCommand() cli.Command {
+	return cli.Command{
+		Name:  "encrypt-secrets",
+		Usage: "Encrypt api secrets with the current key-encryption key",
+		Description: "Encrypts any plaintext api secrets with the --kek-file key. To rotate, " +
+			"give the new key as --kek-file and the previous as --old-kek-file, every secret " +
+			"sealed by an old key is re-encrypted with the new one",
+		Flags: append(databaseFlags(), kekFlags()...),
+		Action: func(c *cli.Context) {
+			ring, err := loadKeyRing(c)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			if nil == ring {
+				log.Fatal("A key-encryption key is required, see --kek-file")
+				return
+			}
+			ds, err := openDatastore(c)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			defer ds.Close()
+			changed, err := ds.EncryptSecrets(ring)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			fmt.Printf("Encrypted %d secrets with kek %s\n", changed, ring.CurrentId())
+		},
+	}
+}
+
+func initSealCommand() cli.Command {
+	return cli.Command{
+		Name:  "init-seal",
+		Usage: "Create a master key for sealed mode, split into unseal shares",
+		Description: "Generates a master key for signing keys, printing it split into shares " +
+			"any threshold of which unseal a server started with --sealed. The master key " +
+			"itself is never stored, hand each share to a different operator",
+		ArgsUsage: "<id>",
+		Flags: append(databaseFlags(),
+			cli.IntFlag{
+				Name:  "shares",
+				Usage: "number of shares to create",
+				Value: 5,
+			},
+			cli.IntFlag{
+				Name:  "threshold",
+				Usage: "number of shares needed to unseal",
+				Value: 3,
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "replace an existing seal, signing keys saved under it are lost",
+			},
+		),
+		Action: func(c *cli.Context) {
+			id := c.Args().Get(0)
+			if "" == id {
+				fmt.Fprintf(os.Stderr, "Missing id argument\n")
+				cli.ShowSubcommandHelp(c)
+				os.Exit(1)
+			}
+			config, shares, err := atm.NewSealedMasterKey(id, c.Int("shares"), c.Int("threshold"))
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			ds, err := openDatastore(c)
 			if nil != err {
 				log.Fatal(err)
 				return
 			}
-			db_pass = []byte("")
 			defer ds.Close()
+			if err := ds.SaveSealConfig(config, c.Bool("force")); nil != err {
+				log.Fatal(err)
+				return
+			}
+			fmt.Printf("Master key %s, %d of these shares are needed to unseal\n", id, config.Threshold)
+			for i, share := range shares {
+				fmt.Printf("Share %d: %s\n", i+1, share)
+			}
+		},
+	}
+}
 
-			service := &atm.Server{
-				Ds:               ds,
-				Object_host:      c.String("object-host"),
-				Default_duration: int64(c.Duration("duration").Seconds()),
-				Nonces:           atm.NewNonceStore(),
+func newKekCommand() cli.Command {
+	return cli.Command{
+		Name:      "new-kek",
+		Usage:     "Generate a new key-encryption key",
+		ArgsUsage: "<id>",
+		Action: func(c *cli.Context) {
+			id := c.Args().Get(0)
+			if "" == id {
+				fmt.Fprintf(os.Stderr, "Missing id argument\n")
+				cli.ShowSubcommandHelp(c)
+				os.Exit(1)
 			}
-			service.Run()
+			k, err := atm.NewKek(id)
+			if nil != err {
+				log.Fatal(err)
+				return
+			}
+			fmt.Println(k.String())
 		},
 	}
 }
+
+func printMigrations(applied []atm.Migration) {
+	for _, m := range applied {
+		fmt.Printf("Applied %04d %s\n", m.Version, m.Name)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// A Store held entirely in memory, for tests & tiny deployments
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+)
+
+// An access rule, as in the rules table. Container & Object are regular
+// expressions and Method a comma separated set of methods
+type Rule struct {
+	// Optional, reported in the audit log. Defaults to the rule's position
+	Id          string `json:"id" yaml:"id"`
+	AccountId   string `json:"account_id" yaml:"account_id"`
+	RequestorId string `json:"requestor_id" yaml:"requestor_id"`
+	Container   string `json:"container" yaml:"container"`
+	Object      string `json:"object" yaml:"object"`
+	Method      string `json:"method" yaml:"method"`
+	Duration    int64  `json:"duration" yaml:"duration"`
+	container   *regexp.Regexp
+	object      *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.container, err = regexp.Compile(r.Container); nil != err {
+		return errors.New(fmt.Sprintf("Invalid container pattern %s: %s", r.Container, err.Error()))
+	}
+	if r.object, err = regexp.Compile(r.Object); nil != err {
+		return errors.New(fmt.Sprintf("Invalid object pattern %s: %s", r.Object, err.Error()))
+	}
+	return nil
+}
+
+func (r *Rule) matches(u *UrlRequest) bool {
+	return r.container.MatchString(u.Container) &&
+		r.object.MatchString(u.Object) &&
+		methodAllowed(r.Method, u.Method)
+}
+
+type memoryAccount struct {
+	Account
+	secret   string
+	networks []*net.IPNet
+}
+
+type MemoryDatastore struct {
+	*SigningKeys
+	lock       sync.RWMutex
+	accounts   map[string]*memoryAccount
+	rules      []*Rule
+	rateLimits map[string]*RateLimit
+}
+
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{
+		SigningKeys: NewSigningKeys(),
+		accounts:    make(map[string]*memoryAccount),
+		rateLimits:  make(map[string]*RateLimit),
+	}
+}
+
+func (m *MemoryDatastore) AddAccount(id, name, secret string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.accounts[name] = &memoryAccount{Account: Account{Id: id, Name: name}, secret: secret}
+}
+
+func (m *MemoryDatastore) AddRule(r Rule) error {
+	if err := r.compile(); nil != err {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rules = append(m.rules, &r)
+	return nil
+}
+
+// Swap all accounts, rules & rate limits at once, leaving signing keys alone
+func (m *MemoryDatastore) replace(accounts map[string]*memoryAccount, rules []*Rule,
+	rateLimits map[string]*RateLimit) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.accounts = accounts
+	m.rules = rules
+	m.rateLimits = rateLimits
+}
+
+func (m *MemoryDatastore) Ping() error {
+	return nil
+}
+
+func (m *MemoryDatastore) Close() error {
+	return nil
+}
+
+func (m *MemoryDatastore) Account(name string) (*Account, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	a := &Account{}
+	if found, ok := m.accounts[name]; ok {
+		*a = found.Account
+	}
+	return a, nil
+}
+
+func (m *MemoryDatastore) accountById(id string) *memoryAccount {
+	for _, a := range m.accounts {
+		if id == a.Id {
+			return a
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDatastore) KeyForRequest(u *UrlRequest, appId string) (string, int64, error) {
+	m.lock.RLock()
+	account, ok := m.accounts[u.Account]
+	var matched *Rule
+	if ok {
+		for i, r := range m.rules {
+			if r.AccountId == account.Id && r.RequestorId == appId && r.matches(u) {
+				matched = r
+				u.RuleId = r.Id
+				if "" == r.Id {
+					u.RuleId = fmt.Sprintf("%d", i+1)
+				}
+			}
+		}
+	}
+	m.lock.RUnlock()
+	if nil == matched {
+		return "", 0, nil
+	}
+
+	signing_key := m.signingKeyFor(matched.AccountId)
+	if "" == signing_key {
+		return signing_key, 0, KeyNotSetError{Account: u.Account, AccountId: matched.AccountId}
+	}
+	return signing_key, matched.Duration, nil
+}
+
+func (m *MemoryDatastore) ApiKeySecret(apiKey string) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if a := m.accountById(apiKey); nil != a && "" != a.secret {
+		return a.secret, nil
+	}
+	return "", UnknownApiKeyError{ApiKey: apiKey}
+}
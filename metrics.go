@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Prometheus metrics, served at /metrics. A nil *Metrics records nothing
+package atm
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE = "atm"
+	// label values standing in for accounts & methods not worth a series
+	METRICS_UNKNOWN = "unknown"
+	METRICS_OTHER   = "other"
+)
+
+type Metrics struct {
+	Registry     *prometheus.Registry
+	urls         *prometheus.CounterVec
+	authFailures *prometheus.CounterVec
+	queries      *prometheus.HistogramVec
+	lock         sync.Mutex
+	// accounts whose last url request found no signing key
+	missing map[string]bool
+}
+
+type counter interface {
+	Count() int
+}
+
+// Metrics for a server using nonces & ds, which also report their sizes if
+// they can be counted
+func NewMetrics(nonces NonceChecker, ds Store) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		urls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "urls_total",
+			Help:      "Url requests by account, method & outcome (issued, denied or failed)",
+		}, []string{"account", "method", "outcome"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "auth_failures_total",
+			Help:      "Failed request authentications by reason",
+		}, []string{"reason"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "datastore_query_seconds",
+			Help:      "Time taken by datastore calls by operation",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"operation"}),
+		missing: make(map[string]bool),
+	}
+	m.Registry.MustRegister(m.urls, m.authFailures, m.queries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "accounts_missing_signing_key",
+			Help:      "Accounts whose latest url request found no signing key set",
+		}, func() float64 {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			return float64(len(m.missing))
+		}),
+	)
+	if c, ok := nonces.(counter); ok {
+		m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "nonces",
+			Help:      "Nonces remembered to detect replayed requests",
+		}, func() float64 { return float64(c.Count()) }))
+	}
+	if c, ok := ds.(counter); ok {
+		m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "signing_key_accounts",
+			Help:      "Accounts with signing keys loaded",
+		}, func() float64 { return float64(c.Count()) }))
+	}
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// Labelled with the account name only once it resolved to an account, &
+// only the methods swift knows, so requests can not make up new series
+func (m *Metrics) urlOutcome(accountId, account, method, outcome string) {
+	if nil == m {
+		return
+	}
+	if "" == accountId {
+		account = METRICS_UNKNOWN
+	}
+	switch method {
+	case "GET", "HEAD", "PUT", "POST", "DELETE":
+	default:
+		method = METRICS_OTHER
+	}
+	m.urls.WithLabelValues(account, method, outcome).Inc()
+}
+
+func (m *Metrics) authFailed(reason string) {
+	if nil == m {
+		return
+	}
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) keyMissing(account string) {
+	if nil == m {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.missing[account] = true
+}
+
+func (m *Metrics) keyFound(account string) {
+	if nil == m {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.missing, account)
+}
+
+// Wrap ds to time each call made through the Store interface
+func (m *Metrics) TimedStore(ds Store) Store {
+	return &timedStore{Store: ds, m: m}
+}
+
+type timedStore struct {
+	Store
+	m *Metrics
+}
+
+func (t *timedStore) observe(operation string, start time.Time) {
+	t.m.queries.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (t *timedStore) Account(name string) (*Account, error) {
+	defer t.observe("account", time.Now())
+	return t.Store.Account(name)
+}
+
+func (t *timedStore) KeyForRequest(u *UrlRequest, appId string) (string, int64, error) {
+	defer t.observe("key_for_request", time.Now())
+	return t.Store.KeyForRequest(u, appId)
+}
+
+func (t *timedStore) ApiKeySecret(apiKey string) (string, error) {
+	defer t.observe("api_key_secret", time.Now())
+	return t.Store.ApiKeySecret(apiKey)
+}
+
+func (t *timedStore) AllowedNetworks(apiKey string) ([]*net.IPNet, error) {
+	defer t.observe("allowed_networks", time.Now())
+	return t.Store.AllowedNetworks(apiKey)
+}
+
+func (t *timedStore) StageSigningKeyForAccount(account string, k *SigningKey) error {
+	defer t.observe("stage_signing_key", time.Now())
+	return t.Store.StageSigningKeyForAccount(account, k)
+}
+
+func (t *timedStore) RemoveSigningKeyForAccount(account string) error {
+	defer t.observe("remove_signing_key", time.Now())
+	return t.Store.RemoveSigningKeyForAccount(account)
+}
+
+func (t *timedStore) Ping() error {
+	defer t.observe("ping", time.Now())
+	return t.Store.Ping()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Versioned schema migrations embedded in the binary
+package atm
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+const MIGRATIONS_TABLE = "schema_migrations"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// The embedded migrations for driver, ordered by version. Files are named
+// like migrations/<driver>/0001_initial.sql
+func MigrationsFor(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("No migrations for database driver %s", driver))
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if nil != err || len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid migration file name %s", e.Name()))
+		}
+		up, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if nil != err {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], Up: string(up)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, errors.New(fmt.Sprintf("Duplicate migration version %d", migrations[i].Version))
+		}
+	}
+	return migrations, nil
+}
+
+// The individual statements of a migration, split on a trailing ; with
+// comment lines removed as not every driver will run several at once
+func (m *Migration) Statements() []string {
+	var statements []string
+	var b strings.Builder
+	for _, line := range strings.Split(m.Up, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if "" == trimmed || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(b.String()), ";"))
+			b.Reset()
+		}
+	}
+	if s := strings.TrimSpace(b.String()); "" != s {
+		statements = append(statements, s)
+	}
+	return statements
+}
+
+func (d *Datastore) createMigrationsTable() error {
+	_, err := d.pool.Exec("CREATE TABLE IF NOT EXISTS " + MIGRATIONS_TABLE + " (" +
+		"version INTEGER NOT NULL PRIMARY KEY, " +
+		"name VARCHAR(255) NOT NULL, " +
+		"applied_at BIGINT NOT NULL)")
+	return err
+}
+
+func (d *Datastore) appliedMigrations() (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	rows, err := d.pool.Query("SELECT version, applied_at FROM " + MIGRATIONS_TABLE)
+	if nil != err {
+		return applied, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); nil != err {
+			return applied, err
+		}
+		applied[version] = time.Unix(at, 0).UTC()
+	}
+	return applied, rows.Err()
+}
+
+// Create the schema for a new, empty database. Refuses to run against one
+// that already has migrations recorded
+func (d *Datastore) InitSchema() ([]Migration, error) {
+	if err := d.createMigrationsTable(); nil != err {
+		return nil, err
+	}
+	applied, err := d.appliedMigrations()
+	if nil != err {
+		return nil, err
+	}
+	if len(applied) > 0 {
+		return nil, errors.New("Database already initialized, use migrate to upgrade it")
+	}
+	return d.Migrate()
+}
+
+// Apply any migrations not yet recorded, in order, returning those applied
+func (d *Datastore) Migrate() ([]Migration, error) {
+	migrations, err := MigrationsFor(d.driver)
+	if nil != err {
+		return nil, err
+	}
+	if err := d.createMigrationsTable(); nil != err {
+		return nil, err
+	}
+	applied, err := d.appliedMigrations()
+	if nil != err {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range migrations {
+		if _, found := applied[m.Version]; found {
+			continue
+		}
+		if err := d.applyMigration(&m); nil != err {
+			return done, errors.New(fmt.Sprintf("Migration %04d_%s failed: %s", m.Version, m.Name, err.Error()))
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (d *Datastore) applyMigration(m *Migration) error {
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	for _, s := range m.Statements() {
+		if _, err := tx.Exec(s); nil != err {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO "+MIGRATIONS_TABLE+" (version, name, applied_at) VALUES (?, ?, ?)"),
+		m.Version, m.Name, time.Now().UTC().Unix())
+	if nil != err {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Every known migration along with if & when it was applied
+func (d *Datastore) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := MigrationsFor(d.driver)
+	if nil != err {
+		return nil, err
+	}
+	if err := d.createMigrationsTable(); nil != err {
+		return nil, err
+	}
+	applied, err := d.appliedMigrations()
+	if nil != err {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		at, found := applied[m.Version]
+		status = append(status, MigrationStatus{Migration: m, Applied: found, AppliedAt: at})
+	}
+	return status, nil
+}
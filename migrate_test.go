@@ -0,0 +1,32 @@
+package atm
+
+import (
+	"testing"
+)
+
+func TestMigrationsFor(t *testing.T) {
+	m, err := MigrationsFor("mysql")
+	if nil != err {
+		t.Fatal("Unable to load mysql migrations", err)
+	}
+	if 0 == len(m) || 1 != m[0].Version {
+		t.Error("Expected migrations starting at version 1", m)
+	}
+	if _, err := MigrationsFor("nosuchdb"); nil == err {
+		t.Error("Expected an error for unknown driver")
+	}
+}
+
+func TestMigrationStatements(t *testing.T) {
+	m := &Migration{Up: "-- a comment\nCREATE TABLE a (\n\tid INTEGER\n);\n\nCREATE TABLE b (id INTEGER);\nCREATE INDEX c ON b (id)\n"}
+	s := m.Statements()
+	if 3 != len(s) {
+		t.Fatal("Expected 3 statements", s)
+	}
+	if "CREATE TABLE a (\n\tid INTEGER\n)" != s[0] {
+		t.Error("Unexpected first statement", s[0])
+	}
+	if "CREATE INDEX c ON b (id)" != s[2] {
+		t.Error("Unexpected last statement", s[2])
+	}
+}
@@ -0,0 +1,2 @@
+-- Room for secrets encrypted with a kek
+ALTER TABLE accounts MODIFY secret VARCHAR(1024) NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- Swift signing keys, envelope encrypted with the server master key. dek
+-- is the per key data encryption key sealed by the master key
+CREATE TABLE IF NOT EXISTS signing_keys (
+	account_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	dek VARCHAR(1024) NOT NULL,
+	signing_key VARCHAR(1024) NOT NULL,
+	updated_at BIGINT NOT NULL,
+	FOREIGN KEY (account_id) REFERENCES accounts(id)
+);
@@ -0,0 +1,8 @@
+-- A log of signing key changes, polled by every instance to refresh the
+-- keys it has cached
+CREATE TABLE IF NOT EXISTS signing_key_events (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	account_id VARCHAR(255) NOT NULL,
+	action VARCHAR(16) NOT NULL,
+	created_at BIGINT NOT NULL
+);
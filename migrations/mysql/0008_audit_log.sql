@@ -0,0 +1,18 @@
+-- Every url issued or denied. expires_at is 0 when nothing was issued
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	created_at BIGINT NOT NULL,
+	outcome VARCHAR(16) NOT NULL,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	requestor_id VARCHAR(255) NOT NULL,
+	account_id VARCHAR(255) NOT NULL DEFAULT '',
+	account VARCHAR(255) NOT NULL,
+	container VARCHAR(1024) NOT NULL,
+	object VARCHAR(1024) NOT NULL,
+	method VARCHAR(16) NOT NULL,
+	expires_at BIGINT NOT NULL DEFAULT 0,
+	rule_id VARCHAR(255) NOT NULL DEFAULT '',
+	client_ip VARCHAR(64) NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_requestor ON audit_log (requestor_id);
+CREATE INDEX audit_log_account ON audit_log (account_id);
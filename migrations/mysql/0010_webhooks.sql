@@ -0,0 +1,25 @@
+-- Outbound notifications per account. events is a comma separated list of
+-- event types, empty for all, & container a regexp limiting url events
+CREATE TABLE IF NOT EXISTS webhooks (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	account_id VARCHAR(255) NOT NULL,
+	url VARCHAR(2048) NOT NULL,
+	secret VARCHAR(255) NOT NULL,
+	events VARCHAR(255) NOT NULL DEFAULT '',
+	container VARCHAR(1024) NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+CREATE INDEX webhooks_account ON webhooks (account_id);
+
+-- Deliveries given up on after every retry failed. event is the JSON payload
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	webhook_id VARCHAR(64) NOT NULL,
+	account_id VARCHAR(255) NOT NULL,
+	url VARCHAR(2048) NOT NULL,
+	event TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	last_error VARCHAR(1024) NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+CREATE INDEX webhook_dead_letters_account ON webhook_dead_letters (account_id);
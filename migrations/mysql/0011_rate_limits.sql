@@ -0,0 +1,7 @@
+-- Per requestor overrides of the default rate limit. A per_minute of 0
+-- leaves the requestor unlimited
+CREATE TABLE IF NOT EXISTS rate_limits (
+	requestor_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	per_minute INTEGER NOT NULL,
+	burst INTEGER NOT NULL
+);
@@ -0,0 +1,10 @@
+-- Swift credentials accounts registered to have their signing key fetched,
+-- a JSON document envelope encrypted with the server master key like
+-- signing_keys
+CREATE TABLE IF NOT EXISTS swift_credentials (
+	account_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	dek VARCHAR(1024) NOT NULL,
+	credentials TEXT NOT NULL,
+	updated_at BIGINT NOT NULL,
+	FOREIGN KEY (account_id) REFERENCES accounts(id)
+);
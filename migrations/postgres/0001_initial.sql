@@ -0,0 +1,21 @@
+-- Accounts are both owners of swift accounts & requestors of urls,
+-- the id doubles as the api key
+CREATE TABLE IF NOT EXISTS accounts (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	secret VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+-- Which requestor may get urls to which containers/objects (regular
+-- expressions) with which comma separated methods in an account
+CREATE TABLE IF NOT EXISTS rules (
+	id SERIAL PRIMARY KEY,
+	account_id VARCHAR(255) NOT NULL REFERENCES accounts(id),
+	requestor_id VARCHAR(255) NOT NULL,
+	container VARCHAR(1024) NOT NULL,
+	object VARCHAR(1024) NOT NULL,
+	method VARCHAR(64) NOT NULL,
+	duration BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS rules_requestor ON rules (requestor_id);
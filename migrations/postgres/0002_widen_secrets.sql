@@ -0,0 +1,2 @@
+-- Room for secrets encrypted with a kek
+ALTER TABLE accounts ALTER COLUMN secret TYPE VARCHAR(1024);
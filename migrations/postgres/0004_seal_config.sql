@@ -0,0 +1,9 @@
+-- Sealed mode, the master key is split into shares & never stored. Only
+-- its id and a value sealed by it, to verify recombined shares, are kept
+CREATE TABLE IF NOT EXISTS seal_config (
+	id INTEGER NOT NULL PRIMARY KEY,
+	kek_id VARCHAR(255) NOT NULL,
+	shares INTEGER NOT NULL,
+	threshold INTEGER NOT NULL,
+	check_value VARCHAR(1024) NOT NULL
+);
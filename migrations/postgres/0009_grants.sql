@@ -0,0 +1,18 @@
+-- Opaque urls issued in proxy mode, by sha256 of the token. revoked_at is 0
+-- until revoked
+CREATE TABLE IF NOT EXISTS grants (
+	id CHAR(64) NOT NULL PRIMARY KEY,
+	requestor_id VARCHAR(255) NOT NULL,
+	account_id VARCHAR(255) NOT NULL,
+	account VARCHAR(255) NOT NULL,
+	container VARCHAR(1024) NOT NULL,
+	object VARCHAR(1024) NOT NULL,
+	method VARCHAR(16) NOT NULL,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	revoked_at BIGINT NOT NULL DEFAULT 0,
+	bytes_in BIGINT NOT NULL DEFAULT 0,
+	bytes_out BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX grants_requestor ON grants (requestor_id);
+CREATE INDEX grants_account ON grants (account_id);
@@ -0,0 +1,3 @@
+-- A check value of each unseal share, comma separated, so bad shares are
+-- refused as they are submitted
+ALTER TABLE seal_config ADD COLUMN share_checks TEXT;
@@ -0,0 +1,2 @@
+-- Room for secrets encrypted with a kek. SQLite does not enforce VARCHAR
+-- lengths so there is nothing to change, this keeps versions in step
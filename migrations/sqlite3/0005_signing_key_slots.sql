@@ -0,0 +1,17 @@
+-- Two signing keys per account, like swift's Temp-URL-Key & Temp-URL-Key-2,
+-- so keys can be rotated. Slot 1 is the newest key, only used for signing
+-- from active_at, slot 2 the key it replaces
+CREATE TABLE signing_key_slots (
+	account_id VARCHAR(255) NOT NULL,
+	slot INTEGER NOT NULL,
+	dek VARCHAR(1024) NOT NULL,
+	signing_key VARCHAR(1024) NOT NULL,
+	active_at BIGINT NOT NULL,
+	set_at BIGINT NOT NULL,
+	PRIMARY KEY (account_id, slot),
+	FOREIGN KEY (account_id) REFERENCES accounts(id)
+);
+INSERT INTO signing_key_slots (account_id, slot, dek, signing_key, active_at, set_at)
+	SELECT account_id, 1, dek, signing_key, updated_at, updated_at FROM signing_keys;
+DROP TABLE signing_keys;
+ALTER TABLE signing_key_slots RENAME TO signing_keys;
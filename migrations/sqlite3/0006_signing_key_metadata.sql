@@ -0,0 +1,3 @@
+-- Who set each signing key and when it is dropped, 0 for never
+ALTER TABLE signing_keys ADD COLUMN set_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE signing_keys ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Comma separated CIDRs an api key may be used from, anywhere when empty
+ALTER TABLE accounts ADD COLUMN allowed_networks VARCHAR(1024) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Expired grants are dropped as new ones are created, by expires_at
+CREATE INDEX grants_expires ON grants (expires_at);
@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Client addresses, as seen through trusted proxies, and the networks each
+// api key may be used from
+package atm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	CLIENT_IP       = "client-ip"
+	FORWARDED_FOR   = "X-Forwarded-For"
+	NETWORKS_SEP    = ","
+	maxNetworksSize = 1024
+)
+
+// The networks apiKey may be used from, nil for anywhere
+type NetworkFinder func(apiKey string) ([]*net.IPNet, error)
+
+// Parse CIDRs, taking a bare address as a network of just that address
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if "" == cidr {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if nil == ip {
+				return nil, errors.New(fmt.Sprintf("Invalid network %s", cidr))
+			}
+			bits := 8 * net.IPv6len
+			if nil != ip.To4() {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if nil != err {
+			return nil, errors.New(fmt.Sprintf("Invalid network %s", cidr))
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinNetworks(networks []*net.IPNet) string {
+	cidrs := make([]string, 0, len(networks))
+	for _, n := range networks {
+		cidrs = append(cidrs, n.String())
+	}
+	return strings.Join(cidrs, NETWORKS_SEP)
+}
+
+// Proxies trusted to report the client address in X-Forwarded-For
+type TrustedProxies []*net.IPNet
+
+// The address of the client making r. When it came through trusted proxies
+// that is the nearest address in X-Forwarded-For not itself a trusted proxy
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err {
+		addr = r.RemoteAddr
+	}
+	ip := net.ParseIP(addr)
+	if nil == ip || !networksContain(p, ip) {
+		return addr
+	}
+	var hops []string
+	for _, header := range r.Header[FORWARDED_FOR] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if nil == hop {
+			break
+		}
+		addr = hop.String()
+		if !networksContain(p, hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// Middleware noting the client address for everything after it
+func ClientAddress(p TrustedProxies) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		c.Set(CLIENT_IP, p.ClientIP(c.Request()))
+		return nil
+	}
+}
+
+// Refuse apiKey from addr when it has networks & addr is in none of them
+func allowedFrom(find NetworkFinder, apiKey, addr string) error {
+	networks, err := find(apiKey)
+	if nil != err {
+		return err
+	}
+	if 0 == len(networks) {
+		return nil
+	}
+	if ip := net.ParseIP(addr); nil != ip && networksContain(networks, ip) {
+		return nil
+	}
+	return hmacError{fmt.Sprintf("Api key %s not allowed from %s", apiKey, addr), AUTH_FAILED_NETWORK}
+}
+
+func (m *MemoryDatastore) AllowedNetworks(apiKey string) ([]*net.IPNet, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if a := m.accountById(apiKey); nil != a {
+		return a.networks, nil
+	}
+	return nil, nil
+}
+
+// Limit apiKey to the cidrs, or allow it from anywhere when there are none
+func (m *MemoryDatastore) SetAllowedNetworks(apiKey string, cidrs []string) error {
+	networks, err := ParseNetworks(cidrs)
+	if nil != err {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	a := m.accountById(apiKey)
+	if nil == a {
+		return errors.New(fmt.Sprintf("No account with api key %s", apiKey))
+	}
+	a.networks = networks
+	return nil
+}
+
+func (d *Datastore) AllowedNetworks(apiKey string) ([]*net.IPNet, error) {
+	var cidrs string
+	err := d.pool.QueryRow(d.rebind("SELECT allowed_networks FROM accounts WHERE id = ?"), apiKey).Scan(&cidrs)
+	if nil != err {
+		return nil, err
+	}
+	return ParseNetworks(strings.Split(cidrs, NETWORKS_SEP))
+}
+
+// Limit apiKey to the cidrs, or allow it from anywhere when there are none
+func (d *Datastore) SetAllowedNetworks(apiKey string, cidrs []string) error {
+	networks, err := ParseNetworks(cidrs)
+	if nil != err {
+		return err
+	}
+	joined := joinNetworks(networks)
+	if len(joined) > maxNetworksSize {
+		return errors.New("Too many networks")
+	}
+	// looked up rather than going by rows affected, which mysql only counts
+	// when the value changed
+	var id string
+	err = d.pool.QueryRow(d.rebind("SELECT id FROM accounts WHERE id = ?"), apiKey).Scan(&id)
+	if sql.ErrNoRows == err {
+		return errors.New(fmt.Sprintf("No account with api key %s", apiKey))
+	} else if nil != err {
+		return err
+	}
+	_, err = d.pool.Exec(d.rebind("UPDATE accounts SET allowed_networks = ? WHERE id = ?"), joined, apiKey)
+	return err
+}
@@ -0,0 +1,46 @@
+package atm
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.1.0.0/16", " 192.0.2.7 ", "", "2001:db8::/32"})
+	if nil != err || 3 != len(networks) {
+		t.Fatal("Unexpected networks", networks, err)
+	}
+	if "192.0.2.7/32" != networks[1].String() {
+		t.Error("Expected a bare address to be a /32", networks[1])
+	}
+	if !networksContain(networks, net.ParseIP("10.1.200.3")) || networksContain(networks, net.ParseIP("10.2.0.1")) {
+		t.Error("Unexpected containment")
+	}
+	if _, err := ParseNetworks([]string{"10.1.0.0/33"}); nil == err {
+		t.Error("Expected an invalid network to be refused")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	p := TrustedProxies(proxies)
+	r := &http.Request{RemoteAddr: "192.0.2.1:4000", Header: http.Header{}}
+	r.Header.Set(FORWARDED_FOR, "198.51.100.9")
+	if "192.0.2.1" != p.ClientIP(r) {
+		t.Error("Expected X-Forwarded-For ignored from an untrusted address", p.ClientIP(r))
+	}
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set(FORWARDED_FOR, "203.0.113.5, 198.51.100.9, 10.0.0.3")
+	if "198.51.100.9" != p.ClientIP(r) {
+		t.Error("Expected the nearest untrusted hop", p.ClientIP(r))
+	}
+	r.Header.Set(FORWARDED_FOR, "10.0.0.4")
+	if "10.0.0.4" != p.ClientIP(r) {
+		t.Error("Expected the furthest proxy when every hop is trusted", p.ClientIP(r))
+	}
+	r.Header.Del(FORWARDED_FOR)
+	if "10.0.0.2" != p.ClientIP(r) {
+		t.Error("Expected the proxy itself without X-Forwarded-For", p.ClientIP(r))
+	}
+}
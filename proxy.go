@@ -0,0 +1,257 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Proxy mode, where atm hands out opaque urls & streams the objects to &
+// from swift itself, so grants can be revoked & their traffic counted
+package atm
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// How long the tempurl used for each proxied request is valid
+	PROXY_SIGN_DURATION = 60
+	GRANT_PATH          = "/p/"
+
+	PROXY_DIAL_TIMEOUT            = 10 * time.Second
+	PROXY_RESPONSE_HEADER_TIMEOUT = 30 * time.Second
+)
+
+// Request headers passed along to swift
+var proxyRequestHeaders = []string{
+	"Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Etag",
+}
+
+// Response headers not passed back from swift
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// For proxied requests when the server has no Proxy_client. There is no
+// overall timeout, as large objects may take long to stream, but swift
+// must connect & start answering promptly
+var defaultProxyClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   PROXY_DIAL_TIMEOUT,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   PROXY_DIAL_TIMEOUT,
+		ResponseHeaderTimeout: PROXY_RESPONSE_HEADER_TIMEOUT,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	// swift's replies are passed back as they are
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Methods an opaque url can be issued for
+func proxiedMethod(method string) bool {
+	return "GET" == method || "HEAD" == method || "PUT" == method
+}
+
+func (s *Server) proxying() bool {
+	return "" != s.Proxy_url && nil != s.Grants
+}
+
+// Record a grant for each of us, expiring at the matching expires, all
+// together or not at all, returning the opaque urls for them
+func (s *Server) grantUrls(us []UrlRequest, requestorId string, expires []int64) ([]string, error) {
+	grants := make([]*Grant, len(us))
+	urls := make([]string, len(us))
+	for i := range us {
+		u := &us[i]
+		token, id, err := NewGrantToken()
+		if nil != err {
+			return nil, err
+		}
+		grants[i] = &Grant{
+			Id:          id,
+			RequestorId: requestorId,
+			Account:     u.Account,
+			Container:   u.Container,
+			Object:      u.Object,
+			Method:      u.Method,
+			CreatedAt:   time.Now().UTC(),
+			ExpiresAt:   time.Unix(expires[i], 0).UTC(),
+		}
+		if a, err := s.Ds.Account(u.Account); nil == err {
+			grants[i].AccountId = a.Id
+		}
+		urls[i] = strings.TrimRight(s.Proxy_url, "/") + GRANT_PATH + token
+	}
+	if err := s.Grants.CreateGrants(grants); nil != err {
+		return nil, err
+	}
+	return urls, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Stream a request on an opaque url to swift, after checking the grant is
+// still good & the rules still allow it
+func (s *Server) proxy(c *echo.Context) error {
+	if !s.proxying() {
+		return c.JSON(http.StatusNotFound, ErrMsg(http.StatusText(http.StatusNotFound)))
+	}
+	if s.sealed() {
+		return sealedError(c)
+	}
+	g, err := s.Grants.Grant(GrantId(c.Param("token")))
+	if nil != err {
+		requestLog(c).Error("proxy", "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble checking grant"))
+	}
+	if nil == g {
+		return c.JSON(http.StatusNotFound, ErrMsg(http.StatusText(http.StatusNotFound)))
+	}
+	if !g.Usable(time.Now()) {
+		return c.JSON(http.StatusGone, ErrMsg("Url expired or revoked"))
+	}
+	r := c.Request()
+	if !methodAllowed(g.Method, r.Method) {
+		return c.JSON(http.StatusMethodNotAllowed, ErrMsg("Method not allowed for this url"))
+	}
+
+	m := &UrlRequest{
+		Host:      s.objectHost(g.Account),
+		Account:   g.Account,
+		Container: g.Container,
+		Object:    g.Object,
+		Method:    r.Method,
+	}
+	m.Key, _, err = s.keyForRequest(m, g.RequestorId)
+	if nil != err {
+		requestLog(c).Error("proxy", "grant", g.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble checking authorization"))
+	}
+	if "" == m.Key {
+		return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this resource"))
+	}
+
+	in := &countingReader{r: r.Body}
+	req, err := http.NewRequest(r.Method, m.SignedUrlUntil(time.Now().Unix()+PROXY_SIGN_DURATION), in)
+	if nil != err {
+		return c.JSON(http.StatusInternalServerError, ErrMsg(err.Error()))
+	}
+	req.ContentLength = r.ContentLength
+	for _, h := range proxyRequestHeaders {
+		if v := r.Header.Get(h); "" != v {
+			req.Header.Set(h, v)
+		}
+	}
+	client := s.Proxy_client
+	if nil == client {
+		client = defaultProxyClient
+	}
+	resp, err := client.Do(req)
+	if nil != err {
+		requestLog(c).Error("proxy", "grant", g.Id, "error", err)
+		return c.JSON(http.StatusBadGateway, ErrMsg("Trouble reaching object store"))
+	}
+	defer resp.Body.Close()
+
+	for h, values := range resp.Header {
+		if !hopHeaders[h] {
+			c.Response().Header()[h] = values
+		}
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+	out, err := io.Copy(c.Response(), resp.Body)
+	if nil != err {
+		requestLog(c).Error("proxy streaming", "grant", g.Id, "error", err)
+	}
+	if err := s.Grants.AddGrantBytes(g.Id, in.n, out); nil != err {
+		requestLog(c).Error("proxy counting bytes", "grant", g.Id, "error", err)
+	}
+	return nil
+}
+
+// Grants requested by, or for the account of, the requestor
+func (s *Server) listGrants(c *echo.Context) error {
+	if !s.proxying() {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Proxy mode not enabled"))
+	}
+	viewer, ok := c.Get(API_KEY).(string)
+	if !ok {
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Failed getting requesting id"))
+	}
+	limit := 0
+	if raw := c.Query("limit"); "" != raw {
+		n, err := strconv.Atoi(raw)
+		if nil != err || n < 0 {
+			return c.JSON(http.StatusBadRequest, ErrMsg("Invalid limit"))
+		}
+		limit = n
+	}
+	grants, err := s.Grants.GrantsFor(viewer, GrantsLimit(limit))
+	if nil != err {
+		requestLog(c).Error("listGrants", "viewer", viewer, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble reading grants"))
+	}
+	if nil == grants {
+		grants = []*Grant{}
+	}
+	return c.JSON(http.StatusOK, grants)
+}
+
+// Revoke a grant, by either its requestor or the owner of its account
+func (s *Server) revokeGrant(c *echo.Context) error {
+	if !s.proxying() {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Proxy mode not enabled"))
+	}
+	g, err := s.Grants.Grant(c.Param("id"))
+	if nil != err {
+		requestLog(c).Error("revokeGrant", "grant", c.Param("id"), "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble checking grant"))
+	}
+	if nil == g {
+		return c.JSON(http.StatusNotFound, ErrMsg(http.StatusText(http.StatusNotFound)))
+	}
+	viewer := c.Get(API_KEY)
+	if viewer != g.RequestorId && viewer != g.AccountId {
+		return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this grant"))
+	}
+	if err := s.Grants.RevokeGrant(g.Id); nil != err {
+		requestLog(c).Error("revokeGrant", "grant", g.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble revoking grant"))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Token bucket rate limiting of authenticated requests per api key, and of
+// failed authentication per client address
+package atm
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	RATE_LIMIT_HEADER     = "RateLimit-Limit"
+	RATE_REMAINING_HEADER = "RateLimit-Remaining"
+	RATE_RESET_HEADER     = "RateLimit-Reset"
+
+	// How long a requestor's override is used before looking it up again
+	RATE_OVERRIDE_TTL = time.Minute
+	// How often idle buckets are dropped
+	rateLimitPrune = time.Minute
+)
+
+// Requests refilled per minute, up to Burst at once. A PerMinute of 0 is
+// no limit at all
+type RateLimit struct {
+	RequestorId string `json:"requestor_id,omitempty" yaml:"requestor_id"`
+	PerMinute   int    `json:"per_minute" yaml:"per_minute"`
+	Burst       int    `json:"burst" yaml:"burst"`
+}
+
+func (r RateLimit) Unlimited() bool {
+	return r.PerMinute <= 0
+}
+
+func (r RateLimit) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
+
+type RateLimitStore interface {
+	// nil when the requestor has no override
+	RateLimitFor(requestorId string) (*RateLimit, error)
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+	// when limit was looked up, zero if it is not an override
+	checked time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: limit.burst(), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	perSecond := float64(b.limit.PerMinute) / 60
+	b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+}
+
+// Time until n tokens are in the bucket
+func (b *bucket) until(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	perSecond := float64(b.limit.PerMinute) / 60
+	return time.Duration((n - b.tokens) / perSecond * float64(time.Second))
+}
+
+type rateResult struct {
+	allowed   bool
+	unlimited bool
+	limit     int
+	remaining int
+	// until the bucket is full again
+	reset time.Duration
+	// until the next request is allowed
+	retry time.Duration
+}
+
+type RateLimiter struct {
+	Default RateLimit
+	// For each client address, taken from by every failed authentication
+	Failures  RateLimit
+	Overrides RateLimitStore
+	lock      sync.Mutex
+	keys      map[string]*bucket
+	addrs     map[string]*bucket
+	pruned    time.Time
+}
+
+func NewRateLimiter(def, failures RateLimit, overrides RateLimitStore) *RateLimiter {
+	return &RateLimiter{
+		Default:   def,
+		Failures:  failures,
+		Overrides: overrides,
+		keys:      make(map[string]*bucket),
+		addrs:     make(map[string]*bucket),
+		pruned:    time.Now(),
+	}
+}
+
+// The limit for requestorId, its override if it has one
+func (l *RateLimiter) limitFor(requestorId string) RateLimit {
+	if nil == l.Overrides {
+		return l.Default
+	}
+	override, err := l.Overrides.RateLimitFor(requestorId)
+	if nil != err {
+		log.Printf("rateLimit: %s. Error: %s", requestorId, err.Error())
+		return l.Default
+	}
+	if nil == override {
+		return l.Default
+	}
+	return *override
+}
+
+// Take a request from the bucket of requestorId
+func (l *RateLimiter) allow(requestorId string) rateResult {
+	now := time.Now()
+	l.lock.Lock()
+	b, found := l.keys[requestorId]
+	stale := !found || now.Sub(b.checked) > RATE_OVERRIDE_TTL
+	l.lock.Unlock()
+
+	var limit RateLimit
+	if stale {
+		limit = l.limitFor(requestorId)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+	if b, found = l.keys[requestorId]; !found {
+		b = newBucket(l.Default, now)
+		l.keys[requestorId] = b
+	}
+	if stale {
+		b.refill(now)
+		b.limit, b.checked = limit, now
+		b.tokens = math.Min(b.tokens, limit.burst())
+	}
+	if b.limit.Unlimited() {
+		return rateResult{allowed: true, unlimited: true}
+	}
+	b.refill(now)
+	r := rateResult{limit: int(b.limit.burst())}
+	if b.tokens >= 1 {
+		b.tokens--
+		r.allowed = true
+	}
+	r.remaining = int(math.Floor(b.tokens))
+	r.reset = b.until(b.limit.burst())
+	r.retry = b.until(1)
+	return r
+}
+
+// How long until addr may try again, 0 if it has not run out of failures
+func (l *RateLimiter) blocked(addr string) time.Duration {
+	if l.Failures.Unlimited() {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, found := l.addrs[addr]
+	if !found {
+		return 0
+	}
+	b.refill(time.Now())
+	return b.until(1)
+}
+
+func (l *RateLimiter) failed(addr string) {
+	if l.Failures.Unlimited() {
+		return
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, found := l.addrs[addr]
+	if !found {
+		b = newBucket(l.Failures, now)
+		l.addrs[addr] = b
+	}
+	b.refill(now)
+	b.tokens = math.Max(0, b.tokens-1)
+}
+
+// Drop buckets that have refilled, they are no different from new ones
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < rateLimitPrune {
+		return
+	}
+	l.pruned = now
+	for _, buckets := range []map[string]*bucket{l.keys, l.addrs} {
+		for k, b := range buckets {
+			b.refill(now)
+			if b.limit.Unlimited() || b.tokens >= b.limit.burst() {
+				delete(buckets, k)
+			}
+		}
+	}
+}
+
+func tooManyRequests(c *echo.Context, retry time.Duration) error {
+	c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(retry.Seconds()))))
+	return c.JSON(http.StatusTooManyRequests, ErrMsg("Too many requests"))
+}
+
+// Wrap the auth middleware so authenticated requests are limited per api
+// key, and client addresses failing authentication are turned away once
+// they run out of failures
+func RateLimited(l *RateLimiter, auth echo.HandlerFunc) echo.MiddlewareFunc {
+	return func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			addr := clientIP(c)
+			if retry := l.blocked(addr); retry > 0 {
+				return tooManyRequests(c, retry)
+			}
+			if err := auth(c); nil != err {
+				// only the client's failures, not the server's trouble
+				// looking up keys
+				if he, ok := err.(*echo.HTTPError); ok && he.Code() < http.StatusInternalServerError {
+					l.failed(addr)
+				}
+				return err
+			}
+			requestorId, _ := c.Get(API_KEY).(string)
+			r := l.allow(requestorId)
+			if !r.unlimited {
+				header := c.Response().Header()
+				header.Set(RATE_LIMIT_HEADER, fmt.Sprintf("%d", r.limit))
+				header.Set(RATE_REMAINING_HEADER, fmt.Sprintf("%d", r.remaining))
+				header.Set(RATE_RESET_HEADER, fmt.Sprintf("%d", int64(math.Ceil(r.reset.Seconds()))))
+			}
+			if !r.allowed {
+				return tooManyRequests(c, r.retry)
+			}
+			return h(c)
+		}
+	}
+}
+
+func (m *MemoryDatastore) RateLimitFor(requestorId string) (*RateLimit, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if r, found := m.rateLimits[requestorId]; found {
+		copy := *r
+		return &copy, nil
+	}
+	return nil, nil
+}
+
+// Override the limit of r.RequestorId
+func (m *MemoryDatastore) SetRateLimit(r RateLimit) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rateLimits[r.RequestorId] = &r
+}
+
+func (d *Datastore) RateLimitFor(requestorId string) (*RateLimit, error) {
+	r := &RateLimit{RequestorId: requestorId}
+	err := d.pool.QueryRow(d.rebind("SELECT per_minute, burst FROM rate_limits WHERE requestor_id = ?"),
+		requestorId).Scan(&r.PerMinute, &r.Burst)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Override the limit of r.RequestorId
+func (d *Datastore) SetRateLimit(r RateLimit) error {
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(d.rebind("DELETE FROM rate_limits WHERE requestor_id = ?"), r.RequestorId); nil != err {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO rate_limits (requestor_id, per_minute, burst) VALUES (?, ?, ?)"),
+		r.RequestorId, r.PerMinute, r.Burst)
+	if nil != err {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Go back to the default limit for requestorId
+func (d *Datastore) RemoveRateLimit(requestorId string) error {
+	_, err := d.pool.Exec(d.rebind("DELETE FROM rate_limits WHERE requestor_id = ?"), requestorId)
+	return err
+}
+
+func (d *Datastore) RateLimits() ([]*RateLimit, error) {
+	rows, err := d.pool.Query("SELECT requestor_id, per_minute, burst FROM rate_limits ORDER BY requestor_id")
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*RateLimit
+	for rows.Next() {
+		r := &RateLimit{}
+		if err := rows.Scan(&r.RequestorId, &r.PerMinute, &r.Burst); nil != err {
+			return nil, err
+		}
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
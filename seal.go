@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Sealed mode, where the master key encrypting persisted signing keys is
+// never stored but split into shares that operators submit after startup
+package atm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Sealed by the master key so a combination of shares can be verified
+const sealCheck = "atm-seal-check"
+
+type SealConfig struct {
+	KekId     string
+	Shares    int
+	Threshold int
+	Check     string
+	// A check value of each share, so a bad share is refused when submitted
+	// rather than spoiling the combination. Empty for older seals
+	ShareChecks []string
+}
+
+func shareCheck(share []byte) string {
+	h := sha256.Sum256(append([]byte(sealCheck), share...))
+	return hex.EncodeToString(h[:])
+}
+
+// Whether share is one of those the master key was split into, always true
+// for seals without share checks
+func (c *SealConfig) validShare(share []byte) bool {
+	if 0 == len(c.ShareChecks) {
+		return true
+	}
+	check := []byte(shareCheck(share))
+	for _, known := range c.ShareChecks {
+		if 1 == subtle.ConstantTimeCompare(check, []byte(known)) {
+			return true
+		}
+	}
+	return false
+}
+
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Progress  int  `json:"progress"`
+}
+
+// Generate a new master key split into shares, any threshold of which will
+// unseal, along with the config to verify them. The key itself is discarded
+func NewSealedMasterKey(id string, shares, threshold int) (*SealConfig, []string, error) {
+	k, err := NewKek(id)
+	if nil != err {
+		return nil, nil, err
+	}
+	parts, err := SplitSecret(k.key, shares, threshold)
+	if nil != err {
+		return nil, nil, err
+	}
+	check, err := NewKeyRing(k).Seal([]byte(sealCheck), sealCheck)
+	if nil != err {
+		return nil, nil, err
+	}
+	text := make([]string, len(parts))
+	checks := make([]string, len(parts))
+	for i, p := range parts {
+		text[i] = base64.StdEncoding.EncodeToString(p)
+		checks[i] = shareCheck(p)
+	}
+	c := &SealConfig{KekId: id, Shares: shares, Threshold: threshold, Check: check, ShareChecks: checks}
+	return c, text, nil
+}
+
+// Save the seal config, refusing to replace an existing one unless replace
+// is set, as that orphans every signing key sealed with the old master key
+func (d *Datastore) SaveSealConfig(c *SealConfig, replace bool) error {
+	existing, err := d.SealConfig()
+	if nil != err {
+		return err
+	}
+	if nil != existing && !replace {
+		return errors.New("Seal already initialized")
+	}
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM seal_config"); nil != err {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO seal_config (id, kek_id, shares, threshold, check_value, share_checks) VALUES (1, ?, ?, ?, ?, ?)"),
+		c.KekId, c.Shares, c.Threshold, c.Check, strings.Join(c.ShareChecks, ","))
+	if nil != err {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The saved seal config, nil if sealed mode was never initialized
+func (d *Datastore) SealConfig() (*SealConfig, error) {
+	c := &SealConfig{}
+	var checks sql.NullString
+	err := d.pool.QueryRow("SELECT kek_id, shares, threshold, check_value, share_checks FROM seal_config WHERE id = 1").
+		Scan(&c.KekId, &c.Shares, &c.Threshold, &c.Check, &checks)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	if "" != checks.String {
+		c.ShareChecks = strings.Split(checks.String, ",")
+	}
+	return c, nil
+}
+
+// Collects unseal shares, one per operator, until the threshold is reached,
+// then hands the recreated master key to onUnseal
+type SealState struct {
+	lock     sync.Mutex
+	config   *SealConfig
+	shares   map[string][]byte
+	unsealed bool
+	onUnseal func(*KeyRing) error
+}
+
+func NewSealState(c *SealConfig, onUnseal func(*KeyRing) error) *SealState {
+	return &SealState{config: c, shares: make(map[string][]byte), onUnseal: onUnseal}
+}
+
+func (s *SealState) Sealed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.unsealed
+}
+
+func (s *SealState) Status() SealStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status()
+}
+
+func (s *SealState) status() SealStatus {
+	return SealStatus{Sealed: !s.unsealed, Threshold: s.config.Threshold, Progress: len(s.shares)}
+}
+
+// Add the base64 share of operator, replacing any they sent before. Shares
+// are checked as they arrive when the seal has share checks. Otherwise a bad
+// combination only discards the share completing it, so one bad share does
+// not undo everyone else's
+func (s *SealState) Unseal(operator, share string) (SealStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.unsealed {
+		return s.status(), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(share)
+	if nil != err || KEK_SIZE+1 != len(b) {
+		return s.status(), errors.New("Invalid share")
+	}
+	if !s.config.validShare(b) {
+		return s.status(), errors.New("Share is not part of this seal")
+	}
+	for submitter, existing := range s.shares {
+		if submitter != operator && bytes.Equal(existing, b) {
+			return s.status(), errors.New("Share already submitted")
+		}
+	}
+	s.shares[operator] = b
+	if len(s.shares) < s.config.Threshold {
+		return s.status(), nil
+	}
+
+	shares := make([][]byte, 0, len(s.shares))
+	for _, b := range s.shares {
+		shares = append(shares, b)
+	}
+	key, err := CombineShares(shares)
+	if nil == err {
+		ring := NewKeyRing(&Kek{Id: s.config.KekId, key: key})
+		if check, err := ring.Open(s.config.Check, sealCheck); nil == err && sealCheck == string(check) {
+			if err := s.onUnseal(ring); nil != err {
+				return s.status(), errors.New(fmt.Sprintf("Unable to unseal: %s", err.Error()))
+			}
+			s.unsealed = true
+			s.shares = make(map[string][]byte)
+			return s.status(), nil
+		}
+	}
+	delete(s.shares, operator)
+	return s.status(), errors.New("Shares did not recreate the master key, your share was discarded")
+}
@@ -0,0 +1,104 @@
+package atm
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSealState(t *testing.T) {
+	config, shares, err := NewSealedMasterKey("sealed", 3, 2)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var unsealedWith *KeyRing
+	s := NewSealState(config, func(r *KeyRing) error {
+		unsealedWith = r
+		return nil
+	})
+	if !s.Sealed() {
+		t.Fatal("Expected to start sealed")
+	}
+	if _, err := s.Unseal("alice", "not a share"); nil == err {
+		t.Error("Expected an invalid share to be rejected")
+	}
+
+	// a share from some other master key is refused without losing progress
+	_, others, _ := NewSealedMasterKey("other", 3, 2)
+	if status, err := s.Unseal("alice", shares[0]); nil != err || 1 != status.Progress {
+		t.Fatal("Unexpected status after one share", status, err)
+	}
+	if _, err := s.Unseal("mallory", others[1]); nil == err || !s.Sealed() {
+		t.Error("Expected a share of another seal to be refused")
+	}
+	if 1 != s.Status().Progress {
+		t.Error("Expected the valid share kept", s.Status())
+	}
+	if _, err := s.Unseal("bob", shares[0]); nil == err {
+		t.Error("Expected a share already submitted by another operator to be rejected")
+	}
+	status, err := s.Unseal("bob", shares[2])
+	if nil != err || status.Sealed || s.Sealed() {
+		t.Fatal("Expected to be unsealed", status, err)
+	}
+	if nil == unsealedWith || "sealed" != unsealedWith.CurrentId() {
+		t.Error("Unseal callback not given the master key")
+	}
+}
+
+func TestSealStateWithoutShareChecks(t *testing.T) {
+	config, shares, _ := NewSealedMasterKey("sealed", 3, 2)
+	config.ShareChecks = nil
+	s := NewSealState(config, func(r *KeyRing) error { return nil })
+
+	_, others, _ := NewSealedMasterKey("other", 3, 2)
+	s.Unseal("alice", shares[0])
+	if _, err := s.Unseal("mallory", others[1]); nil == err || !s.Sealed() {
+		t.Error("Expected mismatched shares to fail")
+	}
+	if 1 != s.Status().Progress {
+		t.Error("Expected only the bad share discarded", s.Status())
+	}
+	if status, err := s.Unseal("bob", shares[1]); nil != err || status.Sealed {
+		t.Error("Expected to unseal with the earlier share kept", status, err)
+	}
+}
+
+func TestServerSealed(t *testing.T) {
+	config, shares, _ := NewSealedMasterKey("sealed", 2, 2)
+	s, c := newTestServer(t)
+	s.Seal = NewSealState(config, func(r *KeyRing) error { return nil })
+	s.Unseal_keys = []string{"backup-key"}
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Error("Expected url requests to fail while sealed")
+	}
+	s.Swift = NewSwiftKeyFetcher(s.Ds, 0)
+	owner := &AtmClient{ApiKey: "owner-key", ApiSecret: "owner-secret", AtmHost: c.AtmHost}
+	if resp, _, err := owner.signedRequest("DELETE", "/v1/keys/owner/swift", nil); nil != err ||
+		http.StatusServiceUnavailable != resp.StatusCode {
+		t.Error("Expected swift credentials left alone while sealed", resp, err)
+	}
+	s.Swift.Close()
+	s.Swift = nil
+	operators := []*AtmClient{c, &AtmClient{ApiKey: "owner-key", ApiSecret: "owner-secret", AtmHost: c.AtmHost}}
+	if _, err := operators[1].Unseal(shares[1]); nil == err {
+		t.Error("Expected a key that is not an unseal operator to be refused")
+	}
+	if status, _ := c.SealStatus(); 0 != status.Progress {
+		t.Error("Expected no progress from a refused share", status)
+	}
+	s.Unseal_keys = append(s.Unseal_keys, "owner-key")
+	for i, share := range shares {
+		if _, err := operators[i].Unseal(share); nil != err {
+			t.Fatal("Unable to unseal", err)
+		}
+	}
+	status, err := c.SealStatus()
+	if nil != err || status.Sealed {
+		t.Error("Expected to be unsealed", status, err)
+	}
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil != err {
+		t.Error("Unexpected error after unsealing", err)
+	}
+}
@@ -1,13 +1,18 @@
 package atm
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo"
 	mw "github.com/labstack/echo/middleware"
+	_ "github.com/lib/pq"
 )
 
 const (
@@ -16,100 +21,736 @@ const (
 )
 
 type Server struct {
-	Ds               *Datastore
+	Ds               Store
 	Object_host      string
 	Default_duration int64
 	Nonces           NonceChecker
+	Seal             *SealState
+	Swift            *SwiftKeyFetcher
+	// Seconds before a key replacing an active one is used for signing
+	Key_activation_delay int64
+	// For opening signing keys sealed by clients
+	Box *BoxKey
+	// Refuse signing keys sent in the clear
+	Require_sealed_keys bool
+	Audit               AuditLog
+	// Public base url of this service. When set, with Grants, urls issued are
+	// opaque ones proxied through atm rather than swift tempurls
+	Proxy_url string
+	Grants    GrantStore
+	// For proxied requests to swift, one with connect & response header
+	// timeouts if nil
+	Proxy_client *http.Client
+	Webhooks     *WebhookSender
+	// Limits authenticated requests, none when nil
+	Limiter *RateLimiter
+	// Proxies whose X-Forwarded-For is believed for the client address
+	Trusted_proxies TrustedProxies
+	// Served at /metrics when set, on Metrics_listen if given rather than
+	// alongside the service
+	Metrics        *Metrics
+	Metrics_listen string
+	// Accounts that must have a signing key for /readyz to report ready
+	Required_accounts []string
+	// Request log lines go here, the default logger when nil
+	Logger *slog.Logger
+	// Addresses to serve on, DEFAULT_LISTEN when empty
+	Listen []string
+	// Longest url lifetime in seconds, 0 for no limit
+	Max_duration int64
+	// Swift hosts of particular accounts, by name, rather than Object_host
+	Object_hosts map[string]string
+	// How far request timestamps may be from now, HMAC_EXPIRATION when 0
+	Hmac_expiration time.Duration
+	// Api keys of the operators allowed to submit unseal shares
+	Unseal_keys []string
+	lock        sync.Mutex
+	servers     []*http.Server
+	stopped     bool
+	// closed once Shutdown is done waiting on requests
+	drained   chan struct{}
+	drainOnce sync.Once
 }
 
-func (a *Server) Run() {
+func (a *Server) logger() *slog.Logger {
+	if nil == a.Logger {
+		return slog.Default()
+	}
+	return a.Logger
+}
+
+// Serve on every listen address, until one fails or Shutdown is called
+func (a *Server) Run() error {
+	e := a.Handler()
+	listen := a.Listen
+	if 0 == len(listen) {
+		listen = []string{DEFAULT_LISTEN}
+	}
+	var servers []*http.Server
+	for _, addr := range listen {
+		servers = append(servers, &http.Server{Addr: addr, Handler: e})
+	}
+	if nil != a.Metrics && "" != a.Metrics_listen {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", a.Metrics.Handler())
+		servers = append(servers, &http.Server{Addr: a.Metrics_listen, Handler: mux})
+	}
+	a.lock.Lock()
+	if a.stopped {
+		a.lock.Unlock()
+		return nil
+	}
+	a.servers = servers
+	a.lock.Unlock()
+
+	failed := make(chan error, len(servers))
+	for _, srv := range servers {
+		a.logger().Info("listening", "addr", srv.Addr)
+		go func(srv *http.Server) {
+			failed <- srv.ListenAndServe()
+		}(srv)
+	}
+	if err := <-failed; http.ErrServerClosed != err {
+		a.Shutdown(context.Background())
+		return err
+	}
+	// ListenAndServe returns as Shutdown starts, the requests it waits on
+	// still need whatever the caller closes once Run returns
+	<-a.drainedChan()
+	return nil
+}
+
+// Stop listening & wait for requests in progress, until ctx is done
+func (a *Server) Shutdown(ctx context.Context) error {
+	a.lock.Lock()
+	a.stopped = true
+	servers := a.servers
+	a.lock.Unlock()
+	var err error
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(ctx); nil == err {
+			err = shutdownErr
+		}
+	}
+	drained := a.drainedChan()
+	a.drainOnce.Do(func() { close(drained) })
+	return err
+}
+
+func (a *Server) drainedChan() chan struct{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if nil == a.drained {
+		a.drained = make(chan struct{})
+	}
+	return a.drained
+}
+
+func (s *Server) objectHost(account string) string {
+	if host, found := s.Object_hosts[account]; found {
+		return host
+	}
+	return s.Object_host
+}
+
+// The routes & middleware of the service
+func (a *Server) Handler() *echo.Echo {
 	e := echo.New()
 
 	// Middleware
-	e.Use(mw.Logger())
+	e.Use(RequestLogger(a.logger()))
 	e.Use(mw.Recover())
-	auth_opts := NewHmacOpts(a.Ds.ApiKeySecret, a.Nonces)
-	e.Use(HMACAuth(auth_opts))
+	e.Use(ClientAddress(a.Trusted_proxies))
+	e.Get("/healthz", a.healthz)
+	e.Get("/readyz", a.readyz)
+	// opaque urls carry their own authorization
+	e.Get(GRANT_PATH+":token", a.proxy)
+	e.Head(GRANT_PATH+":token", a.proxy)
+	e.Put(GRANT_PATH+":token", a.proxy)
 
+	auth_opts := NewHmacOpts(a.Ds.ApiKeySecret, a.Nonces)
+	auth_opts.NetworksFor = a.Ds.AllowedNetworks
+	if a.Hmac_expiration > 0 {
+		auth_opts.Expiration = a.Hmac_expiration
+	}
+	if nil != a.Metrics {
+		auth_opts.OnFailure = a.Metrics.authFailed
+		if "" == a.Metrics_listen {
+			metrics := a.Metrics.Handler()
+			e.Get("/metrics", func(c *echo.Context) error {
+				metrics.ServeHTTP(c.Response(), c.Request())
+				return nil
+			})
+		}
+	}
 	v1 := e.Group("/v1")
+	if nil != a.Limiter {
+		v1.Use(RateLimited(a.Limiter, HMACAuth(auth_opts)))
+	} else {
+		v1.Use(HMACAuth(auth_opts))
+	}
 	v1.Post("/urls", a.createUrl)
+	// outside /keys/:name, where it would shadow an account of that name
+	v1.Get("/server-pubkey", a.serverPublicKey)
+	v1.Get("/keys/:name", a.keyStatus)
 	v1.Put("/keys/:name", a.setKey)
 	v1.Delete("/keys/:name", a.removeKey)
+	v1.Put("/keys/:name/swift", a.setSwiftCredentials)
+	v1.Delete("/keys/:name/swift", a.removeSwiftCredentials)
+	v1.Get("/audit", a.auditLog)
+	v1.Get("/webhooks/:name", a.listWebhooks)
+	v1.Post("/webhooks/:name", a.addWebhook)
+	v1.Get("/webhooks/:name/dead-letters", a.deadLetters)
+	v1.Delete("/webhooks/:name/:id", a.removeWebhook)
+	v1.Get("/grants", a.listGrants)
+	v1.Delete("/grants/:id", a.revokeGrant)
+	v1.Get("/seal", a.sealStatus)
+	v1.Post("/unseal", a.unseal)
+
+	return e
+}
+
+// In sealed mode until enough unseal shares are submitted
+func (s *Server) sealed() bool {
+	return nil != s.Seal && s.Seal.Sealed()
+}
+
+func sealedError(c *echo.Context) error {
+	return c.JSON(http.StatusServiceUnavailable, ErrMsg("Service is sealed"))
+}
 
-	e.Run(":8080")
+func (s *Server) sealStatus(c *echo.Context) error {
+	if nil == s.Seal {
+		return c.JSON(http.StatusOK, SealStatus{})
+	}
+	return c.JSON(http.StatusOK, s.Seal.Status())
+}
+
+type unsealRequest struct {
+	Share string `json:"share"`
+}
+
+func (s *Server) unsealOperator(apiKey string) bool {
+	for _, k := range s.Unseal_keys {
+		if "" != apiKey && k == apiKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) unseal(c *echo.Context) error {
+	if nil == s.Seal {
+		return c.JSON(http.StatusBadRequest, ErrMsg("Not running in sealed mode"))
+	}
+	operator, _ := c.Get(API_KEY).(string)
+	if !s.unsealOperator(operator) {
+		return c.JSON(http.StatusForbidden, ErrMsg("Not an unseal operator"))
+	}
+	u := &unsealRequest{}
+	if err := c.Bind(u); nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	status, err := s.Seal.Unseal(operator, u.Share)
+	if nil != err {
+		requestLog(c).Error("unseal", "error", err)
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	return c.JSON(http.StatusOK, status)
 }
 
 type keyRequest struct {
-	Key string `json:key`
+	Key        string `json:key`
+	ActivateAt int64  `json:"activate_at,omitempty"`
+	// Seconds after activation the key is dropped, 0 to keep it
+	Ttl int64 `json:"ttl,omitempty"`
+	// Instead of Key, sealed to the server public key with the account name
+	SealedKey string `json:"sealed_key,omitempty"`
+}
+
+func (s *Server) serverPublicKey(c *echo.Context) error {
+	if nil == s.Box {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Sealed keys not enabled"))
+	}
+	return c.JSON(http.StatusOK, s.Box.PublicKey())
+}
+
+// The plaintext signing key of k, opening it if sealed
+func (s *Server) requestedKey(k *keyRequest, account string) (string, error) {
+	if "" == k.SealedKey {
+		if s.Require_sealed_keys {
+			return "", errors.New("Signing key must be sealed to the server public key")
+		}
+		return k.Key, nil
+	}
+	if "" != k.Key {
+		return "", errors.New("Only one of key and sealed_key may be given")
+	}
+	if nil == s.Box {
+		return "", errors.New("Sealed keys not enabled")
+	}
+	key, err := s.Box.Open(k.SealedKey, account)
+	if nil != err {
+		return "", err
+	}
+	return string(key), nil
 }
 
 func (s *Server) removeKey(c *echo.Context) error {
-	a, err := s.Ds.Account(c.Param("name"))
-	if nil != err || a.Id == "" {
-		return c.JSON(http.StatusGone, ErrMsg(http.StatusText(http.StatusNotFound)))
+	if s.sealed() {
+		return sealedError(c)
 	}
-	if c.Get(API_KEY) != a.Id {
-		return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this account"))
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
 	}
-	s.Ds.RemoveSigningKeyForAccount(a.Id)
+	if err := s.Ds.RemoveSigningKeyForAccount(a.Id); nil != err {
+		requestLog(c).Error("removeKey", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble removing key"))
+	}
+	s.notifyKey(c, WEBHOOK_KEY_REMOVED, a, nil)
 	return c.JSON(http.StatusNoContent, a)
 }
 
+func (s *Server) keyStatus(c *echo.Context) error {
+	if s.sealed() {
+		return sealedError(c)
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	return c.JSON(http.StatusOK, NewKeyStatus(a.Name, s.Ds.SigningKeysForAccount(a.Id)))
+}
+
 func (s *Server) setKey(c *echo.Context) error {
+	if s.sealed() {
+		return sealedError(c)
+	}
 	k := &keyRequest{}
 	if err := c.Bind(k); nil != err {
 		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
 	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	plain, err := s.requestedKey(k, c.Param("name"))
+	if nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	if "" == plain {
+		return c.JSON(http.StatusBadRequest, ErrMsg("Missing key"))
+	}
+	if k.Ttl < 0 {
+		return c.JSON(http.StatusBadRequest, ErrMsg("Invalid ttl"))
+	}
+	key := NewSigningKey(plain)
+	key.SetBy = a.Id
+	if k.ActivateAt > 0 {
+		key.ActiveAt = time.Unix(k.ActivateAt, 0).UTC()
+	} else if nil != s.Ds.SigningKeysForAccount(a.Id).Current(key.ActiveAt) {
+		// rotating, give swift time to have the new key too
+		key.ActiveAt = key.ActiveAt.Add(time.Duration(s.Key_activation_delay) * time.Second)
+	}
+	if k.Ttl > 0 {
+		expires := key.ActiveAt.Add(time.Duration(k.Ttl) * time.Second)
+		key.ExpiresAt = &expires
+	}
+	if err := s.Ds.StageSigningKeyForAccount(a.Id, key); nil != err {
+		requestLog(c).Error("setKey", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble saving key"))
+	}
+	s.Metrics.keyFound(a.Name)
+	s.notifyKey(c, WEBHOOK_KEY_SET, a, key)
+	return c.JSON(http.StatusOK, a)
+}
+
+// The account named in the path when the requestor owns it, otherwise a nil
+// account along with the reply already sent
+func (s *Server) ownedAccount(c *echo.Context) (*Account, error) {
 	a, err := s.Ds.Account(c.Param("name"))
 	if nil != err || a.Id == "" {
-		return c.JSON(http.StatusGone, ErrMsg(http.StatusText(http.StatusNotFound)))
+		return nil, c.JSON(http.StatusGone, ErrMsg(http.StatusText(http.StatusNotFound)))
 	}
 	if c.Get(API_KEY) != a.Id {
-		return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this account"))
+		return nil, c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this account"))
+	}
+	return a, nil
+}
+
+func (s *Server) setSwiftCredentials(c *echo.Context) error {
+	if s.sealed() {
+		return sealedError(c)
+	}
+	if nil == s.Swift {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Swift key retrieval not enabled"))
+	}
+	creds := &SwiftCredentials{}
+	if err := c.Bind(creds); nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	if err := s.Swift.Register(a.Id, creds); nil != err {
+		requestLog(c).Error("setSwiftCredentials", "account", a.Id, "error", err)
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
 	}
-	s.Ds.AddSigningKeyForAccount(k.Key, a.Id)
 	return c.JSON(http.StatusOK, a)
 }
 
+// Forget the account's swift credentials. The key already fetched with them
+// stays loaded & signing until replaced or removed
+func (s *Server) removeSwiftCredentials(c *echo.Context) error {
+	if s.sealed() {
+		return sealedError(c)
+	}
+	if nil == s.Swift {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Swift key retrieval not enabled"))
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	if err := s.Swift.Unregister(a.Id); nil != err {
+		requestLog(c).Error("removeSwiftCredentials", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Unable to remove swift credentials"))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Look up the signing key, fetching it from swift when the account has
+// registered credentials but no key is loaded yet
+func (s *Server) keyForRequest(u *UrlRequest, requestorId string) (string, int64, error) {
+	key, duration, err := s.Ds.KeyForRequest(u, requestorId)
+	if notSet, ok := err.(KeyNotSetError); ok && nil != s.Swift && s.Swift.Registered(notSet.AccountId) {
+		if _, err := s.Swift.Refresh(notSet.AccountId); nil != err {
+			return "", 0, err
+		}
+		return s.Ds.KeyForRequest(u, requestorId)
+	}
+	return key, duration, err
+}
+
 func (s *Server) createUrl(c *echo.Context) error {
-	o := &UrlRequest{Host: s.Object_host, Duration: s.Default_duration}
+	if s.sealed() {
+		return sealedError(c)
+	}
+	o := &UrlRequest{Duration: s.Default_duration}
 	if err := c.Bind(o); nil != err {
 		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
 	}
+	o.Host = s.objectHost(o.Account)
 
 	if !o.Valid() {
 		return c.JSON(http.StatusBadRequest, ErrMsg("Missing account, container, object, or method, or invalid duration"))
 	}
 
-	ruleDuration := int64(0)
-	var err error
 	requestorId, ok := c.Get(API_KEY).(string)
 	if !ok {
 		return c.JSON(http.StatusInternalServerError, ErrMsg("Failed getting requesting id"))
 	}
-	o.Key, ruleDuration, err = s.Ds.KeyForRequest(o, requestorId)
-	if nil != err {
-		log.Printf("keyForRequest: %v, %s. Error: %s", o, "", err.Error())
-		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble checking authorization"))
+
+	methods := o.RequestedMethods()
+	if s.proxying() {
+		for _, method := range methods {
+			if !proxiedMethod(method) {
+				return c.JSON(http.StatusBadRequest, ErrMsg("Only GET, HEAD or PUT urls can be proxied"))
+			}
+		}
 	}
-	if "" == o.Key {
-		return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this resource"))
+	u := &Tmpurl{
+		Path: o.Path(),
+		Urls: make(map[string]string, len(methods)),
 	}
-	//if ruleDuration > 0 && ruleDuration > o.Duration {
-	//o.Duration = ruleDuration
-	//}
-	if ruleDuration > 0 && o.Duration <= 0 {
-		o.Duration = ruleDuration
+	// every method is checked before any url is issued, so a denial leaves
+	// no grants behind for the methods allowed before it
+	allowed := make([]UrlRequest, 0, len(methods))
+	for _, method := range methods {
+		m := *o
+		m.Method = method
+		m.Methods = nil
+		ruleDuration := int64(0)
+		var err error
+		m.Key, ruleDuration, err = s.keyForRequest(&m, requestorId)
+		if notSet, ok := err.(KeyNotSetError); ok {
+			s.Metrics.keyMissing(notSet.Account)
+		}
+		if nil != err {
+			requestLog(c).Error("keyForRequest", "url_request", m, "error", err)
+			s.audit(c, &m, requestorId, AUDIT_FAILED, AUDIT_REASON_DATASTORE, 0)
+			return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble checking authorization"))
+		}
+		if "" == m.Key {
+			s.audit(c, &m, requestorId, AUDIT_DENIED, "No matching rule", 0)
+			return c.JSON(http.StatusForbidden, ErrMsg("Not authorized for this resource"))
+		}
+		//if ruleDuration > 0 && ruleDuration > m.Duration {
+		//m.Duration = ruleDuration
+		//}
+		if ruleDuration > 0 && m.Duration <= 0 {
+			m.Duration = ruleDuration
+		}
+		if m.Duration <= 0 {
+			m.Duration = s.Default_duration
+		}
+		if s.Max_duration > 0 && m.Duration > s.Max_duration {
+			m.Duration = s.Max_duration
+		}
+		allowed = append(allowed, m)
 	}
-	if o.Duration <= 0 {
-		o.Duration = s.Default_duration
+	expires := make([]int64, len(allowed))
+	for i := range allowed {
+		expires[i] = time.Now().UTC().Unix() + allowed[i].Duration
 	}
-
-	u := &Tmpurl{
-		Url:  o.SignedUrl(),
-		Path: o.Path(),
+	// every grant is stored before any is audited as issued, so a failure
+	// leaves none the client never saw
+	var granted []string
+	if s.proxying() {
+		var err error
+		if granted, err = s.grantUrls(allowed, requestorId, expires); nil != err {
+			requestLog(c).Error("grantUrls", "url_request", o, "error", err)
+			for i := range allowed {
+				s.audit(c, &allowed[i], requestorId, AUDIT_FAILED, AUDIT_REASON_DATASTORE, 0)
+			}
+			return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble recording grant"))
+		}
+	}
+	for i := range allowed {
+		m := &allowed[i]
+		if nil != granted {
+			u.Urls[m.Method] = granted[i]
+		} else {
+			u.Urls[m.Method] = m.SignedUrlUntil(expires[i])
+		}
+		s.audit(c, m, requestorId, AUDIT_ISSUED, "", expires[i])
+		s.Metrics.keyFound(m.Account)
 	}
+	u.Url = u.Urls[methods[0]]
 
 	c.Response().Header().Set("Location", u.Url)
 	return c.JSON(http.StatusCreated, u)
 }
+
+// The address of the client making the request
+func clientIP(c *echo.Context) string {
+	if addr, ok := c.Get(CLIENT_IP).(string); ok {
+		return addr
+	}
+	return TrustedProxies(nil).ClientIP(c.Request())
+}
+
+// Record the outcome of u in the audit log, if there is one, & tell the
+// account's webhooks. Failing to is logged rather than failing the request
+func (s *Server) audit(c *echo.Context, u *UrlRequest, requestorId, outcome, reason string, expires int64) {
+	accountId := ""
+	if a, err := s.Ds.Account(u.Account); nil == err {
+		accountId = a.Id
+	}
+	s.Metrics.urlOutcome(accountId, u.Account, u.Method, outcome)
+	c.Set(LOG_ACCOUNT, u.Account)
+	c.Set(LOG_DECISION, outcome)
+	if nil == s.Audit && nil == s.Webhooks {
+		return
+	}
+	e := &AuditEntry{
+		Time:        time.Now().UTC(),
+		Outcome:     outcome,
+		Reason:      reason,
+		RequestorId: requestorId,
+		Account:     u.Account,
+		Container:   u.Container,
+		Object:      u.Object,
+		Method:      u.Method,
+		RuleId:      u.RuleId,
+		ClientIp:    clientIP(c),
+	}
+	e.AccountId = accountId
+	if expires > 0 {
+		t := time.Unix(expires, 0).UTC()
+		e.ExpiresAt = &t
+	}
+	if nil != s.Audit {
+		if err := s.Audit.RecordAudit(e); nil != err {
+			requestLog(c).Error("audit", "outcome", e.Outcome, "account", e.Account, "error", err)
+		}
+	}
+	if AUDIT_FAILED != outcome && nil != s.Webhooks && "" != e.AccountId {
+		event := NewWebhookEvent(WEBHOOK_URL_ISSUED)
+		if AUDIT_DENIED == outcome {
+			event.Type = WEBHOOK_URL_DENIED
+		}
+		event.AccountId, event.Account, event.RequestorId = e.AccountId, e.Account, e.RequestorId
+		event.Container, event.Object, event.Method = e.Container, e.Object, e.Method
+		event.ExpiresAt, event.Reason, event.ClientIp = e.ExpiresAt, e.Reason, e.ClientIp
+		s.Webhooks.Notify(event)
+	}
+}
+
+type auditPage struct {
+	Entries []*AuditEntry `json:"entries"`
+	// Pass as before for the next page, 0 when there are no more
+	Next int64 `json:"next"`
+}
+
+// Entries requested by, or for the account of, the requestor
+func (s *Server) auditLog(c *echo.Context) error {
+	if nil == s.Audit {
+		return c.JSON(http.StatusNotImplemented, ErrMsg("Audit log not enabled"))
+	}
+	viewer, ok := c.Get(API_KEY).(string)
+	if !ok {
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Failed getting requesting id"))
+	}
+	f := &AuditFilter{
+		Viewer:      viewer,
+		RequestorId: c.Query("requestor_id"),
+		Account:     c.Query("account"),
+		Container:   c.Query("container"),
+		Object:      c.Query("object"),
+		Method:      c.Query("method"),
+		Outcome:     c.Query("outcome"),
+	}
+	var since, until, limit int64
+	params := map[string]*int64{"since": &since, "until": &until, "limit": &limit, "before": &f.Before}
+	for name, value := range params {
+		raw := c.Query(name)
+		if "" == raw {
+			continue
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if nil != err || n < 0 {
+			return c.JSON(http.StatusBadRequest, ErrMsg("Invalid "+name))
+		}
+		*value = n
+	}
+	if since > 0 {
+		f.Since = time.Unix(since, 0)
+	}
+	if until > 0 {
+		f.Until = time.Unix(until, 0)
+	}
+	f.Limit = int(limit)
+
+	entries, err := s.Audit.QueryAudit(f)
+	if nil != err {
+		requestLog(c).Error("auditLog", "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble reading audit log"))
+	}
+	page := &auditPage{Entries: entries}
+	if nil == page.Entries {
+		page.Entries = []*AuditEntry{}
+	}
+	if len(entries) == f.limit() {
+		page.Next = entries[len(entries)-1].Id
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func webhooksDisabled(c *echo.Context) error {
+	return c.JSON(http.StatusNotImplemented, ErrMsg("Webhooks not enabled"))
+}
+
+// The webhooks of an account, without their secrets
+func (s *Server) listWebhooks(c *echo.Context) error {
+	if nil == s.Webhooks {
+		return webhooksDisabled(c)
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	hooks, err := s.Webhooks.Store.WebhooksFor(a.Id)
+	if nil != err {
+		requestLog(c).Error("listWebhooks", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble reading webhooks"))
+	}
+	for _, h := range hooks {
+		h.Secret = ""
+	}
+	if nil == hooks {
+		hooks = []*Webhook{}
+	}
+	return c.JSON(http.StatusOK, hooks)
+}
+
+// Add a webhook to an account, replying with its secret, generated if
+// not given. It is not shown again
+func (s *Server) addWebhook(c *echo.Context) error {
+	if nil == s.Webhooks {
+		return webhooksDisabled(c)
+	}
+	h := &Webhook{}
+	if err := c.Bind(h); nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	h.Id, h.AccountId, h.CreatedAt = "", a.Id, time.Time{}
+	if err := h.Prepare(); nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	if err := s.Webhooks.Check(h); nil != err {
+		return c.JSON(http.StatusBadRequest, ErrMsg(err.Error()))
+	}
+	if err := s.Webhooks.Store.AddWebhook(h); nil != err {
+		requestLog(c).Error("addWebhook", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble saving webhook"))
+	}
+	return c.JSON(http.StatusCreated, h)
+}
+
+func (s *Server) removeWebhook(c *echo.Context) error {
+	if nil == s.Webhooks {
+		return webhooksDisabled(c)
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	if err := s.Webhooks.Store.RemoveWebhook(a.Id, c.Param("id")); nil != err {
+		requestLog(c).Error("removeWebhook", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble removing webhook"))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Deliveries to the account's webhooks given up on, newest first
+func (s *Server) deadLetters(c *echo.Context) error {
+	if nil == s.Webhooks {
+		return webhooksDisabled(c)
+	}
+	a, err := s.ownedAccount(c)
+	if nil == a {
+		return err
+	}
+	letters, err := s.Webhooks.Store.DeadLetters(a.Id)
+	if nil != err {
+		requestLog(c).Error("deadLetters", "account", a.Id, "error", err)
+		return c.JSON(http.StatusInternalServerError, ErrMsg("Trouble reading dead letters"))
+	}
+	if nil == letters {
+		letters = []*DeadLetter{}
+	}
+	return c.JSON(http.StatusOK, letters)
+}
+
+// Tell the webhooks of a that its signing key changed
+func (s *Server) notifyKey(c *echo.Context, eventType string, a *Account, key *SigningKey) {
+	if nil == s.Webhooks {
+		return
+	}
+	e := NewWebhookEvent(eventType)
+	e.AccountId, e.Account, e.ClientIp = a.Id, a.Name, clientIP(c)
+	if nil != key {
+		e.Fingerprint = key.FingerprintFor(a.Name)
+	}
+	if requestorId, ok := c.Get(API_KEY).(string); ok {
+		e.RequestorId = requestorId
+	}
+	s.Webhooks.Notify(e)
+}
@@ -0,0 +1,714 @@
+package atm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A server with a memory datastore & a client for backup-key. Each configure
+// runs before the handler is built, for settings only read at that point
+func newTestServer(t *testing.T, configure ...func(s *Server)) (*Server, *AtmClient) {
+	box, err := NewBoxKey()
+	if nil != err {
+		t.Fatal("Unable to create box key", err)
+	}
+	s := &Server{
+		Box:              box,
+		Ds:               newTestMemoryDatastore(t),
+		Object_host:      "https://swift.example.org",
+		Default_duration: 300,
+		Nonces:           NewNonceStore(),
+		Audit:            NewMemoryAuditLog(),
+	}
+	for _, f := range configure {
+		f(s)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	c := &AtmClient{
+		ApiKey:    "backup-key",
+		ApiSecret: "backup-secret",
+		AtmHost:   ts.URL,
+	}
+	return s, c
+}
+
+func TestServerCreateUrl(t *testing.T) {
+	s, c := newTestServer(t)
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Error("Expected an error without a signing key set")
+	}
+	if entries, err := s.Audit.QueryAudit(&AuditFilter{Outcome: AUDIT_FAILED}); nil != err || 1 != len(entries) ||
+		AUDIT_REASON_DATASTORE != entries[0].Reason {
+		t.Error("Expected the failure audited without the error itself", entries, err)
+	}
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+
+	url, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	if nil != err {
+		t.Fatal("Unexpected error requesting url", err)
+	}
+	if !strings.HasPrefix(url, "https://swift.example.org/v1/owner/backups/host-1/a.tgz?temp_url_sig=") {
+		t.Error("Unexpected url", url)
+	}
+
+	if _, err := c.RequestTempUrl("DELETE", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Error("Expected DELETE to be forbidden")
+	}
+
+	urls, err := c.RequestTempUrls([]string{"GET", "HEAD"}, "owner", "public", "a.txt", 60)
+	if nil != err {
+		t.Fatal("Unexpected error requesting urls", err)
+	}
+	if 2 != len(urls) || "" == urls["GET"] || "" == urls["HEAD"] || urls["GET"] == urls["HEAD"] {
+		t.Error("Expected distinct GET and HEAD urls", urls)
+	}
+}
+
+func TestServerBadSecret(t *testing.T) {
+	s, c := newTestServer(t)
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	c.ApiSecret = "wrong"
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Error("Expected a request with the wrong secret to fail")
+	}
+}
+
+func TestServerKeyStatus(t *testing.T) {
+	s, c := newTestServer(t)
+	c.ApiKey = "owner-key"
+	c.ApiSecret = "owner-secret"
+	if err := c.StageKey("owner", "swift-key", time.Time{}, time.Hour); nil != err {
+		t.Fatal("Unexpected error setting key", err)
+	}
+	stored := s.Ds.SigningKeysForAccount("owner-key").Primary
+	if nil == stored.fingerprint || "" != stored.fingerprint.value {
+		t.Error("Expected no fingerprint derived without webhooks to tell", stored)
+	}
+	status, err := c.KeyStatus("owner")
+	if nil != err {
+		t.Fatal("Unexpected error getting key status", err)
+	}
+	if KeyFingerprint("owner", "swift-key") != status.Signing || "owner-key" != status.Primary.SetBy || nil == status.Primary.ExpiresAt {
+		t.Error("Unexpected key status", status.Signing, status.Primary)
+	}
+	if KeyFingerprint("other", "swift-key") == status.Signing || status.Primary.Fingerprint != status.Signing {
+		t.Error("Expected a fingerprint salted with the account", status.Signing, status.Primary.Fingerprint)
+	}
+	if stored.fingerprint.value != status.Signing {
+		t.Error("Expected the fingerprint kept with the key once derived", stored.fingerprint.value)
+	}
+	if _, err := c.KeyStatus("backup"); nil == err {
+		t.Error("Expected the status of another account's keys to be forbidden")
+	}
+}
+
+func TestServerSetRemoveKey(t *testing.T) {
+	s, c := newTestServer(t)
+	s.Key_activation_delay = 3600
+	c.ApiKey = "owner-key"
+	c.ApiSecret = "owner-secret"
+	if err := c.SetKey("backup", "swift-key", 0); nil == err {
+		t.Error("Expected setting another account's key to be forbidden")
+	}
+	if err := c.SetKey("owner", "swift-key", 0); nil != err {
+		t.Fatal("Unexpected error setting key", err)
+	}
+	if err := c.SetKey("owner", "new-key", 0); nil != err {
+		t.Fatal("Unexpected error setting key", err)
+	}
+	if status, _ := c.KeyStatus("owner"); KeyFingerprint("owner", "new-key") != status.Signing {
+		t.Error("Expected set to sign right away despite the activation delay", status)
+	}
+	if err := c.RemoveKey("owner"); nil != err {
+		t.Error("Unexpected error removing key", err)
+	}
+	if keys := s.Ds.SigningKeysForAccount("owner-key"); nil != keys {
+		t.Error("Expected keys to be removed", keys)
+	}
+}
+
+func TestServerSealedKey(t *testing.T) {
+	s, c := newTestServer(t)
+	s.Require_sealed_keys = true
+	c.ApiKey = "owner-key"
+	c.ApiSecret = "owner-secret"
+	other, _ := NewBoxKey()
+	c.ServerPubkey = other.PublicKey().Fingerprint()
+	if err := c.SetKey("owner", "swift-key", 0); nil == err {
+		t.Error("Expected a key other than the pinned one to be refused")
+	}
+	if k := s.Ds.SigningKeysForAccount("owner-key").Current(time.Now()); nil != k {
+		t.Error("Expected no key sent to an unpinned server key", k)
+	}
+	c.ServerPubkey = s.Box.PublicKey().Fingerprint()
+	if err := c.SetKey("owner", "swift-key", 0); nil != err {
+		t.Fatal("Unexpected error setting a sealed key", err)
+	}
+	if k := s.Ds.SigningKeysForAccount("owner-key").Current(time.Now()); nil == k || "swift-key" != k.Key {
+		t.Error("Expected the sealed key to be opened", k)
+	}
+
+	resp, _, err := c.signedRequest("PUT", "/v1/keys/owner", []byte(`{"key":"plain-key"}`))
+	if nil != err || 400 != resp.StatusCode {
+		t.Error("Expected a plaintext key to be refused", err)
+	}
+	if resp, _, _ := c.signedRequest("GET", "/v1/keys/server-pubkey", nil); http.StatusOK == resp.StatusCode {
+		t.Error("Expected /v1/keys/:name left to accounts")
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	s, c := newTestServer(t)
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	c.RequestTempUrl("DELETE", "owner", "backups", "host-1/a.tgz", 60)
+
+	entries, next, err := c.Audit(&AuditFilter{})
+	if nil != err {
+		t.Fatal("Unexpected error reading audit log", err)
+	}
+	if 2 != len(entries) || 0 != next {
+		t.Fatal("Expected 2 audit entries", entries, next)
+	}
+	if AUDIT_DENIED != entries[0].Outcome || "DELETE" != entries[0].Method {
+		t.Error("Expected the denied DELETE first", entries[0])
+	}
+	issued := entries[1]
+	if AUDIT_ISSUED != issued.Outcome || "1" != issued.RuleId || "owner-key" != issued.AccountId ||
+		nil == issued.ExpiresAt || "127.0.0.1" != issued.ClientIp {
+		t.Error("Unexpected issued entry", issued)
+	}
+
+	entries, next, err = c.Audit(&AuditFilter{Outcome: AUDIT_ISSUED, Container: "backups", Limit: 1})
+	if nil != err || 1 != len(entries) || entries[0].Id != issued.Id || issued.Id != next {
+		t.Error("Expected a filtered page with the issued entry", entries, next, err)
+	}
+
+	c.ApiKey = "owner-key"
+	c.ApiSecret = "owner-secret"
+	if entries, _, _ := c.Audit(&AuditFilter{}); 2 != len(entries) {
+		t.Error("Expected the account owner to see entries for their account", entries)
+	}
+	if entries, _, _ := c.Audit(&AuditFilter{RequestorId: "owner-key"}); 0 != len(entries) {
+		t.Error("Expected no entries requested by the owner", entries)
+	}
+}
+
+func TestServerProxy(t *testing.T) {
+	var stored []byte
+	objects := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "" == r.URL.Query().Get("temp_url_sig") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			stored, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			w.Header().Set("Etag", "abc")
+			w.Write(stored)
+		}
+	}))
+	t.Cleanup(objects.Close)
+
+	s, c := newTestServer(t)
+	s.Object_host = objects.URL
+	s.Grants = NewMemoryGrantStore()
+	s.Proxy_url = c.AtmHost + "/"
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+
+	if _, err := c.RequestTempUrl("POST", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Error("Expected POST to not be proxied")
+	}
+	if _, err := c.RequestTempUrls([]string{"GET", "PUT"}, "owner", "public", "a.txt", 60); nil == err {
+		t.Error("Expected PUT on public to be denied")
+	}
+	if grants, err := c.Grants(); nil != err || 0 != len(grants) {
+		t.Error("Expected no grant left for the allowed GET", grants, err)
+	}
+	url, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	if nil != err {
+		t.Fatal("Unexpected error requesting url", err)
+	}
+	if !strings.HasPrefix(url, c.AtmHost+GRANT_PATH) || strings.Contains(url, "temp_url_sig") {
+		t.Fatal("Expected an opaque url", url)
+	}
+	req, _ := http.NewRequest("PUT", url, strings.NewReader("backup data"))
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err || http.StatusCreated != resp.StatusCode {
+		t.Fatal("Expected the PUT to be proxied", resp, err)
+	}
+	if "backup data" != string(stored) {
+		t.Error("Unexpected object stored", string(stored))
+	}
+	if resp, _ := http.Get(url); http.StatusMethodNotAllowed != resp.StatusCode {
+		t.Error("Expected a GET on a PUT url to be refused", resp.StatusCode)
+	}
+
+	grants, err := c.Grants()
+	if nil != err || 1 != len(grants) || 11 != grants[0].BytesIn || "owner-key" != grants[0].AccountId {
+		t.Fatal("Expected the grant with its bytes counted", grants, err)
+	}
+	owner := &AtmClient{ApiKey: "owner-key", ApiSecret: "owner-secret", AtmHost: c.AtmHost}
+	if err := owner.RevokeGrant(grants[0].Id); nil != err {
+		t.Fatal("Expected the owner to revoke the grant", err)
+	}
+	req, _ = http.NewRequest("PUT", url, strings.NewReader("more"))
+	if resp, _ := http.DefaultClient.Do(req); http.StatusGone != resp.StatusCode {
+		t.Error("Expected a revoked url to stop working", resp.StatusCode)
+	}
+
+	url, _ = c.RequestTempUrl("GET", "owner", "public", "a.txt", 60)
+	resp, err = http.Get(url)
+	if nil != err || http.StatusOK != resp.StatusCode || "abc" != resp.Header.Get("Etag") {
+		t.Fatal("Expected the GET to be proxied", resp, err)
+	}
+	resp.Body.Close()
+	if resp, _ := http.Head(url); http.StatusOK != resp.StatusCode {
+		t.Error("Expected HEAD on a GET url", resp.StatusCode)
+	}
+	if resp, _ := http.Get(c.AtmHost + GRANT_PATH + "nope"); http.StatusNotFound != resp.StatusCode {
+		t.Error("Expected an unknown token to be not found", resp.StatusCode)
+	}
+}
+
+type failingGrants struct {
+	GrantStore
+}
+
+func (failingGrants) CreateGrants([]*Grant) error {
+	return errors.New("disk full")
+}
+
+func TestServerProxyGrantFailure(t *testing.T) {
+	s, c := newTestServer(t)
+	s.Grants = &failingGrants{GrantStore: NewMemoryGrantStore()}
+	s.Proxy_url = c.AtmHost + "/"
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	if _, err := c.RequestTempUrls([]string{"GET", "HEAD"}, "owner", "public", "a.txt", 60); nil == err {
+		t.Error("Expected an error when grants can not be stored")
+	}
+	if entries, _ := s.Audit.QueryAudit(&AuditFilter{Outcome: AUDIT_ISSUED}); 0 != len(entries) {
+		t.Error("Expected nothing audited as issued", entries)
+	}
+	if entries, _ := s.Audit.QueryAudit(&AuditFilter{Outcome: AUDIT_FAILED}); 2 != len(entries) {
+		t.Error("Expected both methods audited as failed", entries)
+	}
+}
+
+func TestServerWebhooks(t *testing.T) {
+	events := make(chan *WebhookEvent, 10)
+	var secret string
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if WebhookSignature(secret, r.Header.Get(WEBHOOK_TIMESTAMP_HEADER), body) != r.Header.Get(WEBHOOK_SIGNATURE_HEADER) {
+			t.Error("Unexpected webhook signature")
+		}
+		e := &WebhookEvent{}
+		json.Unmarshal(body, e)
+		events <- e
+	}))
+	t.Cleanup(receiver.Close)
+
+	s, c := newTestServer(t)
+	s.Webhooks = NewWebhookSender(NewMemoryWebhookStore(), 1)
+	s.Webhooks.RetryDelay = time.Millisecond
+	s.Webhooks.MaxAttempts = 2
+	owner := &AtmClient{ApiKey: "owner-key", ApiSecret: "owner-secret", AtmHost: c.AtmHost}
+
+	if _, err := owner.AddWebhook("owner", &Webhook{Url: receiver.URL}); nil == err {
+		t.Error("Expected a plain http loopback webhook to be refused")
+	}
+	s.Webhooks.AllowHttp = true
+	if _, err := owner.AddWebhook("owner", &Webhook{Url: receiver.URL}); nil == err {
+		t.Error("Expected a loopback webhook to be refused")
+	}
+	s.Webhooks.AllowedNetworks, _ = ParseNetworks([]string{"127.0.0.0/8"})
+
+	if _, err := c.AddWebhook("owner", &Webhook{Url: receiver.URL}); nil == err {
+		t.Error("Expected only the owner to add webhooks")
+	}
+	h, err := owner.AddWebhook("owner", &Webhook{Url: receiver.URL, Container: "^backups$"})
+	if nil != err || "" == h.Secret {
+		t.Fatal("Unable to add webhook", h, err)
+	}
+	secret = h.Secret
+	if hooks, _ := owner.Webhooks("owner"); 1 != len(hooks) || "" != hooks[0].Secret {
+		t.Error("Expected the webhook listed without its secret", hooks)
+	}
+
+	if err := owner.SetKey("owner", "swift-key", 0); nil != err {
+		t.Fatal("Unable to set key", err)
+	}
+	c.RequestTempUrl("GET", "owner", "public", "a.txt", 60)
+	c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	// the key event is retried, so may arrive after the url event
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if received[e.Type] || "owner-key" != e.AccountId {
+				t.Error("Unexpected event", e)
+			}
+			received[e.Type] = true
+			if WEBHOOK_URL_ISSUED == e.Type && ("backups" != e.Container || "backup-key" != e.RequestorId) {
+				t.Error("Expected the backups url event only", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for events", received)
+		}
+	}
+	if !received[WEBHOOK_KEY_SET] || !received[WEBHOOK_URL_ISSUED] {
+		t.Error("Expected key set & url issued events", received)
+	}
+
+	failures = 2
+	owner.RemoveKey("owner")
+	s.Webhooks.Close()
+	letters, err := owner.DeadLetters("owner")
+	if nil != err || 1 != len(letters) || WEBHOOK_KEY_REMOVED != letters[0].Event.Type || 2 != letters[0].Attempts {
+		t.Error("Expected the undelivered removal as a dead letter", letters, err)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	_, c := newTestServer(t, func(s *Server) {
+		m := s.Ds.(*MemoryDatastore)
+		m.SetRateLimit(RateLimit{RequestorId: "owner-key", PerMinute: 0})
+		s.Limiter = NewRateLimiter(RateLimit{PerMinute: 1, Burst: 2}, RateLimit{PerMinute: 1, Burst: 1}, m)
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Audit(&AuditFilter{}); nil != err {
+			t.Fatal("Expected requests within the burst", i, err)
+		}
+	}
+	resp, _, err := c.signedRequest("GET", "/v1/audit", nil)
+	if nil != err || http.StatusTooManyRequests != resp.StatusCode || "" == resp.Header.Get("Retry-After") ||
+		"0" != resp.Header.Get(RATE_REMAINING_HEADER) || "2" != resp.Header.Get(RATE_LIMIT_HEADER) {
+		t.Error("Expected the third request limited", resp, err)
+	}
+
+	owner := &AtmClient{ApiKey: "owner-key", ApiSecret: "owner-secret", AtmHost: c.AtmHost}
+	for i := 0; i < 5; i++ {
+		if _, _, err := owner.Audit(&AuditFilter{}); nil != err {
+			t.Fatal("Expected the unlimited override", i, err)
+		}
+	}
+
+	bad := &AtmClient{ApiKey: "owner-key", ApiSecret: "wrong", AtmHost: c.AtmHost}
+	if resp, _, _ := bad.signedRequest("GET", "/v1/audit", nil); http.StatusUnauthorized != resp.StatusCode {
+		t.Error("Expected the first failure to be unauthorized", resp.StatusCode)
+	}
+	if resp, _, _ := owner.signedRequest("GET", "/v1/audit", nil); http.StatusTooManyRequests != resp.StatusCode {
+		t.Error("Expected the address turned away after failing", resp.StatusCode)
+	}
+}
+
+type failingSecrets struct {
+	Store
+}
+
+func (failingSecrets) ApiKeySecret(string) (string, error) {
+	return "", errors.New("dial tcp secret-host:3306: connection refused")
+}
+
+func TestServerAuthLookupFailure(t *testing.T) {
+	_, c := newTestServer(t, func(s *Server) {
+		s.Ds = &failingSecrets{Store: s.Ds}
+		s.Limiter = NewRateLimiter(RateLimit{PerMinute: 60, Burst: 10}, RateLimit{PerMinute: 1, Burst: 1}, nil)
+	})
+	for i := 0; i < 3; i++ {
+		resp, body, err := c.signedRequest("GET", "/v1/audit", nil)
+		if nil != err || http.StatusInternalServerError != resp.StatusCode || strings.Contains(body, "secret-host") {
+			t.Error("Expected a lookup failure answered as the server's, without charging the client", i, resp, body, err)
+		}
+	}
+}
+
+func TestServerAllowedNetworks(t *testing.T) {
+	s, c := newTestServer(t, func(s *Server) {
+		s.Trusted_proxies, _ = ParseNetworks([]string{"127.0.0.1"})
+	})
+	m := s.Ds.(*MemoryDatastore)
+	if err := m.SetAllowedNetworks("backup-key", []string{"192.0.2.0/24"}); nil != err {
+		t.Fatal("Unable to set networks", err)
+	}
+	if resp, _, _ := c.signedRequest("GET", "/v1/audit", nil); http.StatusForbidden != resp.StatusCode {
+		t.Error("Expected the key refused outside its networks", resp.StatusCode)
+	}
+
+	uri := "/v1/audit"
+	auth := AuthorizorForRequest(NewHmacOpts(nil, nil), "GET", uri)
+	auth.ApiKey, auth.Md5, auth.Type = c.ApiKey, md5Of(nil), "application/json"
+	auth.Xtime, auth.Nonce = time.Now().UTC().Format(time.RFC3339), "allowed-network"
+	req, _ := http.NewRequest("GET", c.AtmHost+uri, nil)
+	for h, v := range map[string]string{XTIME: auth.Xtime, CONTENT_MD5: auth.Md5, XNONCE: auth.Nonce,
+		CONTENT_TYPE: auth.Type, FORWARDED_FOR: "192.0.2.10",
+		"Authorization": "ATM_Auth " + c.ApiKey + ":" + auth.SignatureWith(c.ApiSecret)} {
+		req.Header.Set(h, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err || http.StatusOK != resp.StatusCode {
+		t.Error("Expected the key allowed through the trusted proxy", resp, err)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	withMetrics := func(s *Server) {
+		s.Metrics = NewMetrics(s.Nonces, s.Ds)
+		s.Ds = s.Metrics.TimedStore(s.Ds)
+	}
+	s, c := newTestServer(t, withMetrics)
+
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil == err {
+		t.Fatal("Expected an error without a signing key set")
+	}
+	scrape := func() string {
+		resp, err := http.Get(c.AtmHost + "/metrics")
+		if nil != err {
+			t.Fatal("Unable to get metrics", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	body := scrape()
+	for _, line := range []string{
+		`atm_urls_total{account="owner",method="PUT",outcome="failed"} 1`,
+		"atm_accounts_missing_signing_key 1",
+		"atm_signing_key_accounts 0",
+		"atm_nonces 1",
+		`atm_datastore_query_seconds_count{operation="key_for_request"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Error("Expected metric", line)
+		}
+	}
+
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil != err {
+		t.Fatal("Unexpected error requesting url", err)
+	}
+	bad := &AtmClient{ApiKey: "backup-key", ApiSecret: "wrong", AtmHost: c.AtmHost}
+	bad.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60)
+	c.RequestTempUrl("PATCH", "made-up-account", "backups", "host-1/a.tgz", 60)
+	body = scrape()
+	if strings.Contains(body, "made-up-account") || strings.Contains(body, "PATCH") {
+		t.Error("Expected unknown accounts & methods not to become labels")
+	}
+	for _, line := range []string{
+		`atm_urls_total{account="unknown",method="other",outcome="denied"} 1`,
+		`atm_urls_total{account="owner",method="PUT",outcome="issued"} 1`,
+		"atm_accounts_missing_signing_key 0",
+		"atm_signing_key_accounts 1",
+		`atm_auth_failures_total{reason="signature_mismatch"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Error("Expected metric", line)
+		}
+	}
+
+	_, separate := newTestServer(t, withMetrics, func(s *Server) { s.Metrics_listen = "127.0.0.1:9100" })
+	resp, err := http.Get(separate.AtmHost + "/metrics")
+	if nil != err {
+		t.Fatal("Unable to get metrics", err)
+	}
+	resp.Body.Close()
+	if http.StatusOK == resp.StatusCode {
+		t.Error("Expected metrics only on their own address")
+	}
+}
+
+type brokenNonces struct{}
+
+func (brokenNonces) Add(string)        {}
+func (brokenNonces) Valid(string) bool { return true }
+func (brokenNonces) Remove(string)     {}
+
+type failingPing struct {
+	Store
+}
+
+func (failingPing) Ping() error {
+	return errors.New("dial tcp secret-host:3306: connection refused")
+}
+
+func TestServerHealth(t *testing.T) {
+	s, c := newTestServer(t, func(s *Server) { s.Required_accounts = []string{"owner"} })
+
+	health := func(path string) (int, *Health) {
+		resp, err := http.Get(c.AtmHost + path)
+		if nil != err {
+			t.Fatal("Unable to get", path, err)
+		}
+		defer resp.Body.Close()
+		h := &Health{}
+		if err := json.NewDecoder(resp.Body).Decode(h); nil != err {
+			t.Fatal("Unable to decode", path, err)
+		}
+		return resp.StatusCode, h
+	}
+	if code, h := health("/healthz"); http.StatusOK != code || HEALTH_OK != h.Status {
+		t.Error("Expected healthy", code, h)
+	}
+	code, h := health("/readyz")
+	if http.StatusServiceUnavailable != code || HEALTH_NOT_READY != h.Status {
+		t.Error("Expected not ready without a signing key", code, h)
+	}
+	if check := h.Checks["signing_key:owner"]; nil == check || HEALTH_FAILED != check.Status {
+		t.Error("Expected the signing key check to fail", h.Checks)
+	}
+	if check := h.Checks["datastore"]; nil == check || HEALTH_OK != check.Status {
+		t.Error("Expected the datastore check to pass", h.Checks)
+	}
+	if check := h.Checks["nonces"]; nil == check || HEALTH_OK != check.Status {
+		t.Error("Expected the nonce check to pass", h.Checks)
+	}
+	if count := s.Nonces.(NonceStore).Count(); 0 != count {
+		t.Error("Expected readiness probes to leave no nonces behind", count)
+	}
+	s.Nonces = brokenNonces{}
+	if _, h := health("/readyz"); HEALTH_FAILED != h.Checks["nonces"].Status {
+		t.Error("Expected a nonce store forgetting nonces to fail", h.Checks)
+	}
+	s.Nonces = NewNonceStore()
+	s.Ds = &failingPing{Store: s.Ds}
+	resp, _ := http.Get(c.AtmHost + "/readyz")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"datastore":{"status":"failed"}`) || strings.Contains(string(body), "secret-host") {
+		t.Error("Expected the datastore failing without the ping error in the reply", string(body))
+	}
+	s.Ds = s.Ds.(*failingPing).Store
+
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+	if code, h := health("/readyz"); http.StatusOK != code || HEALTH_OK != h.Status {
+		t.Error("Expected ready with a signing key", code, h)
+	}
+}
+
+func TestServerDurationLimitAndHosts(t *testing.T) {
+	s, c := newTestServer(t, func(s *Server) {
+		s.Max_duration = 120
+		s.Object_hosts = map[string]string{"owner": "https://archive.example.org"}
+	})
+	s.Ds.AddSigningKeyForAccount("swift-key", "owner-key")
+
+	url, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 3600)
+	if nil != err {
+		t.Fatal("Unexpected error requesting url", err)
+	}
+	if !strings.HasPrefix(url, "https://archive.example.org/v1/owner/") {
+		t.Error("Expected the account's own host", url)
+	}
+	i := strings.Index(url, "temp_url_expires=")
+	if i < 0 {
+		t.Fatal("Expected an expiry", url)
+	}
+	expires, err := strconv.ParseInt(url[i+len("temp_url_expires="):], 10, 64)
+	if nil != err || expires > time.Now().Unix()+s.Max_duration {
+		t.Error("Expected the duration capped", url, err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Listen = []string{"127.0.0.1:0"}
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Shutdown(context.Background()); nil != err {
+		t.Error("Unexpected error shutting down", err)
+	}
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Error("Expected Run to return cleanly", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected Run to return once shut down")
+	}
+}
+
+// Holds readiness checks on the datastore until released
+type slowPing struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *slowPing) Ping() error {
+	close(p.started)
+	<-p.release
+	return nil
+}
+
+func TestServerShutdownWaitsForRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal("Unable to find a free port", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s, _ := newTestServer(t)
+	slow := &slowPing{Store: s.Ds, started: make(chan struct{}), release: make(chan struct{})}
+	s.Ds = slow
+	s.Listen = []string{addr}
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+
+	replied := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			resp, err := http.Get("http://" + addr + "/readyz")
+			if nil == err {
+				resp.Body.Close()
+				replied <- nil
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		replied <- errors.New("server never answered")
+	}()
+	select {
+	case <-slow.started:
+	case err := <-replied:
+		t.Fatal("Expected the request held in progress", err)
+	}
+	go s.Shutdown(context.Background())
+	select {
+	case <-done:
+		t.Fatal("Expected Run to wait on the request in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(slow.release)
+	if err := <-replied; nil != err {
+		t.Error("Expected the request in progress answered", err)
+	}
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Error("Expected Run to return cleanly", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected Run to return once the request finished")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Shamir's secret sharing over GF(2^8), splitting a master key so that any
+// threshold of the shares can recreate it
+package atm
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+var (
+	gfExp [255]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// 3 generates the multiplicative group of GF(2^8) with the AES polynomial
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		xtime := x << 1
+		if x&0x80 != 0 {
+			xtime ^= 0x1b
+		}
+		x ^= xtime
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if 0 == a || 0 == b {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if 0 == a {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// Split secret into n shares, any threshold of which recreate it. Each share
+// is the secret length plus a trailing byte holding its x coordinate
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || n < threshold || n > 255 {
+		return nil, errors.New("Need 2 <= threshold <= shares <= 255")
+	}
+	if 0 == len(secret) {
+		return nil, errors.New("Nothing to split")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold-1)
+	for b, s := range secret {
+		if _, err := rand.Read(coefficients); nil != err {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method, highest coefficient first
+			y := byte(0)
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i][b] = gfMul(y, x) ^ s
+		}
+	}
+	return shares, nil
+}
+
+// Recreate a secret from at least threshold of its shares. With too few
+// shares the result is garbage rather than an error, so verify it
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("Need at least 2 shares")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("Invalid share")
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if len(s) != size {
+			return nil, errors.New("Shares are not all the same length")
+		}
+		x := s[size-1]
+		if 0 == x || seen[x] {
+			return nil, errors.New("Invalid or duplicate share")
+		}
+		seen[x] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		xi := si[size-1]
+		// Lagrange basis polynomial for share i evaluated at 0
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := sj[size-1]
+			basis = gfMul(basis, gfDiv(xj, xj^xi))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si[b], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,33 @@
+package atm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := SplitSecret(secret, 5, 3)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var some [][]byte
+		for _, i := range subset {
+			some = append(some, shares[i])
+		}
+		combined, err := CombineShares(some)
+		if nil != err || !bytes.Equal(secret, combined) {
+			t.Error("Shares did not recreate the secret", subset, err)
+		}
+	}
+	if combined, _ := CombineShares(shares[:2]); bytes.Equal(secret, combined) {
+		t.Error("Fewer than threshold shares recreated the secret")
+	}
+	if _, err := CombineShares([][]byte{shares[0], shares[0]}); nil == err {
+		t.Error("Expected duplicate shares to be rejected")
+	}
+	if _, err := SplitSecret(secret, 2, 3); nil == err {
+		t.Error("Expected threshold above shares to be rejected")
+	}
+}
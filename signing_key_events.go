@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Sharing signing key changes between instances using one database. Every
+// change is logged to signing_key_events, which each instance polls to
+// reload the keys of changed accounts from signing_keys
+package atm
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	KEY_EVENT_SET    = "set"
+	KEY_EVENT_REMOVE = "remove"
+	// How long events are kept for instances to catch up
+	KEY_EVENT_RETENTION = 24 * time.Hour
+	// Events are rechecked this far back, as ids may commit out of order
+	keyEventGrace = 10 * time.Second
+)
+
+func (d *Datastore) recordSigningKeyEvent(tx *sql.Tx, account, action string) error {
+	_, err := tx.Exec(d.rebind("INSERT INTO signing_key_events (account_id, action, created_at) VALUES (?, ?, ?)"),
+		account, action, time.Now().Unix())
+	return err
+}
+
+// Poll for signing key changes from other instances every interval, until
+// closed. Needs the master key set, & the keys loaded, first
+func (d *Datastore) WatchSigningKeys(interval time.Duration) error {
+	var last int64
+	err := d.pool.QueryRow("SELECT COALESCE(MAX(id), 0) FROM signing_key_events").Scan(&last)
+	if nil != err {
+		return err
+	}
+	d.watchStop = make(chan bool)
+	go d.watchSigningKeys(interval, last, d.watchStop)
+	return nil
+}
+
+func (d *Datastore) watchSigningKeys(interval time.Duration, last int64, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	polled := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			latest, err := d.SyncSigningKeys(last, polled.Add(-keyEventGrace))
+			if nil != err {
+				log.Printf("Syncing signing keys: %s", err.Error())
+				continue
+			}
+			last, polled = latest, now
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reload the keys of every account with an event after id last or since,
+// returning the latest event id seen. Also drops events past retention
+func (d *Datastore) SyncSigningKeys(last int64, since time.Time) (int64, error) {
+	rows, err := d.pool.Query(d.rebind("SELECT id, account_id FROM signing_key_events WHERE id > ? OR created_at >= ?"),
+		last, since.Unix())
+	if nil != err {
+		return last, err
+	}
+	changed := make(map[string]bool)
+	latest := last
+	for rows.Next() {
+		var id int64
+		var account string
+		if err := rows.Scan(&id, &account); nil != err {
+			rows.Close()
+			return last, err
+		}
+		changed[account] = true
+		if id > latest {
+			latest = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); nil != err {
+		return last, err
+	}
+
+	for account := range changed {
+		keys, err := d.loadSigningKeys(account)
+		if nil != err {
+			return last, err
+		}
+		d.SigningKeys.lock.Lock()
+		d.SigningKeys.setAccountKeys(account, keys)
+		d.SigningKeys.lock.Unlock()
+	}
+
+	_, err = d.pool.Exec(d.rebind("DELETE FROM signing_key_events WHERE created_at < ?"),
+		time.Now().Add(-KEY_EVENT_RETENTION).Unix())
+	return latest, err
+}
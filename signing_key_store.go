@@ -0,0 +1,241 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Persistence of signing keys in the sql datastore, envelope encrypted with
+// the server master key. The in memory SigningKeys act as a read-through
+// cache in front of the signing_keys table
+package atm
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Persist signing keys encrypted with r. Without a master key signing keys
+// are only ever kept in memory
+func (d *Datastore) SetMasterKey(r *KeyRing) {
+	d.masterKey = r
+}
+
+func (d *Datastore) AddSigningKeyForAccount(key, account string) error {
+	return d.StageSigningKeyForAccount(account, NewSigningKey(key))
+}
+
+func (d *Datastore) StageSigningKeyForAccount(account string, k *SigningKey) error {
+	if nil == d.masterKey {
+		return d.SigningKeys.StageSigningKeyForAccount(account, k)
+	}
+	d.SigningKeys.lock.Lock()
+	defer d.SigningKeys.lock.Unlock()
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	// staged from the rows, locked until commit, not the cache another
+	// replica may have changed since it was last synced
+	current, err := d.lockSigningKeys(tx, account)
+	if nil != err {
+		tx.Rollback()
+		return err
+	}
+	keys := current.stage(k)
+	if keys == current {
+		tx.Rollback()
+		d.SigningKeys.setAccountKeys(account, keys)
+		return nil
+	}
+	if err := d.saveSigningKeys(tx, keys, account); nil != err {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); nil != err {
+		return err
+	}
+	d.SigningKeys.setAccountKeys(account, keys)
+	return nil
+}
+
+// The persisted keys of account, locked for the rest of tx. Expired keys
+// are dropped first, which on sqlite also takes the write lock
+func (d *Datastore) lockSigningKeys(tx *sql.Tx, account string) (*AccountKeys, error) {
+	if _, err := tx.Exec(d.rebind("DELETE FROM signing_keys WHERE account_id = ? AND expires_at > 0 AND expires_at <= ?"),
+		account, time.Now().Unix()); nil != err {
+		return nil, err
+	}
+	query := "SELECT " + signingKeyColumns + " FROM signing_keys WHERE account_id = ?"
+	if SQLITE_DRIVER != d.driver {
+		query += " FOR UPDATE"
+	}
+	all, err := d.querySigningKeys(tx, d.rebind(query), account)
+	if nil != err {
+		return nil, err
+	}
+	return all[account], nil
+}
+
+func (d *Datastore) RemoveSigningKeyForAccount(account string) error {
+	if nil != d.masterKey {
+		tx, err := d.pool.Begin()
+		if nil != err {
+			return err
+		}
+		if _, err := tx.Exec(d.rebind("DELETE FROM signing_keys WHERE account_id = ?"), account); nil != err {
+			tx.Rollback()
+			return err
+		}
+		if err := d.recordSigningKeyEvent(tx, account, KEY_EVENT_REMOVE); nil != err {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); nil != err {
+			return err
+		}
+	}
+	return d.SigningKeys.RemoveSigningKeyForAccount(account)
+}
+
+// From the cache, falling back to the signing_keys table
+func (d *Datastore) SigningKeysForAccount(account string) *AccountKeys {
+	if k := d.SigningKeys.accountKeys(account); nil != k || nil == d.masterKey {
+		return k
+	}
+	k, err := d.loadSigningKeys(account)
+	if nil != err {
+		log.Printf("Loading signing key for %s: %s", account, err.Error())
+		return nil
+	}
+	if nil != k {
+		d.SigningKeys.setAccountKeys(account, k)
+	}
+	return k
+}
+
+func (d *Datastore) signingKeyFor(account string) string {
+	if k := d.SigningKeysForAccount(account).Current(time.Now()); nil != k {
+		return k.Key
+	}
+	return ""
+}
+
+const (
+	PRIMARY_SLOT   = 1
+	SECONDARY_SLOT = 2
+)
+
+// Replace the rows of account with keys, within tx
+func (d *Datastore) saveSigningKeys(tx *sql.Tx, keys *AccountKeys, account string) error {
+	if _, err := tx.Exec(d.rebind("DELETE FROM signing_keys WHERE account_id = ?"), account); nil != err {
+		return err
+	}
+	slots := map[int]*SigningKey{PRIMARY_SLOT: keys.Primary, SECONDARY_SLOT: keys.Secondary}
+	for slot, k := range slots {
+		if nil == k {
+			continue
+		}
+		dek, sealed, err := d.masterKey.SealEnvelope([]byte(k.Key), account)
+		if nil != err {
+			return err
+		}
+		expiresAt := int64(0)
+		if nil != k.ExpiresAt {
+			expiresAt = k.ExpiresAt.Unix()
+		}
+		_, err = tx.Exec(d.rebind("INSERT INTO signing_keys (account_id, slot, dek, signing_key, active_at, set_at, set_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+			account, slot, dek, sealed, k.ActiveAt.Unix(), k.SetAt.Unix(), k.SetBy, expiresAt)
+		if nil != err {
+			return err
+		}
+	}
+	return d.recordSigningKeyEvent(tx, account, KEY_EVENT_SET)
+}
+
+const signingKeyColumns = "account_id, slot, dek, signing_key, active_at, set_at, set_by, expires_at"
+
+func (d *Datastore) loadSigningKeys(account string) (*AccountKeys, error) {
+	if err := d.dropExpiredSigningKeys(); nil != err {
+		return nil, err
+	}
+	all, err := d.querySigningKeys(d.pool, d.rebind("SELECT "+signingKeyColumns+" FROM signing_keys WHERE account_id = ?"), account)
+	if nil != err {
+		return nil, err
+	}
+	return all[account], nil
+}
+
+func (d *Datastore) dropExpiredSigningKeys() error {
+	_, err := d.pool.Exec(d.rebind("DELETE FROM signing_keys WHERE expires_at > 0 AND expires_at <= ?"), time.Now().Unix())
+	return err
+}
+
+// The pool, or a transaction, signing keys are read through
+type signingKeyQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Keys by account, decrypted with the master key. Keys that can not be
+// decrypted are logged & skipped
+func (d *Datastore) querySigningKeys(q signingKeyQuerier, query string, args ...interface{}) (map[string]*AccountKeys, error) {
+	rows, err := q.Query(query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string]*AccountKeys)
+	for rows.Next() {
+		var account, dek, sealed, setBy string
+		var slot int
+		var activeAt, setAt, expiresAt int64
+		if err := rows.Scan(&account, &slot, &dek, &sealed, &activeAt, &setAt, &setBy, &expiresAt); nil != err {
+			return nil, err
+		}
+		key, err := d.masterKey.OpenEnvelope(dek, sealed, account)
+		if nil != err {
+			log.Printf("Loading signing key for %s: %s", account, err.Error())
+			continue
+		}
+		k := &SigningKey{
+			Key:      string(key),
+			ActiveAt: time.Unix(activeAt, 0).UTC(),
+			SetAt:    time.Unix(setAt, 0).UTC(),
+			SetBy:    setBy,
+			// derived when first asked for
+			fingerprint: &keyFingerprint{},
+		}
+		if expiresAt > 0 {
+			expires := time.Unix(expiresAt, 0).UTC()
+			k.ExpiresAt = &expires
+		}
+		keys, found := all[account]
+		if !found {
+			keys = &AccountKeys{}
+			all[account] = keys
+		}
+		if PRIMARY_SLOT == slot {
+			keys.Primary = k
+		} else {
+			keys.Secondary = k
+		}
+	}
+	return all, rows.Err()
+}
+
+// Fill the cache with every persisted signing key, returning how many
+// accounts had keys loaded
+func (d *Datastore) LoadSigningKeys() (int, error) {
+	if nil == d.masterKey {
+		return 0, nil
+	}
+	if err := d.dropExpiredSigningKeys(); nil != err {
+		return 0, err
+	}
+	all, err := d.querySigningKeys(d.pool, "SELECT "+signingKeyColumns+" FROM signing_keys")
+	if nil != err {
+		return 0, err
+	}
+	for account, keys := range all {
+		d.SigningKeys.setAccountKeys(account, keys)
+	}
+	return len(all), nil
+}
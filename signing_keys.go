@@ -0,0 +1,233 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Holds the swift tempurl signing keys of each account
+package atm
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Slows guessing a key from its fingerprint, which owners & webhooks see
+	KEY_FINGERPRINT_ITERATIONS = 100000
+	KEY_FINGERPRINT_CONTEXT    = "atm-signing-key-fingerprint:"
+)
+
+// A rule granted the request but the account has no signing key loaded
+type KeyNotSetError struct {
+	Account   string
+	AccountId string
+}
+
+func (e KeyNotSetError) Error() string {
+	return fmt.Sprintf("Key not set for %s", e.Account)
+}
+
+type SigningKey struct {
+	Key string `json:"-"`
+	// Only filled in for the owner, see KeyFingerprint
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	ActiveAt    time.Time  `json:"active_at"`
+	SetAt       time.Time  `json:"set_at"`
+	SetBy       string     `json:"set_by"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// kept with the key once derived, shared by copies
+	fingerprint *keyFingerprint
+}
+
+type keyFingerprint struct {
+	once  sync.Once
+	value string
+}
+
+// A key active from now, never expiring
+func NewSigningKey(key string) *SigningKey {
+	now := time.Now().UTC()
+	return &SigningKey{Key: key, ActiveAt: now, SetAt: now, fingerprint: &keyFingerprint{}}
+}
+
+// The fingerprint of k in account, only derived the first time it is asked
+// for, as it is deliberately slow
+func (k *SigningKey) FingerprintFor(account string) string {
+	if nil == k.fingerprint {
+		return KeyFingerprint(account, k.Key)
+	}
+	k.fingerprint.once.Do(func() { k.fingerprint.value = KeyFingerprint(account, k.Key) })
+	return k.fingerprint.value
+}
+
+// Identifies a key without revealing it, so owners can check which is
+// loaded. Salted with the account name, so fingerprints can not be compared
+// across accounts or precomputed, & slow to make guessing keys costly
+func KeyFingerprint(account, key string) string {
+	sum, err := pbkdf2.Key(sha256.New, key, []byte(KEY_FINGERPRINT_CONTEXT+account), KEY_FINGERPRINT_ITERATIONS, 16)
+	if nil != err {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+func (k *SigningKey) Active(now time.Time) bool {
+	return nil != k && !k.ActiveAt.After(now) && !k.Expired(now)
+}
+
+func (k *SigningKey) Expired(now time.Time) bool {
+	return nil != k && nil != k.ExpiresAt && !k.ExpiresAt.After(now)
+}
+
+// Like swift's Temp-URL-Key & Temp-URL-Key-2 an account has two keys, the
+// newest one and the one it replaces, which still signs until the newest
+// becomes active
+type AccountKeys struct {
+	Primary   *SigningKey `json:"primary,omitempty"`
+	Secondary *SigningKey `json:"secondary,omitempty"`
+}
+
+// The key to sign with at now, nil if none is active
+func (a *AccountKeys) Current(now time.Time) *SigningKey {
+	if nil == a {
+		return nil
+	}
+	if a.Primary.Active(now) {
+		return a.Primary
+	}
+	if a.Secondary.Active(now) {
+		return a.Secondary
+	}
+	return nil
+}
+
+// The keys without any expired at now, a itself if none are
+func (a *AccountKeys) unexpired(now time.Time) *AccountKeys {
+	if nil == a || (!a.Primary.Expired(now) && !a.Secondary.Expired(now)) {
+		return a
+	}
+	keys := &AccountKeys{}
+	if !a.Primary.Expired(now) {
+		keys.Primary = a.Primary
+	}
+	if !a.Secondary.Expired(now) {
+		keys.Secondary = a.Secondary
+	}
+	if nil == keys.Primary && nil == keys.Secondary {
+		return nil
+	}
+	return keys
+}
+
+// The keys after staging k. An active primary becomes the secondary, while a
+// still pending one is just replaced. Staging the primary again is a no-op
+func (a *AccountKeys) stage(k *SigningKey) *AccountKeys {
+	if nil == a {
+		return &AccountKeys{Primary: k}
+	}
+	if nil != a.Primary && k.Key == a.Primary.Key {
+		return a
+	}
+	if a.Primary.Active(k.SetAt) {
+		return &AccountKeys{Primary: k, Secondary: a.Primary}
+	}
+	return &AccountKeys{Primary: k, Secondary: a.Secondary}
+}
+
+// What an owner sees of their keys, never the keys themselves
+type KeyStatus struct {
+	Account string `json:"account"`
+	// Fingerprint of the key signing now, empty if none
+	Signing string `json:"signing"`
+	AccountKeys
+}
+
+func NewKeyStatus(account string, keys *AccountKeys) *KeyStatus {
+	status := &KeyStatus{Account: account}
+	current := keys.Current(time.Now())
+	// copies, the keys held are shared
+	fingerprinted := func(k *SigningKey) *SigningKey {
+		if nil == k {
+			return nil
+		}
+		c := *k
+		c.Fingerprint = k.FingerprintFor(account)
+		if k == current {
+			status.Signing = c.Fingerprint
+		}
+		return &c
+	}
+	if nil != keys {
+		status.Primary = fingerprinted(keys.Primary)
+		status.Secondary = fingerprinted(keys.Secondary)
+	}
+	return status
+}
+
+type SigningKeys struct {
+	lock sync.Mutex
+	keys *Cache
+}
+
+func NewSigningKeys() *SigningKeys {
+	return &SigningKeys{keys: NewCache()}
+}
+
+// Number of accounts with signing keys loaded
+func (s *SigningKeys) Count() int {
+	return s.keys.Count()
+}
+
+func (s *SigningKeys) RemoveSigningKeyForAccount(account string) error {
+	s.keys.Delete(account)
+	return nil
+}
+
+// Sign with key from now on
+func (s *SigningKeys) AddSigningKeyForAccount(key, account string) error {
+	return s.StageSigningKeyForAccount(account, NewSigningKey(key))
+}
+
+// Add k, only signing with it from its ActiveAt on
+func (s *SigningKeys) StageSigningKeyForAccount(account string, k *SigningKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.setAccountKeys(account, s.accountKeys(account).stage(k))
+	return nil
+}
+
+func (s *SigningKeys) SigningKeysForAccount(account string) *AccountKeys {
+	return s.accountKeys(account)
+}
+
+// The cached keys, dropping any that expired
+func (s *SigningKeys) accountKeys(account string) *AccountKeys {
+	k, found := s.keys.Get(account)
+	if !found {
+		return nil
+	}
+	keys := k.(*AccountKeys)
+	if current := keys.unexpired(time.Now()); current != keys {
+		s.setAccountKeys(account, current)
+		return current
+	}
+	return keys
+}
+
+func (s *SigningKeys) setAccountKeys(account string, keys *AccountKeys) {
+	if nil == keys {
+		s.keys.Delete(account)
+		return
+	}
+	s.keys.Set(account, keys)
+}
+
+func (s *SigningKeys) signingKeyFor(account string) string {
+	if k := s.accountKeys(account).Current(time.Now()); nil != k {
+		return k.Key
+	}
+	return ""
+}
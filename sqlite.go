@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// SQLite support, for small sites & tests that want a single file
+package atm
+
+import (
+	"database/sql"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	SQLITE_DRIVER = "sqlite3"
+	// sqlite3 with our REGEXP function registered on each connection
+	sqliteRegexpDriver = "atm_sqlite3"
+)
+
+// compiled patterns from rules, shared by all connections
+var sqliteRegexps = NewCache()
+
+func init() {
+	sql.Register(sqliteRegexpDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", sqliteRegexp, true)
+		},
+	})
+}
+
+// SQLite rewrites X REGEXP Y into regexp(Y, X), so the pattern is first
+func sqliteRegexp(pattern, s string) (bool, error) {
+	if re, found := sqliteRegexps.Get(pattern); found {
+		return re.(*regexp.Regexp).MatchString(s), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if nil != err {
+		return false, err
+	}
+	sqliteRegexps.Set(pattern, re)
+	return re.MatchString(s), nil
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Fetches signing keys straight from the Temp-URL-Key metadata of swift
+// accounts, for owners who register swift credentials instead of pushing
+// their key to us
+package atm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SWIFT_AUTH_USER      = "X-Auth-User"
+	SWIFT_AUTH_KEY       = "X-Auth-Key"
+	SWIFT_AUTH_TOKEN     = "X-Auth-Token"
+	SWIFT_STORAGE_URL    = "X-Storage-Url"
+	SWIFT_TEMP_URL_KEY   = "X-Account-Meta-Temp-Url-Key"
+	SWIFT_TEMP_URL_KEY_2 = "X-Account-Meta-Temp-Url-Key-2"
+	// Recorded as who set keys fetched from swift
+	SWIFT_SET_BY = "swift"
+)
+
+// How to reach a swift account, either auth (v1) url, user & key or a
+// storage url & token. With both the token is used until it is rejected
+type SwiftCredentials struct {
+	AuthUrl    string `json:"auth_url"`
+	User       string `json:"user"`
+	Key        string `json:"key"`
+	StorageUrl string `json:"storage_url"`
+	Token      string `json:"token"`
+}
+
+func (c *SwiftCredentials) Valid() bool {
+	return c.canAuthenticate() || ("" != c.StorageUrl && "" != c.Token)
+}
+
+func (c *SwiftCredentials) canAuthenticate() bool {
+	return "" != c.AuthUrl && "" != c.User && "" != c.Key
+}
+
+// Where registered credentials are kept so they survive a restart & reach
+// every instance
+type SwiftCredentialStore interface {
+	SaveSwiftCredentials(accountId string, c *SwiftCredentials) error
+	RemoveSwiftCredentials(accountId string) error
+	AllSwiftCredentials() (map[string]*SwiftCredentials, error)
+}
+
+type swiftAccount struct {
+	lock  sync.Mutex
+	creds SwiftCredentials
+	// as registered, to tell whether the saved credentials changed
+	registered SwiftCredentials
+}
+
+type SwiftKeyFetcher struct {
+	Ds Store
+	// Credentials are only kept in memory when nil
+	Saved SwiftCredentialStore
+	// Base urls, like https://swift.example.org, auth & storage urls must be
+	// on. Nothing is fetched from anywhere else
+	AllowedHosts []string
+	Client       *http.Client
+	lock         sync.RWMutex
+	creds        map[string]*swiftAccount
+	loaded       bool
+	stop         chan bool
+}
+
+// Fetch keys into ds, refreshing every registered account each interval. An
+// interval of 0 only fetches on registration or when a key is missing
+func NewSwiftKeyFetcher(ds Store, interval time.Duration) *SwiftKeyFetcher {
+	f := &SwiftKeyFetcher{
+		Ds: ds,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			// a redirect could lead anywhere, past AllowedHosts
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		creds: make(map[string]*swiftAccount),
+	}
+	if interval > 0 {
+		f.stop = make(chan bool)
+		go f.run(interval, f.stop)
+	}
+	return f
+}
+
+func (f *SwiftKeyFetcher) run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.refreshAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (f *SwiftKeyFetcher) Close() {
+	if nil != f.stop {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// Remember c for account, fetching its key right away to prove they work
+func (f *SwiftKeyFetcher) Register(account string, c *SwiftCredentials) error {
+	if !c.Valid() {
+		return errors.New("Need auth_url, user & key or storage_url & token")
+	}
+	for _, u := range []string{c.AuthUrl, c.StorageUrl} {
+		if "" == u {
+			continue
+		}
+		if err := f.allowedUrl(u); nil != err {
+			return err
+		}
+	}
+	a := &swiftAccount{creds: *c, registered: *c}
+	if _, err := f.fetch(account, a); nil != err {
+		return err
+	}
+	if nil != f.Saved {
+		if err := f.Saved.SaveSwiftCredentials(account, c); nil != err {
+			return err
+		}
+	}
+	f.lock.Lock()
+	f.creds[account] = a
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *SwiftKeyFetcher) Unregister(account string) error {
+	if nil != f.Saved {
+		if err := f.Saved.RemoveSwiftCredentials(account); nil != err {
+			return err
+		}
+	}
+	f.lock.Lock()
+	delete(f.creds, account)
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *SwiftKeyFetcher) Registered(account string) bool {
+	f.load()
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	_, found := f.creds[account]
+	return found
+}
+
+// Fetch the current key of a registered account
+func (f *SwiftKeyFetcher) Refresh(account string) (string, error) {
+	f.load()
+	f.lock.RLock()
+	a, found := f.creds[account]
+	f.lock.RUnlock()
+	if !found {
+		return "", errors.New(fmt.Sprintf("No swift credentials for %s", account))
+	}
+	return f.fetch(account, a)
+}
+
+// The saved credentials, the first time they can be read. While sealed
+// they can not be, so this is tried again until unsealed
+func (f *SwiftKeyFetcher) load() {
+	f.lock.RLock()
+	loaded := f.loaded
+	f.lock.RUnlock()
+	if loaded || nil == f.Saved {
+		return
+	}
+	if err := f.Sync(); nil != err {
+		log.Printf("Loading swift credentials: %s", err.Error())
+	}
+}
+
+// Match the registered accounts to the saved credentials, picking up those
+// registered or removed through other instances. Unchanged accounts keep
+// their token
+func (f *SwiftKeyFetcher) Sync() error {
+	if nil == f.Saved {
+		return nil
+	}
+	saved, err := f.Saved.AllSwiftCredentials()
+	if nil != err {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	creds := make(map[string]*swiftAccount, len(saved))
+	for account, c := range saved {
+		if a, found := f.creds[account]; found && a.registered == *c {
+			creds[account] = a
+		} else {
+			creds[account] = &swiftAccount{creds: *c, registered: *c}
+		}
+	}
+	f.creds = creds
+	f.loaded = true
+	return nil
+}
+
+func (f *SwiftKeyFetcher) refreshAll() {
+	if err := f.Sync(); nil != err {
+		log.Printf("Loading swift credentials: %s", err.Error())
+	}
+	f.lock.RLock()
+	accounts := make([]string, 0, len(f.creds))
+	for account := range f.creds {
+		accounts = append(accounts, account)
+	}
+	f.lock.RUnlock()
+	for _, account := range accounts {
+		if _, err := f.Refresh(account); nil != err {
+			log.Printf("Refreshing swift key for %s: %s", account, err.Error())
+		}
+	}
+}
+
+func (f *SwiftKeyFetcher) fetch(account string, a *swiftAccount) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if "" == a.creds.Token || "" == a.creds.StorageUrl {
+		if err := f.authenticate(&a.creds); nil != err {
+			return "", err
+		}
+	}
+	key, status, err := f.headAccount(&a.creds)
+	if http.StatusUnauthorized == status && a.creds.canAuthenticate() {
+		// token expired, get a fresh one & try once more
+		if err := f.authenticate(&a.creds); nil != err {
+			return "", err
+		}
+		key, status, err = f.headAccount(&a.creds)
+	}
+	if nil != err {
+		return "", err
+	}
+	k := NewSigningKey(key)
+	k.SetBy = SWIFT_SET_BY
+	if err := f.Ds.StageSigningKeyForAccount(account, k); nil != err {
+		return "", err
+	}
+	return key, nil
+}
+
+// Swift v1 auth, trading user & key for a token & storage url
+func (f *SwiftKeyFetcher) authenticate(c *SwiftCredentials) error {
+	if !c.canAuthenticate() {
+		return errors.New("Swift token rejected and no credentials to get another")
+	}
+	if err := f.allowedUrl(c.AuthUrl); nil != err {
+		return err
+	}
+	req, err := http.NewRequest("GET", c.AuthUrl, nil)
+	if nil != err {
+		return err
+	}
+	req.Header.Set(SWIFT_AUTH_USER, c.User)
+	req.Header.Set(SWIFT_AUTH_KEY, c.Key)
+	resp, err := f.Client.Do(req)
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Swift authentication failed: %s", resp.Status))
+	}
+	c.Token = resp.Header.Get(SWIFT_AUTH_TOKEN)
+	if storage := resp.Header.Get(SWIFT_STORAGE_URL); "" != storage {
+		c.StorageUrl = storage
+	}
+	if "" == c.Token || "" == c.StorageUrl {
+		return errors.New("Swift authentication did not return a token and storage url")
+	}
+	return nil
+}
+
+func (f *SwiftKeyFetcher) headAccount(c *SwiftCredentials) (string, int, error) {
+	// swift picks the storage url when authenticating, check it too
+	if err := f.allowedUrl(c.StorageUrl); nil != err {
+		return "", 0, err
+	}
+	req, err := http.NewRequest("HEAD", c.StorageUrl, nil)
+	if nil != err {
+		return "", 0, err
+	}
+	req.Header.Set(SWIFT_AUTH_TOKEN, c.Token)
+	resp, err := f.Client.Do(req)
+	if nil != err {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", resp.StatusCode, errors.New(fmt.Sprintf("Swift account HEAD failed: %s", resp.Status))
+	}
+	key := resp.Header.Get(SWIFT_TEMP_URL_KEY)
+	if "" == key {
+		// mid rotation the new key may only be in the second slot
+		key = resp.Header.Get(SWIFT_TEMP_URL_KEY_2)
+	}
+	if "" == key {
+		return "", resp.StatusCode, errors.New("Swift account has no Temp-URL-Key set")
+	}
+	return key, resp.StatusCode, nil
+}
+
+// Whether raw is on one of AllowedHosts, the same scheme, host & port
+func (f *SwiftKeyFetcher) allowedUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if nil == err && ("http" == u.Scheme || "https" == u.Scheme) {
+		for _, allowed := range f.AllowedHosts {
+			a, err := url.Parse(allowed)
+			if nil == err && a.Scheme == u.Scheme && strings.EqualFold(a.Host, u.Host) {
+				return nil
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("Swift url %s is not on an allowed host", raw))
+}
+
+// Credentials are sealed with the master key, as one JSON document per
+// account
+func (d *Datastore) SaveSwiftCredentials(accountId string, c *SwiftCredentials) error {
+	if nil == d.masterKey {
+		return errors.New("Swift credentials are only saved under a master key")
+	}
+	plain, err := json.Marshal(c)
+	if nil != err {
+		return err
+	}
+	dek, sealed, err := d.masterKey.SealEnvelope(plain, "swift:"+accountId)
+	if nil != err {
+		return err
+	}
+	tx, err := d.pool.Begin()
+	if nil != err {
+		return err
+	}
+	if _, err := tx.Exec(d.rebind("DELETE FROM swift_credentials WHERE account_id = ?"), accountId); nil != err {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO swift_credentials (account_id, dek, credentials, updated_at) VALUES (?, ?, ?, ?)"),
+		accountId, dek, sealed, time.Now().Unix())
+	if nil != err {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *Datastore) RemoveSwiftCredentials(accountId string) error {
+	_, err := d.pool.Exec(d.rebind("DELETE FROM swift_credentials WHERE account_id = ?"), accountId)
+	return err
+}
+
+// Every saved account's credentials. Those that can not be decrypted are
+// logged & skipped
+func (d *Datastore) AllSwiftCredentials() (map[string]*SwiftCredentials, error) {
+	if nil == d.masterKey {
+		return nil, errors.New("Swift credentials can not be read without the master key")
+	}
+	rows, err := d.pool.Query("SELECT account_id, dek, credentials FROM swift_credentials")
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string]*SwiftCredentials)
+	for rows.Next() {
+		var account, dek, sealed string
+		if err := rows.Scan(&account, &dek, &sealed); nil != err {
+			return nil, err
+		}
+		plain, err := d.masterKey.OpenEnvelope(dek, sealed, "swift:"+account)
+		if nil != err {
+			log.Printf("Loading swift credentials for %s: %s", account, err.Error())
+			continue
+		}
+		c := &SwiftCredentials{}
+		if err := json.Unmarshal(plain, c); nil != err {
+			log.Printf("Loading swift credentials for %s: %s", account, err.Error())
+			continue
+		}
+		all[account] = c
+	}
+	return all, rows.Err()
+}
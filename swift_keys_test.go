@@ -0,0 +1,188 @@
+package atm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A swift that hands out a token for one user & reports the account key
+type fakeSwift struct {
+	lock  sync.Mutex
+	token string
+	key   string
+	auths int
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch r.URL.Path {
+	case "/auth/v1.0":
+		if "owner" != r.Header.Get(SWIFT_AUTH_USER) || "password" != r.Header.Get(SWIFT_AUTH_KEY) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.auths++
+		w.Header().Set(SWIFT_AUTH_TOKEN, f.token)
+		w.Header().Set(SWIFT_STORAGE_URL, "http://"+r.Host+"/v1/AUTH_owner")
+		w.WriteHeader(http.StatusOK)
+	case "/v1/AUTH_owner":
+		if f.token != r.Header.Get(SWIFT_AUTH_TOKEN) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(SWIFT_TEMP_URL_KEY, f.key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeSwift) set(token, key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.token = token
+	f.key = key
+}
+
+func TestSwiftKeyFetcher(t *testing.T) {
+	swift := &fakeSwift{token: "token-1", key: "key-1"}
+	ts := httptest.NewServer(swift)
+	defer ts.Close()
+
+	ds := newTestMemoryDatastore(t)
+	f := NewSwiftKeyFetcher(ds, 0)
+	f.AllowedHosts = []string{ts.URL}
+	defer f.Close()
+
+	if err := f.Register("owner-key", &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner"}); nil == err {
+		t.Error("Expected incomplete credentials to be refused")
+	}
+	if err := f.Register("owner-key", &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner", Key: "wrong"}); nil == err {
+		t.Error("Expected bad credentials to be refused")
+	}
+	if f.Registered("owner-key") {
+		t.Error("Expected failed registration not to be kept")
+	}
+
+	creds := &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner", Key: "password"}
+	if err := f.Register("owner-key", creds); nil != err {
+		t.Fatal("Unexpected error registering", err)
+	}
+	if k := ds.signingKeyFor("owner-key"); "key-1" != k {
+		t.Error("Expected key-1 after registering, got", k)
+	}
+
+	// expired token & rotated key
+	swift.set("token-2", "key-2")
+	if k, err := f.Refresh("owner-key"); nil != err || "key-2" != k {
+		t.Error("Expected refresh to reauthenticate and get key-2", k, err)
+	}
+	if 2 != swift.auths {
+		t.Error("Expected 2 authentications, got", swift.auths)
+	}
+
+	f.Unregister("owner-key")
+	if _, err := f.Refresh("owner-key"); nil == err {
+		t.Error("Expected refresh to fail once unregistered")
+	}
+
+	token := &SwiftCredentials{StorageUrl: ts.URL + "/v1/AUTH_owner", Token: "token-2"}
+	if err := f.Register("backup-key", token); nil != err {
+		t.Error("Unexpected error registering a storage token", err)
+	}
+	swift.set("token-3", "key-3")
+	if _, err := f.Refresh("backup-key"); nil == err {
+		t.Error("Expected an expired token without credentials to fail")
+	}
+}
+
+func TestServerSwiftKey(t *testing.T) {
+	swift := &fakeSwift{token: "token-1", key: "key-1"}
+	ts := httptest.NewServer(swift)
+	defer ts.Close()
+
+	s, c := newTestServer(t)
+	s.Swift = NewSwiftKeyFetcher(s.Ds, 0)
+	s.Swift.AllowedHosts = []string{ts.URL}
+	defer s.Swift.Close()
+	if err := s.Swift.Register("owner-key", &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner", Key: "password"}); nil != err {
+		t.Fatal("Unexpected error registering", err)
+	}
+	s.Ds.RemoveSigningKeyForAccount("owner-key")
+
+	if _, err := c.RequestTempUrl("PUT", "owner", "backups", "host-1/a.tgz", 60); nil != err {
+		t.Error("Expected a missing key to be fetched from swift", err)
+	}
+}
+
+func TestSwiftKeyFetcherAllowedHosts(t *testing.T) {
+	swift := &fakeSwift{token: "token-1", key: "key-1"}
+	ts := httptest.NewServer(swift)
+	defer ts.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(ts.URL+"/auth/v1.0", http.StatusFound))
+	defer redirect.Close()
+
+	f := NewSwiftKeyFetcher(newTestMemoryDatastore(t), 0)
+	defer f.Close()
+	creds := &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner", Key: "password"}
+	if err := f.Register("owner-key", creds); nil == err || 0 != swift.auths {
+		t.Error("Expected a host not allowed to be refused without contacting it", err)
+	}
+	f.AllowedHosts = []string{redirect.URL}
+	if err := f.Register("owner-key", &SwiftCredentials{AuthUrl: redirect.URL, User: "owner", Key: "password"}); nil == err || 0 != swift.auths {
+		t.Error("Expected a redirect not to be followed", err)
+	}
+	if err := f.Register("owner-key", &SwiftCredentials{StorageUrl: "http://169.254.169.254/", Token: "t"}); nil == err {
+		t.Error("Expected a storage url not allowed to be refused")
+	}
+}
+
+func TestDatastoreSwiftCredentials(t *testing.T) {
+	forEachDatastore(t, testDatastoreSwiftCredentials)
+}
+
+func testDatastoreSwiftCredentials(t *testing.T, ds *Datastore) {
+	swift := &fakeSwift{token: "token-1", key: "key-1"}
+	ts := httptest.NewServer(swift)
+	defer ts.Close()
+	creds := &SwiftCredentials{AuthUrl: ts.URL + "/auth/v1.0", User: "owner", Key: "password"}
+	if err := ds.SaveSwiftCredentials("owner-key", creds); nil == err {
+		t.Error("Expected credentials not to be saved without a master key")
+	}
+	k, _ := NewKek("master")
+	ds.SetMasterKey(NewKeyRing(k))
+
+	f := NewSwiftKeyFetcher(ds, 0)
+	f.Saved = ds
+	f.AllowedHosts = []string{ts.URL}
+	defer f.Close()
+	if err := f.Register("owner-key", creds); nil != err {
+		t.Fatal("Unexpected error registering", err)
+	}
+	var stored string
+	ds.pool.QueryRow("SELECT credentials FROM swift_credentials").Scan(&stored)
+	if "" == stored || strings.Contains(stored, "password") {
+		t.Error("Expected the credentials stored encrypted", stored)
+	}
+
+	// a restarted server finds them again
+	restarted := NewSwiftKeyFetcher(ds, 0)
+	restarted.Saved = ds
+	restarted.AllowedHosts = []string{ts.URL}
+	defer restarted.Close()
+	swift.set("token-2", "key-2")
+	if k, err := restarted.Refresh("owner-key"); nil != err || "key-2" != k {
+		t.Error("Expected saved credentials to be loaded", k, err)
+	}
+
+	if err := f.Unregister("owner-key"); nil != err {
+		t.Error("Unexpected error unregistering", err)
+	}
+	if err := restarted.Sync(); nil != err || restarted.Registered("owner-key") {
+		t.Error("Expected credentials removed elsewhere to be dropped", err)
+	}
+}
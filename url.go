@@ -15,28 +15,64 @@ import (
 )
 
 type Tmpurl struct {
-	Url  string `json:"url"`
-	Path string `json:"path"`
+	Url  string            `json:"url"`
+	Path string            `json:"path"`
+	Urls map[string]string `json:"urls,omitempty"`
 }
 
 type UrlRequest struct {
-	Account   string `json:account`
-	Container string `json:container`
-	Object    string `json:object`
-	Method    string `json:method`
-	Key       string `json:"-"`
-	Host      string `json:"-"`
-	Duration  int64  `json:"duration"`
+	Account   string   `json:account`
+	Container string   `json:container`
+	Object    string   `json:object`
+	Method    string   `json:method`
+	Methods   []string `json:"methods,omitempty"`
+	Key       string   `json:"-"`
+	Host      string   `json:"-"`
+	// The rule granting the request, filled in by KeyForRequest
+	RuleId   string `json:"-"`
+	Duration int64  `json:"duration"`
 }
 
 func (u *UrlRequest) Valid() bool {
 	return "" != u.Account &&
 		"" != u.Container &&
 		"" != u.Object &&
-		"" != u.Method &&
+		len(u.RequestedMethods()) > 0 &&
 		u.Duration > 0
 }
 
+// All the distinct methods asked for, Method first followed by Methods,
+// upper cased in the order given
+func (u *UrlRequest) RequestedMethods() []string {
+	methods := make([]string, 0, 1+len(u.Methods))
+	seen := make(map[string]bool, 1+len(u.Methods))
+	for _, m := range append([]string{u.Method}, u.Methods...) {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if "" == m || seen[m] {
+			continue
+		}
+		seen[m] = true
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+// Does the comma separated set of methods from a rule permit method
+// A rule allowing GET implicitly allows HEAD as well
+func methodAllowed(ruleMethods, method string) bool {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if "" == method {
+		return false
+	}
+	for _, m := range strings.Split(ruleMethods, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == method || ("GET" == m && "HEAD" == method) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *UrlRequest) Path() string {
 	return fmt.Sprintf("/v1/%s/%s/%s", u.Account, u.Container, u.Object)
 }
@@ -49,7 +85,11 @@ func (u *UrlRequest) signature(expires int64) string {
 }
 
 func (u *UrlRequest) SignedUrl() string {
-	expires := time.Now().UTC().Unix() + u.Duration
+	return u.SignedUrlUntil(time.Now().UTC().Unix() + u.Duration)
+}
+
+// Signed to expire at the unix time expires rather than Duration from now
+func (u *UrlRequest) SignedUrlUntil(expires int64) string {
 	return fmt.Sprintf("%s%s?temp_url_sig=%s&temp_url_expires=%d", u.Host, u.Path(),
 		u.signature(expires), expires)
 }
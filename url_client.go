@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -15,35 +16,95 @@ type AtmClient struct {
 	ApiKey    string
 	ApiSecret string
 	AtmHost   string
+	// The server public key, or its fingerprint, signing keys may be sealed
+	// to. When empty whatever key the server reports is trusted
+	ServerPubkey string
 }
 
 func (c *AtmClient) RequestTempUrl(method, account, container, object string,
 	duration int64) (string, error) {
 
+	urls, err := c.requestTempUrls([]string{method}, account, container, object, duration)
+	if nil != err {
+		return "", err
+	}
+	return urls.Url, nil
+}
+
+// Request a temp url for each of methods to the same object, returning
+// a map of method to signed url
+func (c *AtmClient) RequestTempUrls(methods []string, account, container, object string,
+	duration int64) (map[string]string, error) {
+
+	urls, err := c.requestTempUrls(methods, account, container, object, duration)
+	if nil != err {
+		return nil, err
+	}
+	return urls.Urls, nil
+}
+
+func (c *AtmClient) requestTempUrls(methods []string, account, container, object string,
+	duration int64) (*Tmpurl, error) {
+
 	uri := "/v1/urls"
 	request := UrlRequest{
 		Account:   account,
 		Container: container,
 		Object:    object,
-		Method:    strings.ToUpper(method),
 		Duration:  duration,
 	}
-	json, err := json.Marshal(request)
+	for _, m := range methods {
+		request.Methods = append(request.Methods, strings.ToUpper(m))
+	}
+	if len(request.Methods) > 0 {
+		request.Method = request.Methods[0]
+		request.Methods = request.Methods[1:]
+	}
+	payload, err := json.Marshal(request)
 	if nil != err {
-		return "", err
+		return nil, err
 	}
+	resp, body, err := c.signedRequest("POST", uri, payload)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusCreated != resp.StatusCode {
+		return nil, errors.New(body)
+	}
+	urls := &Tmpurl{}
+	if err := json.Unmarshal([]byte(body), urls); nil != err {
+		return nil, err
+	}
+	if "" == urls.Url {
+		urls.Url = resp.Header.Get("Location")
+	}
+	return urls, nil
+}
+
+// Send the json payload to uri, signed with our api key & secret
+func (c *AtmClient) signedRequest(method, uri string, payload []byte) (gorequest.Response, string, error) {
+	method = strings.ToUpper(method)
 	hopts := NewHmacOpts(func(s string) (string, error) { return "", nil }, nil)
-	auth := AuthorizorForRequest(hopts, "POST", uri)
+	auth := AuthorizorForRequest(hopts, method, uri)
 	auth.ApiKey = c.ApiKey
-	auth.Md5 = md5Of(json)
+	auth.Md5 = md5Of(payload)
 	auth.Type = gorequest.Types["json"]
 	auth.Xtime = time.Now().UTC().Format(time.RFC3339)
 	auth.Nonce = fmt.Sprintf("%d", time.Now().UnixNano())
 
 	api := gorequest.New()
+	switch method {
+	case "GET":
+		api = api.Get(c.AtmHost + uri)
+	case "PUT":
+		api = api.Put(c.AtmHost + uri)
+	case "DELETE":
+		api = api.Delete(c.AtmHost + uri)
+	default:
+		api = api.Post(c.AtmHost + uri)
+	}
 
-	api = api.Post(c.AtmHost+uri).
-		Type("json").
+	api = api.Type("json").
 		Timeout(5*time.Second).
 		Set(XTIME, auth.Xtime).
 		Set(CONTENT_MD5, auth.Md5).
@@ -52,12 +113,260 @@ func (c *AtmClient) RequestTempUrl(method, account, container, object string,
 		Set("Authorization", fmt.Sprintf("%s %s:%s", hopts.AuthPrefix, c.ApiKey,
 			auth.SignatureWith(c.ApiSecret)))
 	api.BounceToRawString = true
-	resp, body, errs := api.Send(string(json)).End()
+	resp, body, errs := api.Send(string(payload)).End()
 	if nil != errs || len(errs) > 0 {
-		return "", errs[0]
+		return nil, "", errs[0]
+	}
+	return resp, body, nil
+}
+
+// Stage key as the new signing key of account, signing with it from
+// activateAt on & dropping it ttl later. A zero activateAt leaves the timing
+// to the server, a zero ttl keeps the key. The key is sealed to the server
+// public key so only the server can read it
+func (c *AtmClient) StageKey(account, key string, activateAt time.Time, ttl time.Duration) error {
+	pub, err := c.ServerPublicKey()
+	if nil != err {
+		return err
+	}
+	sealed, err := pub.Seal([]byte(key), account)
+	if nil != err {
+		return err
+	}
+	k := map[string]interface{}{"sealed_key": sealed}
+	if !activateAt.IsZero() {
+		k["activate_at"] = activateAt.Unix()
+	}
+	if ttl > 0 {
+		k["ttl"] = int64(ttl.Seconds())
+	}
+	payload, err := json.Marshal(k)
+	if nil != err {
+		return err
+	}
+	resp, body, err := c.signedRequest("PUT", "/v1/keys/"+account, payload)
+	if nil != err {
+		return err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return errors.New(body)
+	}
+	return nil
+}
+
+// Replace the signing key of account, signing with it right away
+func (c *AtmClient) SetKey(account, key string, ttl time.Duration) error {
+	return c.StageKey(account, key, time.Now(), ttl)
+}
+
+// Drop every signing key of account
+func (c *AtmClient) RemoveKey(account string) error {
+	resp, body, err := c.signedRequest("DELETE", "/v1/keys/"+account, nil)
+	if nil != err {
+		return err
+	}
+	if http.StatusNoContent != resp.StatusCode {
+		return errors.New(body)
+	}
+	return nil
+}
+
+// The key signing keys are sealed to before being sent
+func (c *AtmClient) ServerPublicKey() (*BoxPublicKey, error) {
+	resp, body, err := c.signedRequest("GET", "/v1/server-pubkey", nil)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, errors.New(body)
+	}
+	pub := &BoxPublicKey{}
+	if err := json.Unmarshal([]byte(body), pub); nil != err {
+		return nil, err
+	}
+	if "" != c.ServerPubkey {
+		if err := pub.Verify(c.ServerPubkey); nil != err {
+			return nil, err
+		}
+	}
+	return pub, nil
+}
+
+// What keys the server holds for account
+func (c *AtmClient) KeyStatus(account string) (*KeyStatus, error) {
+	resp, body, err := c.signedRequest("GET", "/v1/keys/"+account, nil)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, errors.New(body)
+	}
+	status := &KeyStatus{}
+	if err := json.Unmarshal([]byte(body), status); nil != err {
+		return nil, err
+	}
+	return status, nil
+}
+
+// A page of audit entries matching f, newest first, along with the before
+// to pass for the next page, 0 when there are no more
+func (c *AtmClient) Audit(f *AuditFilter) ([]*AuditEntry, int64, error) {
+	q := url.Values{}
+	strs := map[string]string{
+		"requestor_id": f.RequestorId,
+		"account":      f.Account,
+		"container":    f.Container,
+		"object":       f.Object,
+		"method":       f.Method,
+		"outcome":      f.Outcome,
+	}
+	for name, value := range strs {
+		if "" != value {
+			q.Set(name, value)
+		}
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", fmt.Sprintf("%d", f.Since.Unix()))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", fmt.Sprintf("%d", f.Until.Unix()))
+	}
+	if f.Before > 0 {
+		q.Set("before", fmt.Sprintf("%d", f.Before))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", fmt.Sprintf("%d", f.Limit))
+	}
+	uri := "/v1/audit"
+	if len(q) > 0 {
+		uri += "?" + q.Encode()
+	}
+	resp, body, err := c.signedRequest("GET", uri, nil)
+	if nil != err {
+		return nil, 0, err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, 0, errors.New(body)
+	}
+	page := &auditPage{}
+	if err := json.Unmarshal([]byte(body), page); nil != err {
+		return nil, 0, err
+	}
+	return page.Entries, page.Next, nil
+}
+
+// Proxy mode grants requested by, or for accounts owned by, the client
+func (c *AtmClient) Grants() ([]*Grant, error) {
+	resp, body, err := c.signedRequest("GET", "/v1/grants", nil)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, errors.New(body)
+	}
+	var grants []*Grant
+	if err := json.Unmarshal([]byte(body), &grants); nil != err {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Stop the opaque url of grant id working, immediately
+func (c *AtmClient) RevokeGrant(id string) error {
+	resp, body, err := c.signedRequest("DELETE", "/v1/grants/"+id, nil)
+	if nil != err {
+		return err
+	}
+	if http.StatusNoContent != resp.StatusCode {
+		return errors.New(body)
+	}
+	return nil
+}
+
+// The webhooks of account, without their secrets
+func (c *AtmClient) Webhooks(account string) ([]*Webhook, error) {
+	var hooks []*Webhook
+	if err := c.getJSON("/v1/webhooks/"+account, &hooks); nil != err {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// Add a webhook to account, returning it along with its secret
+func (c *AtmClient) AddWebhook(account string, h *Webhook) (*Webhook, error) {
+	payload, err := json.Marshal(h)
+	if nil != err {
+		return nil, err
+	}
+	resp, body, err := c.signedRequest("POST", "/v1/webhooks/"+account, payload)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusCreated != resp.StatusCode {
+		return nil, errors.New(body)
+	}
+	added := &Webhook{}
+	if err := json.Unmarshal([]byte(body), added); nil != err {
+		return nil, err
+	}
+	return added, nil
+}
+
+func (c *AtmClient) RemoveWebhook(account, id string) error {
+	resp, body, err := c.signedRequest("DELETE", "/v1/webhooks/"+account+"/"+id, nil)
+	if nil != err {
+		return err
+	}
+	if http.StatusNoContent != resp.StatusCode {
+		return errors.New(body)
+	}
+	return nil
+}
+
+// Deliveries to the webhooks of account that were given up on
+func (c *AtmClient) DeadLetters(account string) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	if err := c.getJSON("/v1/webhooks/"+account+"/dead-letters", &letters); nil != err {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func (c *AtmClient) getJSON(uri string, v interface{}) error {
+	resp, body, err := c.signedRequest("GET", uri, nil)
+	if nil != err {
+		return err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return errors.New(body)
+	}
+	return json.Unmarshal([]byte(body), v)
+}
+
+// Submit one unseal share to a sealed server
+func (c *AtmClient) Unseal(share string) (*SealStatus, error) {
+	payload, err := json.Marshal(map[string]string{"share": share})
+	if nil != err {
+		return nil, err
+	}
+	return c.sealRequest("POST", "/v1/unseal", payload)
+}
+
+func (c *AtmClient) SealStatus() (*SealStatus, error) {
+	return c.sealRequest("GET", "/v1/seal", nil)
+}
+
+func (c *AtmClient) sealRequest(method, uri string, payload []byte) (*SealStatus, error) {
+	resp, body, err := c.signedRequest(method, uri, payload)
+	if nil != err {
+		return nil, err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return nil, errors.New(body)
 	}
-	if http.StatusCreated == resp.StatusCode {
-		return resp.Header.Get("Location"), nil
+	status := &SealStatus{}
+	if err := json.Unmarshal([]byte(body), status); nil != err {
+		return nil, err
 	}
-	return "", errors.New(body)
+	return status, nil
 }
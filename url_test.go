@@ -0,0 +1,45 @@
+package atm
+
+import (
+	"testing"
+)
+
+func TestMethodAllowed(t *testing.T) {
+	cases := []struct {
+		rule    string
+		method  string
+		allowed bool
+	}{
+		{"GET", "GET", true},
+		{"GET", "HEAD", true},
+		{"GET", "PUT", false},
+		{"HEAD", "GET", false},
+		{"GET,HEAD", "HEAD", true},
+		{"PUT,POST", "post", true},
+		{"PUT, POST", "POST", true},
+		{"PUT,POST", "GET", false},
+		{"PUT", "", false},
+	}
+	for _, c := range cases {
+		if c.allowed != methodAllowed(c.rule, c.method) {
+			t.Error("Unexpected result for rule", c.rule, "method", c.method)
+		}
+	}
+}
+
+func TestRequestedMethods(t *testing.T) {
+	u := &UrlRequest{Method: "get", Methods: []string{"HEAD", "GET", " put "}}
+	m := u.RequestedMethods()
+	if 3 != len(m) || "GET" != m[0] || "HEAD" != m[1] || "PUT" != m[2] {
+		t.Error("Unexpected requested methods", m)
+	}
+	u = &UrlRequest{Methods: []string{"PUT", "POST"}}
+	m = u.RequestedMethods()
+	if 2 != len(m) || "PUT" != m[0] || "POST" != m[1] {
+		t.Error("Unexpected requested methods without Method", m)
+	}
+	u = &UrlRequest{Account: "a", Container: "c", Object: "o", Duration: 1}
+	if u.Valid() {
+		t.Error("Request without any method should not be valid")
+	}
+}
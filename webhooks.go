@@ -0,0 +1,542 @@
+// Copyright (c) 2016 Stuart Glenn
+// All rights reserved
+// Use of this source code is goverened by a BSD 3-clause license,
+// see included LICENSE file for details
+// Outbound webhooks, letting account owners hear of urls issued & keys
+// changed. Deliveries are signed, sent in the background & retried, with
+// those that never succeed kept as dead letters
+package atm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	WEBHOOK_URL_ISSUED  = "url.issued"
+	WEBHOOK_URL_DENIED  = "url.denied"
+	WEBHOOK_KEY_SET     = "key.set"
+	WEBHOOK_KEY_REMOVED = "key.removed"
+
+	WEBHOOK_EVENT_HEADER     = "X-Atm-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-Atm-Delivery"
+	WEBHOOK_TIMESTAMP_HEADER = "X-Atm-Timestamp"
+	// sha256=<hex hmac-sha256 of "<timestamp>.<body>" keyed by the secret>
+	WEBHOOK_SIGNATURE_HEADER = "X-Atm-Signature"
+
+	WEBHOOK_DEFAULT_ATTEMPTS = 5
+	WEBHOOK_DEFAULT_DELAY    = time.Second
+	WEBHOOK_QUEUE_SIZE       = 1000
+	WEBHOOK_TIMEOUT          = 10 * time.Second
+	// Dead letters listed per account, newest first
+	WEBHOOK_DEAD_LETTER_LIMIT = 100
+)
+
+var webhookEvents = map[string]bool{
+	WEBHOOK_URL_ISSUED:  true,
+	WEBHOOK_URL_DENIED:  true,
+	WEBHOOK_KEY_SET:     true,
+	WEBHOOK_KEY_REMOVED: true,
+}
+
+type Webhook struct {
+	Id        string `json:"id"`
+	AccountId string `json:"account_id"`
+	Url       string `json:"url"`
+	// Only returned when the webhook is added
+	Secret string `json:"secret,omitempty"`
+	// Event types to send, all when empty
+	Events []string `json:"events,omitempty"`
+	// Regexp of containers to send url events for, all when empty
+	Container string    `json:"container,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Check the url, events & container, filling in a missing id or secret
+func (h *Webhook) Prepare() error {
+	if !strings.HasPrefix(h.Url, "https://") && !strings.HasPrefix(h.Url, "http://") {
+		return errors.New("Webhook url must be http or https")
+	}
+	for _, e := range h.Events {
+		if !webhookEvents[e] {
+			return errors.New(fmt.Sprintf("Unknown webhook event %s", e))
+		}
+	}
+	if _, err := regexp.Compile(h.Container); nil != err {
+		return errors.New(fmt.Sprintf("Invalid container regexp: %s", err.Error()))
+	}
+	if "" == h.Id {
+		h.Id = randomHex(16)
+	}
+	if "" == h.Secret {
+		h.Secret = randomHex(32)
+	}
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (h *Webhook) matches(e *WebhookEvent) bool {
+	if len(h.Events) > 0 {
+		wanted := false
+		for _, t := range h.Events {
+			wanted = wanted || t == e.Type
+		}
+		if !wanted {
+			return false
+		}
+	}
+	if "" == h.Container || "" == e.Container {
+		return true
+	}
+	matched, err := regexp.MatchString(h.Container, e.Container)
+	return nil == err && matched
+}
+
+type WebhookEvent struct {
+	Id          string     `json:"id"`
+	Type        string     `json:"type"`
+	Time        time.Time  `json:"time"`
+	AccountId   string     `json:"account_id"`
+	Account     string     `json:"account"`
+	RequestorId string     `json:"requestor_id"`
+	Container   string     `json:"container,omitempty"`
+	Object      string     `json:"object,omitempty"`
+	Method      string     `json:"method,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	ClientIp    string     `json:"client_ip,omitempty"`
+}
+
+func NewWebhookEvent(eventType string) *WebhookEvent {
+	return &WebhookEvent{Id: randomHex(16), Type: eventType, Time: time.Now().UTC()}
+}
+
+type DeadLetter struct {
+	Id        int64         `json:"id"`
+	WebhookId string        `json:"webhook_id"`
+	AccountId string        `json:"account_id"`
+	Url       string        `json:"url"`
+	Event     *WebhookEvent `json:"event"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error"`
+	Time      time.Time     `json:"time"`
+}
+
+type WebhookStore interface {
+	AddWebhook(h *Webhook) error
+	RemoveWebhook(accountId, id string) error
+	WebhooksFor(accountId string) ([]*Webhook, error)
+	RecordDeadLetter(d *DeadLetter) error
+	DeadLetters(accountId string) ([]*DeadLetter, error)
+}
+
+// The signature header value for a delivery
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); nil != err {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Delivers events to the webhooks of their account in the background
+type WebhookSender struct {
+	Store       WebhookStore
+	Client      *http.Client
+	MaxAttempts int
+	// Before the first retry, doubling after each
+	RetryDelay time.Duration
+	// Loopback, link-local & private addresses webhooks may still reach,
+	// none by default
+	AllowedNetworks []*net.IPNet
+	// Allow plain http webhook urls, rather than only https
+	AllowHttp bool
+	lock      sync.RWMutex
+	queue     chan *WebhookEvent
+	wg        sync.WaitGroup
+}
+
+// A delivery of one event to one webhook, over its attempts
+type webhookDelivery struct {
+	hook    *Webhook
+	event   *WebhookEvent
+	body    []byte
+	attempt int
+	delay   time.Duration
+}
+
+func NewWebhookSender(store WebhookStore, workers int) *WebhookSender {
+	w := &WebhookSender{
+		Store:       store,
+		MaxAttempts: WEBHOOK_DEFAULT_ATTEMPTS,
+		RetryDelay:  WEBHOOK_DEFAULT_DELAY,
+		queue:       make(chan *WebhookEvent, WEBHOOK_QUEUE_SIZE),
+	}
+	// checked as connections are made, so a name resolving elsewhere after
+	// Check still can not reach internal services
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT, Control: w.dialControl}
+	w.Client = &http.Client{
+		Timeout:   WEBHOOK_TIMEOUT,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.work(w.queue)
+	}
+	return w
+}
+
+// Whether h may be delivered to, an https url (or http with AllowHttp) on
+// a host resolving only to public addresses or AllowedNetworks
+func (w *WebhookSender) Check(h *Webhook) error {
+	u, err := url.Parse(h.Url)
+	if nil != err || "" == u.Hostname() {
+		return errors.New("Invalid webhook url")
+	}
+	if "https" != u.Scheme && !(w.AllowHttp && "http" == u.Scheme) {
+		return errors.New("Webhook url must be https")
+	}
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if nil == ips[0] {
+		if ips, err = net.LookupIP(u.Hostname()); nil != err {
+			return errors.New(fmt.Sprintf("Unable to resolve webhook host %s", u.Hostname()))
+		}
+	}
+	for _, ip := range ips {
+		if !w.allowedAddress(ip) {
+			return errors.New(fmt.Sprintf("Webhook host %s is not a public address", u.Hostname()))
+		}
+	}
+	return nil
+}
+
+func (w *WebhookSender) allowedAddress(ip net.IP) bool {
+	if networksContain(w.AllowedNetworks, ip) {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func (w *WebhookSender) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if nil != err {
+		return err
+	}
+	if ip := net.ParseIP(host); nil == ip || !w.allowedAddress(ip) {
+		return errors.New(fmt.Sprintf("Webhook address %s is not allowed", host))
+	}
+	return nil
+}
+
+// Queue e for the webhooks of its account. When the queue is full it goes
+// straight to the dead letters
+func (w *WebhookSender) Notify(e *WebhookEvent) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if nil == w.queue {
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		w.deadLetter(&DeadLetter{AccountId: e.AccountId, Event: e, LastError: "Webhook queue full"})
+	}
+}
+
+// Stop taking events & wait for those queued, or waiting to be retried, to
+// be delivered or given up on
+func (w *WebhookSender) Close() {
+	w.lock.Lock()
+	if nil != w.queue {
+		close(w.queue)
+		w.queue = nil
+	}
+	w.lock.Unlock()
+	w.wg.Wait()
+}
+
+func (w *WebhookSender) work(queue chan *WebhookEvent) {
+	defer w.wg.Done()
+	for e := range queue {
+		hooks, err := w.Store.WebhooksFor(e.AccountId)
+		if nil != err {
+			w.deadLetter(&DeadLetter{AccountId: e.AccountId, Event: e, LastError: err.Error()})
+			continue
+		}
+		for _, h := range hooks {
+			if h.matches(e) {
+				w.deliver(h, e)
+			}
+		}
+	}
+}
+
+func (w *WebhookSender) deliver(h *Webhook, e *WebhookEvent) {
+	body, err := json.Marshal(e)
+	if nil != err {
+		log.Printf("webhook: %s. Error: %s", h.Id, err.Error())
+		return
+	}
+	w.attempt(&webhookDelivery{hook: h, event: e, body: body, delay: w.RetryDelay})
+}
+
+// Send d once, scheduling the next try on a timer rather than holding up
+// the worker, which goes on with other events meanwhile
+func (w *WebhookSender) attempt(d *webhookDelivery) {
+	d.attempt++
+	err := w.send(d.hook, d.event, d.body)
+	if nil == err {
+		return
+	}
+	if d.attempt >= w.MaxAttempts {
+		w.deadLetter(&DeadLetter{WebhookId: d.hook.Id, AccountId: d.hook.AccountId, Url: d.hook.Url, Event: d.event,
+			Attempts: d.attempt, LastError: err.Error()})
+		return
+	}
+	delay := d.delay
+	d.delay *= 2
+	w.wg.Add(1)
+	time.AfterFunc(delay, func() {
+		defer w.wg.Done()
+		w.attempt(d)
+	})
+}
+
+func (w *WebhookSender) send(h *Webhook, e *WebhookEvent, body []byte) error {
+	req, err := http.NewRequest("POST", h.Url, bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, e.Type)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, e.Id)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, WebhookSignature(h.Secret, timestamp, body))
+	resp, err := w.Client.Do(req)
+	if nil != err {
+		// without the url, which is logged & kept with the dead letter
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Webhook replied %s", resp.Status))
+	}
+	return nil
+}
+
+func (w *WebhookSender) deadLetter(d *DeadLetter) {
+	d.Time = time.Now().UTC()
+	// by id, receiver urls often carry a credential
+	log.Printf("webhook: giving up on %s event %s for webhook %s: %s", d.Event.Type, d.Event.Id, d.WebhookId, d.LastError)
+	if err := w.Store.RecordDeadLetter(d); nil != err {
+		log.Printf("webhook: %s. Error recording dead letter: %s", d.Event.Id, err.Error())
+	}
+}
+
+type MemoryWebhookStore struct {
+	lock        sync.RWMutex
+	hooks       []*Webhook
+	deadLetters []*DeadLetter
+	next        int64
+}
+
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{next: 1}
+}
+
+func (m *MemoryWebhookStore) AddWebhook(h *Webhook) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	copy := *h
+	m.hooks = append(m.hooks, &copy)
+	return nil
+}
+
+func (m *MemoryWebhookStore) RemoveWebhook(accountId, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, h := range m.hooks {
+		if accountId == h.AccountId && id == h.Id {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryWebhookStore) WebhooksFor(accountId string) ([]*Webhook, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []*Webhook
+	for _, h := range m.hooks {
+		if accountId == h.AccountId {
+			copy := *h
+			found = append(found, &copy)
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryWebhookStore) RecordDeadLetter(d *DeadLetter) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d.Id = m.next
+	m.next++
+	m.deadLetters = append(m.deadLetters, d)
+	if len(m.deadLetters) > AUDIT_MEMORY_SIZE {
+		m.deadLetters = m.deadLetters[len(m.deadLetters)-AUDIT_MEMORY_SIZE:]
+	}
+	return nil
+}
+
+func (m *MemoryWebhookStore) DeadLetters(accountId string) ([]*DeadLetter, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []*DeadLetter
+	for i := len(m.deadLetters) - 1; i >= 0 && len(found) < WEBHOOK_DEAD_LETTER_LIMIT; i-- {
+		if accountId == m.deadLetters[i].AccountId {
+			found = append(found, m.deadLetters[i])
+		}
+	}
+	return found, nil
+}
+
+// Secrets are encrypted when a kek is loaded, bound to the webhook id
+func (d *Datastore) AddWebhook(h *Webhook) error {
+	secret := h.Secret
+	if nil != d.keyRing {
+		sealed, err := d.keyRing.Seal([]byte(secret), h.Id)
+		if nil != err {
+			return err
+		}
+		secret = sealed
+	}
+	_, err := d.pool.Exec(d.rebind("INSERT INTO webhooks (id, account_id, url, secret, events, container, created_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?)"), h.Id, h.AccountId, h.Url, secret, strings.Join(h.Events, ","), h.Container,
+		h.CreatedAt.Unix())
+	return err
+}
+
+func (d *Datastore) RemoveWebhook(accountId, id string) error {
+	_, err := d.pool.Exec(d.rebind("DELETE FROM webhooks WHERE account_id = ? AND id = ?"), accountId, id)
+	return err
+}
+
+func (d *Datastore) WebhooksFor(accountId string) ([]*Webhook, error) {
+	rows, err := d.pool.Query(d.rebind("SELECT id, account_id, url, secret, events, container, created_at "+
+		"FROM webhooks WHERE account_id = ? ORDER BY created_at"), accountId)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*Webhook
+	for rows.Next() {
+		h := &Webhook{}
+		var events string
+		var createdAt int64
+		if err := rows.Scan(&h.Id, &h.AccountId, &h.Url, &h.Secret, &events, &h.Container, &createdAt); nil != err {
+			return nil, err
+		}
+		if IsSealed(h.Secret) {
+			if nil == d.keyRing {
+				return nil, errors.New(fmt.Sprintf("Secret for webhook %s is encrypted but no kek is loaded", h.Id))
+			}
+			plain, err := d.keyRing.Open(h.Secret, h.Id)
+			if nil != err {
+				return nil, err
+			}
+			h.Secret = string(plain)
+		}
+		if "" != events {
+			h.Events = strings.Split(events, ",")
+		}
+		h.CreatedAt = time.Unix(createdAt, 0).UTC()
+		found = append(found, h)
+	}
+	return found, rows.Err()
+}
+
+func (d *Datastore) RecordDeadLetter(l *DeadLetter) error {
+	event, err := json.Marshal(l.Event)
+	if nil != err {
+		return err
+	}
+	_, err = d.pool.Exec(d.rebind("INSERT INTO webhook_dead_letters (webhook_id, account_id, url, event, attempts, "+
+		"last_error, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"), l.WebhookId, l.AccountId, l.Url, string(event),
+		l.Attempts, l.LastError, l.Time.Unix())
+	return err
+}
+
+func (d *Datastore) DeadLetters(accountId string) ([]*DeadLetter, error) {
+	rows, err := d.pool.Query(d.rebind("SELECT id, webhook_id, account_id, url, event, attempts, last_error, "+
+		"created_at FROM webhook_dead_letters WHERE account_id = ? ORDER BY id DESC LIMIT ?"), accountId,
+		WEBHOOK_DEAD_LETTER_LIMIT)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*DeadLetter
+	for rows.Next() {
+		l, err := scanDeadLetter(rows)
+		if nil != err {
+			return nil, err
+		}
+		found = append(found, l)
+	}
+	return found, rows.Err()
+}
+
+func scanDeadLetter(rows *sql.Rows) (*DeadLetter, error) {
+	l := &DeadLetter{Event: &WebhookEvent{}}
+	var event string
+	var createdAt int64
+	err := rows.Scan(&l.Id, &l.WebhookId, &l.AccountId, &l.Url, &event, &l.Attempts, &l.LastError, &createdAt)
+	if nil != err {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(event), l.Event); nil != err {
+		return nil, err
+	}
+	l.Time = time.Unix(createdAt, 0).UTC()
+	return l, nil
+}
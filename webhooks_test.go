@@ -0,0 +1,99 @@
+package atm
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSenderCheck(t *testing.T) {
+	w := NewWebhookSender(NewMemoryWebhookStore(), 1)
+	defer w.Close()
+	for _, url := range []string{
+		"http://93.184.216.34/hook",
+		"https://127.0.0.1/hook",
+		"https://10.1.2.3/hook",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]/hook",
+		"https://0.0.0.0/hook",
+	} {
+		if err := w.Check(&Webhook{Url: url}); nil == err {
+			t.Error("Expected webhook url to be refused", url)
+		}
+	}
+	if err := w.Check(&Webhook{Url: "https://93.184.216.34/hook"}); nil != err {
+		t.Error("Expected a public https url to be allowed", err)
+	}
+	w.AllowedNetworks, _ = ParseNetworks([]string{"10.1.0.0/16"})
+	if err := w.Check(&Webhook{Url: "https://10.1.2.3/hook"}); nil != err {
+		t.Error("Expected an allowed network to be accepted", err)
+	}
+}
+
+func TestWebhookSenderRetries(t *testing.T) {
+	delivered := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/down") {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- r.Header.Get(WEBHOOK_EVENT_HEADER)
+	}))
+	defer receiver.Close()
+
+	store := NewMemoryWebhookStore()
+	store.AddWebhook(&Webhook{Id: "down", AccountId: "owner-key", Url: receiver.URL + "/down", Events: []string{WEBHOOK_KEY_SET}})
+	store.AddWebhook(&Webhook{Id: "up", AccountId: "owner-key", Url: receiver.URL + "/up", Events: []string{WEBHOOK_KEY_REMOVED}})
+	w := NewWebhookSender(store, 1)
+	w.AllowedNetworks, _ = ParseNetworks([]string{"127.0.0.0/8"})
+	w.MaxAttempts = 2
+	w.RetryDelay = time.Second
+
+	set := NewWebhookEvent(WEBHOOK_KEY_SET)
+	set.AccountId = "owner-key"
+	removed := NewWebhookEvent(WEBHOOK_KEY_REMOVED)
+	removed.AccountId = "owner-key"
+	w.Notify(set)
+	w.Notify(removed)
+	select {
+	case e := <-delivered:
+		if WEBHOOK_KEY_REMOVED != e {
+			t.Error("Unexpected delivery", e)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected the next event delivered while the failed one waits to retry")
+	}
+
+	w.Close()
+	letters, _ := store.DeadLetters("owner-key")
+	if 1 != len(letters) || 2 != letters[0].Attempts || "down" != letters[0].WebhookId {
+		t.Error("Expected the retried delivery given up on by Close", letters)
+	}
+}
+
+func TestWebhookSenderDeadLetterHidesUrl(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	store := NewMemoryWebhookStore()
+	store.AddWebhook(&Webhook{Id: "chat", AccountId: "owner-key", Url: "https://127.0.0.1:1/hooks/secret-token"})
+	w := NewWebhookSender(store, 1)
+	w.MaxAttempts = 1
+	e := NewWebhookEvent(WEBHOOK_KEY_SET)
+	e.AccountId = "owner-key"
+	w.Notify(e)
+	w.Close()
+
+	letters, _ := store.DeadLetters("owner-key")
+	if 1 != len(letters) || strings.Contains(letters[0].LastError, "secret-token") {
+		t.Error("Expected the refused delivery without its url in the error", letters)
+	}
+	if !strings.Contains(logged.String(), "webhook chat") || strings.Contains(logged.String(), "secret-token") {
+		t.Error("Expected the dead letter logged by webhook id", logged.String())
+	}
+}